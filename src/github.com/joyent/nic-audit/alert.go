@@ -9,16 +9,13 @@ package main
 
 import (
 	"container/list"
-	"fmt"
 	"log"
-	//	"net/smtp"
 	"os"
+	"time"
 )
 
 import (
-	"github.com/jordan-wright/email"
 	"github.com/joyent/triton-go/compute"
-	"net/smtp"
 )
 
 var alertLogger *log.Logger
@@ -34,108 +31,130 @@ type Alert struct {
 	Account      Account
 	NicGroupName string
 	NicGroupIds  []string
+	// When the violation was first seen and, for nic groups with a grace
+	// period, its stage and the time after which it is remediated
+	FirstSeen   time.Time
+	GraceStage  string
+	RemediateAt time.Time
+	// For alerts of network rules, the type of rule and how the instance
+	// violates it
+	RuleType  string
+	Violation string
+	// One of info, low, medium, high or critical
+	Severity string
 }
 
 // processAlerts iterates an aggregated list of alerts containing
-// offending network details and triggers an alert action for each
-// alert.
-func processAlerts(alerts list.List, client compute.ComputeClient,
-	config Configuration) {
+// offending network details and passes each alert and the result of any
+// remediation on to the configured alert sinks. Remediation is deferred
+// once the rate limits are reached or when the circuit breaker finds too
+// many of the account's instanceCount instances in violation.
+func processAlerts(alerts list.List, instanceCount int, client cloudAPI,
+	config Configuration, run *AuditRun, sink AlertSink) {
 
-	aggregate := "Instances with offending network combinations have been found.\n"
+	policy, _ := newRemediationPolicy(config.Remediation)
+
+	if run.limiter == nil {
+		run.limiter = newRemediationLimiter(policy)
+	}
+
+	breaker := circuitBreakerReason(alerts, instanceCount, policy)
+
+	if len(breaker) > 0 {
+		log.Printf("Halting remediation of account [%v]: %v\n",
+			alerts.Front().Value.(Alert).Account.AccountName, breaker)
+	}
 
 	for e := alerts.Front(); e != nil; e = e.Next() {
 		var alert Alert = e.Value.(Alert)
 		account := alert.Account
 
-		// Always write the alert being processed right away so that we
+		// Always emit the alert being processed right away so that we
 		// know the current item being processed
-		logAlert(alert)
-
-		aggregate += "\n======================================================\n"
-		aggregate += " Offending network match detected\n"
-		aggregate += "======================================================\n"
-		aggregate += fmt.Sprintf("  Account: %v\n", alert.Account.AccountName)
-		aggregate += fmt.Sprintf("  Account Description: %v\n", alert.Account.Description)
-		aggregate += fmt.Sprintf("  Triton URL: %v\n", alert.Account.TritonUrl)
-		aggregate += fmt.Sprintf("  Match Group: %v\n", alert.NicGroupName)
-		aggregate += fmt.Sprintf("  Networks Matched: %v\n", alert.NicGroupIds)
-		aggregate += fmt.Sprintf("  Instance ID: %v\n", alert.Instance.ID)
-		aggregate += fmt.Sprintf("  Instance Name: %v\n", alert.Instance.Name)
-		aggregate += fmt.Sprintf("  Instance IPs: %v\n", alert.Instance.IPs)
-		aggregate += fmt.Sprintf("  Instance Firewall Enabled: %v\n",
-			alert.Instance.FirewallEnabled)
-		aggregate += fmt.Sprintf("  Instance Networks: %v\n", alert.Instance.Networks)
-
-		if len(account.NetworksToRemove) > 0 {
-			networksRemoved, removeErr := removeNICsBasedOnNetworks(
-				account.NetworksToRemove, alert.Instance, client,
-				config.PrivateNetworkBlocks)
-			if removeErr != nil {
-				log.Printf("Error removing network for instance [%v]: %v\n",
-					alert.Instance.ID, removeErr)
-			} else {
-				aggregate += fmt.Sprintf("  Instance Networks Removed: %v\n",
-					networksRemoved)
-			}
+		sink.EmitAlert(alert)
+
+		actions := account.remediationActions(alert)
+
+		if len(actions) > 0 && !severityAtLeast(alert.Severity, policy.minSeverity) {
+			log.Printf("Remediation of instance [%v] skipped because severity "+
+				"[%v] is below [%v]\n", alert.Instance.ID, alert.Severity,
+				policy.minSeverity)
+			continue
 		}
 
-		if len(config.EmailAlerts.SmtpServer) > 0 {
-			emailAlerts(config.EmailAlerts, aggregate)
-		} else {
-			log.Println("Alert email is disable because no SMTP server " +
-				"has been set")
+		if len(actions) > 0 && alert.inGracePeriod() {
+			log.Printf("Remediation of instance [%v] deferred until the grace "+
+				"period ends at %v\n", alert.Instance.ID,
+				alert.RemediateAt.Format(time.RFC3339))
+			run.AlertsInGracePeriod++
+			continue
 		}
-	}
-}
 
-// logAlert outputs a message to STDOUT reporting the specified alert.
-func logAlert(alert Alert) {
-	alertLogger.Printf("%v: %v (%v) %v\n", alert.NicGroupName,
-		alert.Instance.Name, alert.Instance.ID, alert.Instance.IPs)
-}
+		if len(actions) > 0 {
+			cause, reason := deferCircuitBreaker, breaker
 
-// emailAlerts emails the contents of the specified body text to the
-// specified email recipients. Typically the body would contain an aggregation
-// of all of the email alters triggered per account.
-func emailAlerts(emailAlertConfig EmailAlerts, body string) {
-	mail := email.NewEmail()
-	mail.From = fmt.Sprintf("%v <%v>", emailAlertConfig.FromName,
-		emailAlertConfig.From)
-
-	mail.To = emailAlertConfig.To
-	mail.Bcc = emailAlertConfig.BCC
-	mail.Cc = emailAlertConfig.CC
-	mail.Subject = emailAlertConfig.Subject
-	mail.Headers.Add("Content-Type", "text/html; charset=UTF-8")
-	mail.Headers.Add("MIME-version", "1.0")
-	mail.Headers.Add("Content-Transfer-Encoding", "quoted-printable")
-
-	if len(emailAlertConfig.AdditionalBody) > 0 {
-		htmlFormat := "<html><body><pre>%v</pre><p>%v</p></body></html>"
-		mail.HTML = []byte(fmt.Sprintf(htmlFormat, body,
-			emailAlertConfig.AdditionalBody))
-		body += "\n\n" + emailAlertConfig.AdditionalBody
-	} else {
-		htmlFormat := "<html><body><pre>%v</pre></body></html>"
-		mail.HTML = []byte(fmt.Sprintf(htmlFormat, body))
-		mail.Text = []byte(body)
-	}
+			if len(reason) < 1 {
+				cause, reason = deferAccountLimit, run.limiter.deferral(account)
+			}
+
+			if len(reason) > 0 {
+				log.Printf("Remediation of instance [%v] deferred: %v\n",
+					alert.Instance.ID, reason)
+				run.DeferredRemediations = append(run.DeferredRemediations,
+					DeferredRemediation{
+						Account:      account.AccountName,
+						Datacenter:   account.Datacenter,
+						Instance:     alert.Instance.ID,
+						InstanceName: alert.Instance.Name,
+						NicGroup:     alert.NicGroupName,
+						Cause:        cause,
+						Reason:       reason,
+					})
+				auditMetrics.add(metricRemediationDeferred, accountMetricLabels(
+					account, "cause", cause), 1)
+				sink.EmitRemediation(alert, RemediationResult{Deferred: reason})
+				continue
+			}
 
-	serverWithPort := fmt.Sprintf("%v:%v", emailAlertConfig.SmtpServer,
-		emailAlertConfig.SmtpPort)
+			// Nothing is changed by dry runs and planned removals
+			if takesEffect(actions, policy) {
+				run.limiter.wait(account)
+			}
 
-	var auth smtp.Auth = nil
+			result := remediateAlert(alert, actions, client, config, policy, run)
 
-	if len(emailAlertConfig.SmtpUser) > 0 {
-		auth = smtp.PlainAuth(emailAlertConfig.SmtpIdentity, emailAlertConfig.SmtpUser,
-			emailAlertConfig.SmtpPassword, emailAlertConfig.SmtpServer)
-	}
+			if result.changedInstance() {
+				run.limiter.record(account)
+			}
 
-	mailErr := mail.Send(serverWithPort, auth)
+			blocked := networksWithOutcome(result.NICs, nicBlocked)
+			labels := accountMetricLabels(account)
+			auditMetrics.add(metricNICsRemoved, labels,
+				float64(len(result.NetworksRemoved)))
+			auditMetrics.add(metricNICsBlocked, labels, float64(len(blocked)))
+			run.NICsBlocked += len(blocked)
+
+			if result.Err != nil {
+				log.Printf("Error remediating instance [%v]: %v\n",
+					alert.Instance.ID, result.Err)
+				auditMetrics.add(metricRemediationFailed, labels, 1)
+			} else if pending := networksWithOutcome(result.NICs, nicPending); len(pending) > 0 {
+				log.Printf("Removal of networks %v from instance [%v] "+
+					"wasn't verified in time\n", pending, alert.Instance.ID)
+			} else if len(blocked) > 0 {
+				log.Printf("Removal of networks %v from instance [%v] "+
+					"was blocked by the remediation safety limits\n",
+					blocked, alert.Instance.ID)
+			} else if result.removedNothing() {
+				log.Printf("Instance [%v] wasn't remediated because none of its "+
+					"NICs are on the networks to remove\n", alert.Instance.ID)
+			} else if !result.isDryRun() {
+				run.AlertsRemediated++
+				run.RemediatedBySeverity = countSeverity(
+					run.RemediatedBySeverity, alert.Severity)
+			}
 
-	if mailErr != nil {
-		log.Printf("Error sending alert email using SMTP server [%v]. %v\n",
-			serverWithPort, mailErr)
+			sink.EmitRemediation(alert, result)
+		}
 	}
 }
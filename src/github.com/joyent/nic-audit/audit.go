@@ -10,31 +10,47 @@ package main
 import (
 	"container/list"
 	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
+	"strings"
+	"time"
 )
 
 import (
 	triton "github.com/joyent/triton-go"
 	"github.com/joyent/triton-go/authentication"
 	"github.com/joyent/triton-go/compute"
+	"github.com/joyent/triton-go/network"
 	"github.com/twinj/uuid"
 )
 
 // auditAccount is the main function that kicks off the process where
 // every account is audited for offending network combinations.
-func auditAccount(account Account, nicGroups map[string][]string, config Configuration) error {
+func auditAccount(account Account, nicGroups map[string][]string,
+	config Configuration, run *AuditRun, sink AlertSink) error {
 	log.Printf("%v\n", account)
 
-	client, clientErr := setupTritonClient(account)
+	rules, rulesErr := newNetworkRules(config.NetworkRules, nicGroups)
+
+	if rulesErr != nil {
+		return rulesErr
+	}
+
+	periods, periodsErr := newGracePeriods(config.Remediation, nicGroups)
+
+	if periodsErr != nil {
+		return periodsErr
+	}
+
+	client, clientErr := newCloudAPI(account)
 
 	if clientErr != nil {
 		return clientErr
 	}
 
-	listInput := &compute.ListInstancesInput{}
-	instances, instancesErr := client.Instances().List(context.Background(), listInput)
+	instances, instancesErr := client.ListInstances(context.Background())
 
 	if instancesErr != nil {
 		return instancesErr
@@ -42,47 +58,141 @@ func auditAccount(account Account, nicGroups map[string][]string, config Configu
 
 	alerts := createAlertsForOffendingNetworks(account, instances, nicGroups,
 		config.PrivateNetworkBlocks)
-	processAlerts(alerts, *client, config)
+	ruleAlerts := createAlertsForNetworkRules(account, instances, rules,
+		config.PrivateNetworkBlocks)
+	firewallAlerts := createAlertsForFirewalls(account, instances, alerts,
+		client, config)
+	alerts = mergeAlerts(config, alerts, ruleAlerts, firewallAlerts)
+	alerts = applyGracePeriods(alerts, run.violations, periods, time.Now())
+
+	if run.violations != nil {
+		run.violations.markAudited(account)
+	}
+
+	run.markAudited(account)
+
+	run.AccountsAudited++
+	run.InstancesScanned += len(instances)
+	run.AlertCount += alerts.Len()
+	for e := alerts.Front(); e != nil; e = e.Next() {
+		run.AlertsBySeverity = countSeverity(run.AlertsBySeverity,
+			e.Value.(Alert).Severity)
+	}
+	recordAuditMetrics(account, nicGroups, rules, len(instances), alerts)
+
+	processAlerts(alerts, len(instances), remediationCloudAPI(account, client),
+		config, run, sink)
+
+	auditMetrics.set(metricLastSuccessfulRun,
+		accountMetricLabels(account), float64(time.Now().Unix()))
 
 	return nil
 }
 
+// recordAuditMetrics updates the number of instances scanned and the number
+// of violations per nic group and network rule found by the latest audit of
+// an account.
+func recordAuditMetrics(account Account, nicGroups map[string][]string,
+	rules map[string]networkRule, instanceCount int, alerts list.List) {
+
+	auditMetrics.set(metricInstancesScanned,
+		accountMetricLabels(account), float64(instanceCount))
+
+	violations := make(map[string]int, len(nicGroups))
+	for nicGroup := range nicGroups {
+		violations[nicGroup] = 0
+	}
+	for ruleName := range rules {
+		violations[ruleName] = 0
+	}
+
+	for e := alerts.Front(); e != nil; e = e.Next() {
+		violations[e.Value.(Alert).NicGroupName]++
+	}
+
+	for nicGroup, count := range violations {
+		auditMetrics.set(metricViolations, accountMetricLabels(account,
+			"nic_group", nicGroup), float64(count))
+	}
+}
+
 // setupTritonClient configures and instantiates a Triton client that
 // allows you to programmatically access the Triton CloudAPI.
-func setupTritonClient(account Account) (*compute.ComputeClient, error) {
+func setupTritonClient(account Account) (cloudAPI, error) {
 	privateKey, privateKeyReadErr := ioutil.ReadFile(account.KeyPath)
 
 	if privateKeyReadErr != nil {
-		return &compute.ComputeClient{}, privateKeyReadErr
+		return nil, privateKeyReadErr
 	}
 
 	sshKeySigner, signerErr := authentication.NewPrivateKeySigner(
-		account.KeyId, privateKey, account.AccountName)
+		authentication.PrivateKeySignerInput{
+			KeyID:              account.KeyId,
+			PrivateKeyMaterial: privateKey,
+			AccountName:        account.AccountName,
+			Username:           account.User,
+		})
 
 	if signerErr != nil {
-		return &compute.ComputeClient{}, signerErr
+		return nil, signerErr
 	}
 
 	config := &triton.ClientConfig{
 		TritonURL:   account.TritonUrl,
 		AccountName: account.AccountName,
+		Username:    account.User,
 		Signers:     []authentication.Signer{sshKeySigner},
 	}
 
-	return compute.NewClient(config)
+	computeClient, computeErr := compute.NewClient(config)
+
+	if computeErr != nil {
+		return nil, computeErr
+	}
+
+	networkClient, networkErr := network.NewClient(config)
+
+	if networkErr != nil {
+		return nil, networkErr
+	}
+
+	// Retry transient failures of every request made by either client,
+	// assuming the roles of the sub-user on every attempt
+	computeClient.Client.HTTPClient.Transport = newRetryTransport(
+		newRoleTransport(computeClient.Client.HTTPClient.Transport, account.Roles))
+	networkClient.Client.HTTPClient.Transport = newRetryTransport(
+		newRoleTransport(networkClient.Client.HTTPClient.Transport, account.Roles))
+
+	return &tritonCloudAPI{
+		compute: computeClient,
+		network: networkClient,
+	}, nil
 }
 
 // createAlertsForOffendingNetworks aggregates alerts for every offending
-// network pattern match and returns the results as a list.
+// network pattern match and returns the results as a list. Instances whose
+// networks can't be matched are logged and skipped.
 func createAlertsForOffendingNetworks(account Account, instances []*compute.Instance,
 	nicGroups map[string][]string, privateNetworkBlocks []string) list.List {
 
 	alerts := list.New()
 
 	for _, instance := range instances {
+		if networksErr := checkNetworksMatchIPs(*instance); networksErr != nil {
+			log.Printf("ERROR: skipping instance [%v]: %v\n", instance.ID,
+				networksErr)
+			continue
+		}
+
 		for nicGroup, networkIds := range nicGroups {
-			matchingTotal := countMatchingNetworkIds(*instance, networkIds,
-				privateNetworkBlocks)
+			matchingTotal, matchErr := countMatchingNetworkIds(*instance,
+				networkIds, privateNetworkBlocks)
+
+			if matchErr != nil {
+				log.Printf("ERROR: skipping nic group [%v] of instance [%v]: %v\n",
+					nicGroup, instance.ID, matchErr)
+				continue
+			}
 
 			if matchingTotal == len(networkIds) {
 				alert := Alert{
@@ -102,19 +212,17 @@ func createAlertsForOffendingNetworks(account Account, instances []*compute.Inst
 // countMatchingNetworkIds counts the number of networks that matched the
 // offending network match criteria. Typically, the result of this method
 // would be compared to the number of offending networks in the nib_groups
-// configuration.
+// configuration. An error is returned when the networks of the instance
+// don't line up with its IPs, which can happen with an inventory file.
 func countMatchingNetworkIds(instance compute.Instance, searchStrings []string,
-	privateNetworkBlocks []string) int {
+	privateNetworkBlocks []string) (int, error) {
 
 	/* We correlate ip to network name in a map so that we only count a single
 	 * network once even if it matches multiple criteria. */
 	netToIps := make(map[string]string)
 
-	/* We make a *huge* assumption that the networks are in the same order
-	 * as the IPs and that they are always the same number. */
-	if len(instance.Networks) != len(instance.IPs) {
-		log.Fatalf("Network list [%v] doesn't match IP list [%v]\n",
-			instance.Networks, instance.IPs)
+	if networksErr := checkNetworksMatchIPs(instance); networksErr != nil {
+		return 0, networksErr
 	}
 
 	for i := 0; i < len(instance.Networks); i++ {
@@ -172,7 +280,57 @@ func countMatchingNetworkIds(instance compute.Instance, searchStrings []string,
 			continue
 		}
 
-		log.Fatalf("Invalid nic_group search string: %v\n", search)
+		return 0, fmt.Errorf("Invalid nic_group search string: %v", search)
 	}
-	return count
+	return count, nil
+}
+
+// checkNetworksMatchIPs returns an error unless the networks of the instance
+// line up with its IPs.
+func checkNetworksMatchIPs(instance compute.Instance) error {
+	/* We make a *huge* assumption that the networks are in the same order
+	 * as the IPs and that they are always the same number. */
+	if len(instance.Networks) != len(instance.IPs) {
+		return fmt.Errorf("Network list [%v] doesn't match IP list [%v]",
+			instance.Networks, instance.IPs)
+	}
+
+	return nil
+}
+
+// validateNicGroups checks that every member of every nic group is a search
+// string countMatchingNetworkIds understands: a network UUID, a comma
+// delimited list of CIDRs or "public".
+func validateNicGroups(nicGroups map[string][]string) error {
+	for nicGroup, members := range nicGroups {
+		if len(members) < 1 {
+			return fmt.Errorf("Nic group [%v] has no members", nicGroup)
+		}
+
+		for _, member := range members {
+			if !isNicGroupMember(member) {
+				return fmt.Errorf("Invalid member [%v] of nic group [%v]; "+
+					"expected a network UUID, a list of CIDRs or public",
+					member, nicGroup)
+			}
+		}
+	}
+
+	return nil
+}
+
+func isNicGroupMember(search string) bool {
+	if _, uuidErr := uuid.Parse(search); uuidErr == nil || search == "public" {
+		return true
+	}
+
+	cidrs := strings.Split(search, ",")
+
+	for _, cidr := range cidrs {
+		if _, _, cidrErr := net.ParseCIDR(strings.TrimSpace(cidr)); cidrErr != nil {
+			return false
+		}
+	}
+
+	return true
 }
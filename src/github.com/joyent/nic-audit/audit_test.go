@@ -39,7 +39,7 @@ func TestCountOfMatchingNetworkIdsMatchesCIDR(t *testing.T) {
 		"192.168.0.0/16",
 	}
 
-	count := countMatchingNetworkIds(instance, search, privateBlocks)
+	count, _ := countMatchingNetworkIds(instance, search, privateBlocks)
 
 	if count != 1 {
 		t.Errorf("Expected 1 networks matched. Actually matched %v networks.",
@@ -74,7 +74,7 @@ func TestCountOfMatchingNetworkIdsMatchesPublic(t *testing.T) {
 		"192.168.0.0/16",
 	}
 
-	count := countMatchingNetworkIds(instance, search, privateBlocks)
+	count, _ := countMatchingNetworkIds(instance, search, privateBlocks)
 
 	if count != 1 {
 		t.Errorf("Expected 1 networks matched. Actually matched %v networks.",
@@ -109,7 +109,7 @@ func TestCountOfMatchingNetworkIdsMatchesUUID(t *testing.T) {
 		"192.168.0.0/16",
 	}
 
-	count := countMatchingNetworkIds(instance, search, privateBlocks)
+	count, _ := countMatchingNetworkIds(instance, search, privateBlocks)
 
 	if count != 1 {
 		t.Errorf("Expected 1 networks matched. Actually matched %v networks.",
@@ -144,7 +144,7 @@ func TestCountOfMatchingNetworkIdsNoMatches(t *testing.T) {
 		"192.168.0.0/16",
 	}
 
-	count := countMatchingNetworkIds(instance, search, privateBlocks)
+	count, _ := countMatchingNetworkIds(instance, search, privateBlocks)
 
 	if count != 0 {
 		t.Errorf("Expected 0 networks matched. Actually matched %v networks.",
@@ -179,7 +179,7 @@ func TestCountOfMatchingNetworkIdsMatchesPublicAndCIDRShouldCountAsOne(t *testin
 		"192.168.0.0/16",
 	}
 
-	count := countMatchingNetworkIds(instance, search, privateBlocks)
+	count, _ := countMatchingNetworkIds(instance, search, privateBlocks)
 
 	if count != 1 {
 		t.Errorf("Expected 1 networks matched. Actually matched %v networks.",
@@ -214,7 +214,7 @@ func TestCountOfMatchingNetworkIdsMatchesTwoCIDROutOfManyShouldCountAsOne(t *tes
 		"192.168.0.0/16",
 	}
 
-	count := countMatchingNetworkIds(instance, search, privateBlocks)
+	count, _ := countMatchingNetworkIds(instance, search, privateBlocks)
 
 	if count != 1 {
 		t.Errorf("Expected 1 networks matched. Actually matched %v networks.",
@@ -248,7 +248,7 @@ func TestCountOfMatchingNetworkIdsMatchesTwoCIDRShouldCountAsOne(t *testing.T) {
 		"105.160.112.0/22",
 	}
 
-	count := countMatchingNetworkIds(instance, search, privateBlocks)
+	count, _ := countMatchingNetworkIds(instance, search, privateBlocks)
 
 	if count != 1 {
 		t.Errorf("Expected 1 networks matched. Actually matched %v networks.",
@@ -284,10 +284,82 @@ func TestCountOfMatchingNetworkIdsMatchesMultipleCIDRSearch(t *testing.T) {
 		"105.160.112.0/22",
 	}
 
-	count := countMatchingNetworkIds(instance, search, privateBlocks)
+	count, _ := countMatchingNetworkIds(instance, search, privateBlocks)
 
 	if count != 2 {
 		t.Errorf("Expected 1 networks matched. Actually matched %v networks.",
 			count)
 	}
 }
+
+func TestCreateAlertsSkipsInstanceWithMismatchedNetworks(t *testing.T) {
+	mismatched := &compute.Instance{
+		ID:       "mismatched",
+		Networks: []string{testPublicNetwork, testIntranetNetwork},
+		IPs:      []string{"165.122.33.45"},
+	}
+	offender := &compute.Instance{
+		ID:       testOffenderID,
+		Networks: []string{testPublicNetwork, testIntranetNetwork},
+		IPs:      []string{"165.122.33.44", "10.2.45.234"},
+	}
+
+	if _, err := countMatchingNetworkIds(*mismatched, []string{"public"},
+		testPrivateBlocks); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+
+	config := testAuditConfiguration()
+	alerts := createAlertsForOffendingNetworks(Account{AccountName: "some.user"},
+		[]*compute.Instance{mismatched, offender}, config.NicGroups,
+		config.PrivateNetworkBlocks)
+
+	if alerts.Len() != 1 || alerts.Front().Value.(Alert).Instance.ID != testOffenderID {
+		t.Errorf("Expected a single alert for the offending instance. Actually: %v",
+			alerts.Len())
+	}
+}
+
+func TestCreateAlertsEvaluatesOtherNicGroupsAfterAnError(t *testing.T) {
+	offender := &compute.Instance{
+		ID:       testOffenderID,
+		Networks: []string{testPublicNetwork, testIntranetNetwork},
+		IPs:      []string{"165.122.33.44", "10.2.45.234"},
+	}
+	nicGroups := map[string][]string{
+		"invalid":             {"not-a-network"},
+		"public-and-intranet": {"public", testIntranetNetwork},
+	}
+
+	for i := 0; i < 10; i++ {
+		alerts := createAlertsForOffendingNetworks(Account{AccountName: "some.user"},
+			[]*compute.Instance{offender}, nicGroups, testPrivateBlocks)
+
+		if alerts.Len() != 1 {
+			t.Fatalf("Expected a single alert for the valid nic group. "+
+				"Actually: %v", alerts.Len())
+		}
+	}
+}
+
+func TestValidateNicGroups(t *testing.T) {
+	valid := map[string][]string{
+		"all-kinds": {"public", testIntranetNetwork, "10.0.0.0/8, 192.168.0.0/16"},
+	}
+
+	if err := validateNicGroups(valid); err != nil {
+		t.Error(err)
+	}
+
+	invalid := []map[string][]string{
+		{"typo": {"pubilc"}},
+		{"bad-cidr": {"10.0.0.0/8,10.0.0.300/24"}},
+		{"empty": {}},
+	}
+
+	for _, nicGroups := range invalid {
+		if err := validateNicGroups(nicGroups); err == nil {
+			t.Errorf("Expected error and none was thrown: %v", nicGroups)
+		}
+	}
+}
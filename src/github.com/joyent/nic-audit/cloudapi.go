@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+import (
+	"github.com/joyent/triton-go/client"
+	"github.com/joyent/triton-go/compute"
+	tritonerrors "github.com/joyent/triton-go/errors"
+	"github.com/joyent/triton-go/network"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// cloudAPI is the subset of the Triton CloudAPI used to audit accounts and
+// remediate offending network configurations.
+type cloudAPI interface {
+	ListInstances(ctx context.Context) ([]*compute.Instance, error)
+	ListNICs(ctx context.Context, instanceID string) ([]*compute.NIC, error)
+	RemoveNIC(ctx context.Context, instanceID string, mac string) error
+	AddNIC(ctx context.Context, instanceID string, networkID string, ip string) (*compute.NIC, error)
+	ListNetworks(ctx context.Context) ([]*network.Network, error)
+	StopInstance(ctx context.Context, instanceID string) error
+	EnableFirewall(ctx context.Context, instanceID string) error
+	AddTags(ctx context.Context, instanceID string, tags map[string]string) error
+	UpdateMetadata(ctx context.Context, instanceID string, metadata map[string]string) error
+	ListFirewallRules(ctx context.Context, instanceID string) ([]*network.FirewallRule, error)
+	ListDatacenters(ctx context.Context) ([]*compute.DataCenter, error)
+}
+
+// newCloudAPI creates the CloudAPI client for an account. It is a variable
+// so that tests can substitute a fake CloudAPI.
+var newCloudAPI = setupTritonClient
+
+// tritonCloudAPI implements cloudAPI using the triton-go clients and
+// records the latency and errors of every request.
+type tritonCloudAPI struct {
+	compute *compute.ComputeClient
+	network *network.NetworkClient
+}
+
+func (t *tritonCloudAPI) ListInstances(ctx context.Context) ([]*compute.Instance, error) {
+	started := time.Now()
+	instances, err := t.compute.Instances().List(ctx, &compute.ListInstancesInput{})
+	observeCloudAPI("ListInstances", started, err)
+
+	return instances, err
+}
+
+func (t *tritonCloudAPI) ListNICs(ctx context.Context, instanceID string) ([]*compute.NIC, error) {
+	started := time.Now()
+	nics, err := t.compute.Instances().ListNICs(ctx, &compute.ListNICsInput{
+		InstanceID: instanceID,
+	})
+	observeCloudAPI("ListNICs", started, err)
+
+	return nics, err
+}
+
+func (t *tritonCloudAPI) RemoveNIC(ctx context.Context, instanceID string, mac string) error {
+	started := time.Now()
+	err := t.compute.Instances().RemoveNIC(ctx, &compute.RemoveNICInput{
+		InstanceID: instanceID,
+		MAC:        mac,
+	})
+	observeCloudAPI("RemoveNIC", started, err)
+
+	return err
+}
+
+// AddNIC adds a NIC on the network to the instance. When an IP is given it
+// is requested for the NIC, falling back to any IP on the network if
+// CloudAPI reports that the IP is unavailable. Any other error is returned
+// as it is, since the NIC may have been added regardless.
+func (t *tritonCloudAPI) AddNIC(ctx context.Context, instanceID string,
+	networkID string, ip string) (*compute.NIC, error) {
+
+	started := time.Now()
+	var nic *compute.NIC
+	var err error
+
+	if len(ip) > 0 {
+		nic, err = t.addNICWithIP(ctx, instanceID, networkID, ip)
+
+		if err != nil && !isIPUnavailable(err) {
+			observeCloudAPI("AddNIC", started, err)
+			return nil, err
+		}
+
+		if err != nil {
+			log.Printf("Unable to request IP [%v] on network [%v] for "+
+				"instance [%v]: %v\n", ip, networkID, instanceID, err)
+		}
+	}
+
+	if nic == nil {
+		nic, err = t.compute.Instances().AddNIC(ctx, &compute.AddNICInput{
+			InstanceID: instanceID,
+			Network:    networkID,
+		})
+	}
+
+	observeCloudAPI("AddNIC", started, err)
+
+	return nic, err
+}
+
+// addNICWithIP adds a NIC using a network object that requests a specific
+// IP, which the AddNIC call of the triton-go client doesn't support.
+func (t *tritonCloudAPI) addNICWithIP(ctx context.Context, instanceID string,
+	networkID string, ip string) (*compute.NIC, error) {
+
+	tritonClient := t.compute.Client
+	body, err := tritonClient.ExecuteRequest(ctx, client.RequestInput{
+		Method: http.MethodPost,
+		Path: fmt.Sprintf("/%s/machines/%s/nics", tritonClient.AccountName,
+			instanceID),
+		Body: map[string]interface{}{
+			"network": map[string]interface{}{
+				"ipv4_uuid": networkID,
+				"ipv4_ips":  []string{ip},
+			},
+		},
+	})
+
+	if body != nil {
+		defer body.Close()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	nic := &compute.NIC{}
+
+	if decodeErr := json.NewDecoder(body).Decode(nic); decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	return nic, nil
+}
+
+// isIPUnavailable determines if CloudAPI refused to add a NIC because the
+// requested IP is in use or isn't part of the network, which it reports as
+// an invalid argument. No NIC is added when the request is refused.
+func isIPUnavailable(err error) bool {
+	apiErr, ok := asAPIError(err)
+
+	return ok && (apiErr.Code == "InvalidArgument" ||
+		apiErr.Code == "InvalidParameters")
+}
+
+// asAPIError returns the error CloudAPI answered a failed request with, or
+// false when the request failed before CloudAPI answered it. The triton-go
+// clients wrap the errors of their requests, so the cause is checked.
+func asAPIError(err error) (*tritonerrors.APIError, bool) {
+	apiErr, ok := pkgerrors.Cause(err).(*tritonerrors.APIError)
+
+	return apiErr, ok
+}
+
+func (t *tritonCloudAPI) ListNetworks(ctx context.Context) ([]*network.Network, error) {
+	started := time.Now()
+	networks, err := t.network.List(ctx, &network.ListInput{})
+	observeCloudAPI("ListNetworks", started, err)
+
+	return networks, err
+}
+
+func (t *tritonCloudAPI) StopInstance(ctx context.Context, instanceID string) error {
+	started := time.Now()
+	err := t.compute.Instances().Stop(ctx, &compute.StopInstanceInput{
+		InstanceID: instanceID,
+	})
+	observeCloudAPI("StopInstance", started, err)
+
+	return err
+}
+
+func (t *tritonCloudAPI) EnableFirewall(ctx context.Context, instanceID string) error {
+	started := time.Now()
+	err := t.compute.Instances().EnableFirewall(ctx, &compute.EnableFirewallInput{
+		ID: instanceID,
+	})
+	observeCloudAPI("EnableFirewall", started, err)
+
+	return err
+}
+
+func (t *tritonCloudAPI) AddTags(ctx context.Context, instanceID string,
+	tags map[string]string) error {
+
+	started := time.Now()
+	err := t.compute.Instances().AddTags(ctx, &compute.AddTagsInput{
+		ID:   instanceID,
+		Tags: tags,
+	})
+	observeCloudAPI("AddTags", started, err)
+
+	return err
+}
+
+func (t *tritonCloudAPI) UpdateMetadata(ctx context.Context, instanceID string,
+	metadata map[string]string) error {
+
+	started := time.Now()
+	_, err := t.compute.Instances().UpdateMetadata(ctx, &compute.UpdateMetadataInput{
+		ID:       instanceID,
+		Metadata: metadata,
+	})
+	observeCloudAPI("UpdateMetadata", started, err)
+
+	return err
+}
+
+func (t *tritonCloudAPI) ListFirewallRules(ctx context.Context,
+	instanceID string) ([]*network.FirewallRule, error) {
+
+	started := time.Now()
+	rules, err := t.network.Firewall().ListMachineRules(ctx,
+		&network.ListMachineRulesInput{
+			MachineID: instanceID,
+		})
+	observeCloudAPI("ListFirewallRules", started, err)
+
+	return rules, err
+}
+
+func (t *tritonCloudAPI) ListDatacenters(ctx context.Context) ([]*compute.DataCenter, error) {
+	started := time.Now()
+	datacenters, err := t.compute.Datacenters().List(ctx,
+		&compute.ListDataCentersInput{})
+	observeCloudAPI("ListDatacenters", started, err)
+
+	return datacenters, err
+}
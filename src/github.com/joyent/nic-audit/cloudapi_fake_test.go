@@ -0,0 +1,489 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+	tritonerrors "github.com/joyent/triton-go/errors"
+	"github.com/joyent/triton-go/network"
+)
+
+// fakeCloudAPI is an in-memory implementation of the CloudAPI calls used
+// by the auditing tool.
+type fakeCloudAPI struct {
+	mutex        sync.Mutex
+	instances    []*compute.Instance
+	nics         map[string][]*compute.NIC
+	networks     []*network.Network
+	removeErrors map[string]error
+	stuck        map[string]bool
+	removed      []string
+	added        []string
+	actions      []string
+	rules        map[string][]*network.FirewallRule
+	datacenters  []*compute.DataCenter
+}
+
+// newFakeCloudAPI creates an empty fake CloudAPI.
+func newFakeCloudAPI() *fakeCloudAPI {
+	return &fakeCloudAPI{
+		nics:         make(map[string][]*compute.NIC),
+		removeErrors: make(map[string]error),
+		stuck:        make(map[string]bool),
+		rules:        make(map[string][]*network.FirewallRule),
+	}
+}
+
+// addInstance adds an instance with the specified NICs to the fake. The
+// IPs and networks of the instance are derived from its NICs.
+func (f *fakeCloudAPI) addInstance(id string, name string, nics ...*compute.NIC) *compute.Instance {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	instance := &compute.Instance{ID: id, Name: name}
+	f.instances = append(f.instances, instance)
+	f.nics[id] = nics
+	f.syncInstance(instance)
+
+	return instance
+}
+
+// syncInstance updates the IPs and networks of an instance from its NICs.
+// The caller must hold the mutex.
+func (f *fakeCloudAPI) syncInstance(instance *compute.Instance) {
+	instance.IPs = nil
+	instance.Networks = nil
+
+	for _, nic := range f.nics[instance.ID] {
+		instance.IPs = append(instance.IPs, nic.IP)
+		instance.Networks = append(instance.Networks, nic.Network)
+
+		if nic.Primary {
+			instance.PrimaryIP = nic.IP
+		}
+	}
+}
+
+func (f *fakeCloudAPI) ListInstances(ctx context.Context) ([]*compute.Instance, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	instances := make([]*compute.Instance, 0, len(f.instances))
+	for _, instance := range f.instances {
+		copied := *instance
+		instances = append(instances, &copied)
+	}
+
+	return instances, nil
+}
+
+func (f *fakeCloudAPI) ListNICs(ctx context.Context, instanceID string) ([]*compute.NIC, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	nics, ok := f.nics[instanceID]
+
+	if !ok {
+		return nil, fmt.Errorf("Instance [%v] not found", instanceID)
+	}
+
+	copied := make([]*compute.NIC, 0, len(nics))
+	for _, nic := range nics {
+		nicCopy := *nic
+		copied = append(copied, &nicCopy)
+	}
+
+	return copied, nil
+}
+
+func (f *fakeCloudAPI) RemoveNIC(ctx context.Context, instanceID string, mac string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if removeErr, ok := f.removeErrors[normalizeMAC(mac)]; ok {
+		return removeErr
+	}
+
+	// Stuck NICs accept the removal but never disappear
+	if f.stuck[normalizeMAC(mac)] {
+		return nil
+	}
+
+	nics := f.nics[instanceID]
+
+	for i, nic := range nics {
+		if normalizeMAC(nic.MAC) != normalizeMAC(mac) {
+			continue
+		}
+
+		f.nics[instanceID] = append(nics[:i:i], nics[i+1:]...)
+		f.removed = append(f.removed, nic.MAC)
+
+		for _, instance := range f.instances {
+			if instance.ID == instanceID {
+				f.syncInstance(instance)
+			}
+		}
+
+		return nil
+	}
+
+	// CloudAPI answers with an error of its own for NICs it doesn't know
+	return &tritonerrors.APIError{StatusCode: http.StatusNotFound,
+		Code:    "ResourceNotFound",
+		Message: fmt.Sprintf("NIC [%v] not found on instance [%v]", mac, instanceID)}
+}
+
+func (f *fakeCloudAPI) AddNIC(ctx context.Context, instanceID string,
+	networkID string, ip string) (*compute.NIC, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	nics, ok := f.nics[instanceID]
+
+	if !ok {
+		return nil, fmt.Errorf("Instance [%v] not found", instanceID)
+	}
+
+	for _, nic := range nics {
+		if len(ip) > 0 && nic.IP == ip {
+			return nil, fmt.Errorf("IP [%v] is already in use", ip)
+		}
+	}
+
+	if len(ip) < 1 {
+		ip = fmt.Sprintf("10.99.0.%v", len(nics)+1)
+	}
+
+	nic := &compute.NIC{
+		MAC:     fmt.Sprintf("90:b8:d0:99:00:%02x", len(f.added)+1),
+		IP:      ip,
+		Network: networkID,
+	}
+	f.nics[instanceID] = append(nics, nic)
+	f.added = append(f.added, nic.MAC)
+
+	for _, instance := range f.instances {
+		if instance.ID == instanceID {
+			f.syncInstance(instance)
+		}
+	}
+
+	copied := *nic
+	return &copied, nil
+}
+
+func (f *fakeCloudAPI) ListNetworks(ctx context.Context) ([]*network.Network, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.networks, nil
+}
+
+// updateInstance applies a change to the instance with the specified ID
+// and records the action. The caller must hold the mutex.
+func (f *fakeCloudAPI) updateInstance(instanceID string, action string,
+	change func(*compute.Instance)) error {
+
+	for _, instance := range f.instances {
+		if instance.ID == instanceID {
+			change(instance)
+			f.actions = append(f.actions, action)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Instance [%v] not found", instanceID)
+}
+
+func (f *fakeCloudAPI) StopInstance(ctx context.Context, instanceID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.updateInstance(instanceID, "StopInstance", func(instance *compute.Instance) {
+		instance.State = "stopped"
+	})
+}
+
+func (f *fakeCloudAPI) EnableFirewall(ctx context.Context, instanceID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.updateInstance(instanceID, "EnableFirewall", func(instance *compute.Instance) {
+		instance.FirewallEnabled = true
+	})
+}
+
+func (f *fakeCloudAPI) AddTags(ctx context.Context, instanceID string,
+	tags map[string]string) error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.updateInstance(instanceID, "AddTags", func(instance *compute.Instance) {
+		if instance.Tags == nil {
+			instance.Tags = make(map[string]interface{})
+		}
+
+		for key, value := range tags {
+			instance.Tags[key] = value
+		}
+	})
+}
+
+func (f *fakeCloudAPI) UpdateMetadata(ctx context.Context, instanceID string,
+	metadata map[string]string) error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.updateInstance(instanceID, "UpdateMetadata", func(instance *compute.Instance) {
+		if instance.Metadata == nil {
+			instance.Metadata = make(map[string]string)
+		}
+
+		for key, value := range metadata {
+			instance.Metadata[key] = value
+		}
+	})
+}
+
+func (f *fakeCloudAPI) ListFirewallRules(ctx context.Context,
+	instanceID string) ([]*network.FirewallRule, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.rules[instanceID], nil
+}
+
+func (f *fakeCloudAPI) ListDatacenters(ctx context.Context) ([]*compute.DataCenter, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.datacenters, nil
+}
+
+// performedActions returns the instance actions performed so far.
+func (f *fakeCloudAPI) performedActions() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]string(nil), f.actions...)
+}
+
+// removedMACs returns the MAC addresses of every NIC removed so far.
+func (f *fakeCloudAPI) removedMACs() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]string(nil), f.removed...)
+}
+
+// normalizeMAC strips separators from a MAC address so that the formats
+// used in request paths and responses can be compared.
+func normalizeMAC(mac string) string {
+	return strings.ToLower(strings.Replace(mac, ":", "", -1))
+}
+
+// useFakeCloudAPI replaces the CloudAPI client factory with one returning
+// the specified fake. The returned function restores the original factory.
+func useFakeCloudAPI(fake cloudAPI) func() {
+	return useCloudAPIFactory(func(account Account) (cloudAPI, error) {
+		return fake, nil
+	})
+}
+
+// useCloudAPIFactory makes newCloudAPI create clients with the factory and
+// returns a function restoring the original.
+func useCloudAPIFactory(factory func(account Account) (cloudAPI, error)) func() {
+	original := newCloudAPI
+	newCloudAPI = factory
+
+	return func() {
+		newCloudAPI = original
+	}
+}
+
+// signatureHeaderPattern parses the HTTP signature Authorization header.
+var signatureHeaderPattern = regexp.MustCompile(
+	`^Signature keyId="([^"]+)",algorithm="([^"]+)",(?:headers="([^"]+)",)?signature="([^"]+)"$`)
+
+// newFakeCloudAPIServer serves the fake CloudAPI over HTTP, rejecting any
+// request that isn't signed by the specified key for the account.
+func newFakeCloudAPIServer(fake *fakeCloudAPI, accountName string,
+	publicKey *rsa.PublicKey) *httptest.Server {
+
+	keyID := fmt.Sprintf("/%v/keys/%v", accountName, sshMD5Fingerprint(publicKey))
+	machinesPath := regexp.MustCompile(`^/` + regexp.QuoteMeta(accountName) + `/machines$`)
+	nicsPath := regexp.MustCompile(`^/` + regexp.QuoteMeta(accountName) + `/machines/([^/]+)/nics$`)
+	nicPath := regexp.MustCompile(`^/` + regexp.QuoteMeta(accountName) + `/machines/([^/]+)/nics/([^/]+)$`)
+	networksPath := regexp.MustCompile(`^/` + regexp.QuoteMeta(accountName) + `/networks$`)
+
+	handler := func(writer http.ResponseWriter, request *http.Request) {
+		if authErr := verifyHTTPSignature(request, keyID, publicKey); authErr != nil {
+			writeFakeError(writer, http.StatusUnauthorized, "InvalidCredentials",
+				authErr.Error())
+			return
+		}
+
+		ctx := request.Context()
+		path := request.URL.Path
+
+		switch {
+		case request.Method == http.MethodGet && machinesPath.MatchString(path):
+			instances, _ := fake.ListInstances(ctx)
+			writeFakeJSON(writer, http.StatusOK, instances)
+		case request.Method == http.MethodGet && nicsPath.MatchString(path):
+			instanceID := nicsPath.FindStringSubmatch(path)[1]
+			nics, nicsErr := fake.ListNICs(ctx, instanceID)
+
+			if nicsErr != nil {
+				writeFakeError(writer, http.StatusNotFound, "ResourceNotFound",
+					nicsErr.Error())
+				return
+			}
+
+			writeFakeJSON(writer, http.StatusOK, nics)
+		case request.Method == http.MethodDelete && nicPath.MatchString(path):
+			matches := nicPath.FindStringSubmatch(path)
+			removeErr := fake.RemoveNIC(ctx, matches[1], matches[2])
+
+			if apiErr, ok := asAPIError(removeErr); ok {
+				writeFakeError(writer, apiErr.StatusCode, apiErr.Code,
+					apiErr.Message)
+				return
+			}
+
+			if removeErr != nil {
+				writeFakeError(writer, http.StatusInternalServerError,
+					"InternalError", removeErr.Error())
+				return
+			}
+
+			writer.WriteHeader(http.StatusNoContent)
+		case request.Method == http.MethodGet && networksPath.MatchString(path):
+			networks, _ := fake.ListNetworks(ctx)
+			writeFakeJSON(writer, http.StatusOK, networks)
+		default:
+			writeFakeError(writer, http.StatusNotFound, "ResourceNotFound",
+				fmt.Sprintf("%v %v not found", request.Method, path))
+		}
+	}
+
+	return httptest.NewServer(http.HandlerFunc(handler))
+}
+
+// verifyHTTPSignature checks that the request was signed by the specified
+// key using the HTTP signature scheme used by CloudAPI.
+func verifyHTTPSignature(request *http.Request, keyID string, publicKey *rsa.PublicKey) error {
+	matches := signatureHeaderPattern.FindStringSubmatch(request.Header.Get("Authorization"))
+
+	if matches == nil {
+		return fmt.Errorf("Missing or malformed Authorization header")
+	}
+
+	if matches[1] != keyID {
+		return fmt.Errorf("Unknown key [%v]", matches[1])
+	}
+
+	var hashType crypto.Hash
+	var hasher hash.Hash
+
+	switch strings.ToLower(matches[2]) {
+	case "rsa-sha1":
+		hashType, hasher = crypto.SHA1, sha1.New()
+	case "rsa-sha256":
+		hashType, hasher = crypto.SHA256, sha256.New()
+	case "rsa-sha512":
+		hashType, hasher = crypto.SHA512, sha512.New()
+	default:
+		return fmt.Errorf("Unsupported algorithm [%v]", matches[2])
+	}
+
+	signature, decodeErr := base64.StdEncoding.DecodeString(matches[4])
+
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	hasher.Write([]byte("date: " + request.Header.Get("Date")))
+
+	return rsa.VerifyPKCS1v15(publicKey, hashType, hasher.Sum(nil), signature)
+}
+
+// sshMD5Fingerprint returns the colon delimited MD5 fingerprint of an RSA
+// public key in its SSH wire format.
+func sshMD5Fingerprint(publicKey *rsa.PublicKey) string {
+	var wire []byte
+
+	appendBytes := func(data []byte) {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(data)))
+		wire = append(wire, length...)
+		wire = append(wire, data...)
+	}
+
+	appendMPInt := func(value *big.Int) {
+		data := value.Bytes()
+
+		if len(data) > 0 && data[0]&0x80 != 0 {
+			data = append([]byte{0}, data...)
+		}
+
+		appendBytes(data)
+	}
+
+	appendBytes([]byte("ssh-rsa"))
+	appendMPInt(big.NewInt(int64(publicKey.E)))
+	appendMPInt(publicKey.N)
+
+	sum := md5.Sum(wire)
+	parts := make([]string, len(sum))
+
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+func writeFakeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+func writeFakeError(writer http.ResponseWriter, status int, code string, message string) {
+	writeFakeJSON(writer, status, map[string]string{
+		"code":    code,
+		"message": message,
+	})
+}
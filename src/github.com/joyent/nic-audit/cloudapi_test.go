@@ -0,0 +1,461 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+	tritonerrors "github.com/joyent/triton-go/errors"
+)
+
+const (
+	testIntranetNetwork = "e70b8c02-91b8-11e7-ae1f-9392cd8e4bf7"
+	testPublicNetwork   = "14323a83-b0e3-44e8-bd67-fc7078cc94ba"
+	testPrivateNetwork  = "70294144-7680-43d2-9ed0-897ce1658f80"
+)
+
+var testPrivateBlocks = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+}
+
+// newTestFakeCloudAPI creates a fake with one instance on a public network
+// and the privileged intranet, and one instance on private networks only.
+// The intranet NIC is the primary NIC of the offending instance.
+func newTestFakeCloudAPI() *fakeCloudAPI {
+	fake := newFakeCloudAPI()
+	fake.addInstance("4167e82f-2bd8-46c0-ad4b-7899398c8720", "offender",
+		&compute.NIC{MAC: "90:b8:d0:00:00:01", IP: "165.122.33.44",
+			Network: testPublicNetwork},
+		&compute.NIC{MAC: "90:b8:d0:00:00:02", IP: "10.2.45.234",
+			Network: testIntranetNetwork, Primary: true})
+	fake.addInstance("91ddcc19-b7f9-47b8-8258-f2741bd44112", "compliant",
+		&compute.NIC{MAC: "90:b8:d0:00:00:03", IP: "192.168.0.7",
+			Network: testPrivateNetwork, Primary: true},
+		&compute.NIC{MAC: "90:b8:d0:00:00:04", IP: "10.2.45.235",
+			Network: testIntranetNetwork})
+
+	return fake
+}
+
+func testAuditConfiguration() Configuration {
+	return Configuration{
+		PrivateNetworkBlocks: testPrivateBlocks,
+		NicGroups: map[string][]string{
+			"public-and-intranet": {"public", testIntranetNetwork},
+		},
+	}
+}
+
+// testTempDir creates a temporary directory for the files of a test and
+// returns it along with a function that removes it.
+func testTempDir(t *testing.T) (string, func()) {
+	dir, dirErr := ioutil.TempDir("", "nic-audit")
+
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestAuditAccountRemovesOffendingNICsEndToEnd(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	auditErr := auditAccount(account, config.NicGroups, config, run, sink)
+
+	if auditErr != nil {
+		t.Fatal(auditErr)
+	}
+
+	if len(sink.alerts) != 1 || sink.alerts[0].Instance.Name != "offender" {
+		t.Fatalf("Expected a single alert for the offending instance: %+v",
+			sink.alerts)
+	}
+
+	removed := fake.removedMACs()
+
+	if len(removed) != 1 || removed[0] != "90:b8:d0:00:00:01" {
+		t.Errorf("Expected only the public NIC to be removed: %v", removed)
+	}
+
+	if len(sink.remediations) != 1 || sink.remediations[0].Err != nil {
+		t.Fatalf("Expected a successful remediation: %+v", sink.remediations)
+	}
+
+	if nics := sink.remediations[0].NICs; len(nics) != 1 || nics[0].Outcome != nicRemoved {
+		t.Errorf("Expected the NIC removal to be verified: %+v", nics)
+	}
+
+	if run.AlertCount != 1 || run.AlertsRemediated != 1 || run.InstancesScanned != 2 {
+		t.Errorf("Unexpected run summary: %+v", run)
+	}
+}
+
+func TestAuditAccountReportsFailedRemediation(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	fake.removeErrors[normalizeMAC("90:b8:d0:00:00:01")] = errors.New("boom")
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.remediations) != 1 || sink.remediations[0].Err == nil {
+		t.Errorf("Expected a failed remediation: %+v", sink.remediations)
+	}
+
+	if run.AlertsRemediated != 0 {
+		t.Errorf("Expected no remediated alerts. Actually: %v", run.AlertsRemediated)
+	}
+}
+
+func TestAuditAccountContinuesRemovingAfterNICFailure(t *testing.T) {
+	fake := newFakeCloudAPI()
+	fake.addInstance("4167e82f-2bd8-46c0-ad4b-7899398c8720", "offender",
+		&compute.NIC{MAC: "90:b8:d0:00:00:01", IP: "165.122.33.44",
+			Network: testPublicNetwork},
+		&compute.NIC{MAC: "90:b8:d0:00:00:05", IP: "165.122.33.45",
+			Network: testPublicNetwork},
+		&compute.NIC{MAC: "90:b8:d0:00:00:02", IP: "10.2.45.234",
+			Network: testIntranetNetwork, Primary: true})
+	fake.removeErrors[normalizeMAC("90:b8:d0:00:00:01")] = errors.New("boom")
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 1 || removed[0] != "90:b8:d0:00:00:05" {
+		t.Errorf("Expected the second public NIC to be removed: %v", removed)
+	}
+
+	if len(sink.remediations) != 1 || sink.remediations[0].Err == nil {
+		t.Fatalf("Expected a partially failed remediation: %+v", sink.remediations)
+	}
+
+	nics := sink.remediations[0].NICs
+
+	if len(nics) != 2 {
+		t.Fatalf("Expected a result for both public NICs: %+v", nics)
+	}
+
+	if nics[0].Outcome != nicFailed || nics[0].Err == nil || nics[0].IP != "165.122.33.44" {
+		t.Errorf("Expected the first NIC to have failed: %+v", nics[0])
+	}
+
+	if nics[1].Outcome != nicRemoved || nics[1].Err != nil {
+		t.Errorf("Expected the second NIC to be removed: %+v", nics[1])
+	}
+}
+
+func TestAuditAccountReportsUnverifiedRemovalAsPending(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	fake.stuck[normalizeMAC("90:b8:d0:00:00:01")] = true
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.Remediation = RemediationConfig{
+		VerifyTimeout:  "20ms",
+		VerifyInterval: "5ms",
+	}
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.remediations) != 1 {
+		t.Fatalf("Expected a remediation: %+v", sink.remediations)
+	}
+
+	result := sink.remediations[0]
+
+	if len(result.NICs) != 1 || result.NICs[0].Outcome != nicPending ||
+		len(result.NetworksRemoved) != 0 {
+		t.Errorf("Expected the NIC removal to be pending: %+v", result)
+	}
+
+	if run.AlertsRemediated != 0 {
+		t.Errorf("Expected no remediated alerts. Actually: %v", run.AlertsRemediated)
+	}
+}
+
+func TestAuditAccountBlocksRemovalOfPrimaryNIC(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{testIntranetNetwork},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 0 {
+		t.Errorf("Expected the primary NIC to be kept: %v", removed)
+	}
+
+	if len(sink.remediations) != 1 || len(sink.remediations[0].NICs) != 1 ||
+		sink.remediations[0].NICs[0].Outcome != nicBlocked {
+		t.Fatalf("Expected a blocked removal: %+v", sink.remediations)
+	}
+
+	if actions := sink.remediations[0].Actions; len(actions) != 1 ||
+		actions[0].Outcome != actionBlocked || actions[0].Err == nil {
+		t.Errorf("Expected the remove_nics action to be blocked: %+v", actions)
+	}
+
+	if run.NICsBlocked != 1 || run.AlertsRemediated != 0 {
+		t.Errorf("Unexpected run summary: %+v", run)
+	}
+}
+
+func TestAuditAccountOnlyRemovesNICsPartOfTheViolation(t *testing.T) {
+	fake := newFakeCloudAPI()
+	fake.addInstance("4167e82f-2bd8-46c0-ad4b-7899398c8720", "offender",
+		&compute.NIC{MAC: "90:b8:d0:00:00:01", IP: "165.122.33.44",
+			Network: testPublicNetwork},
+		&compute.NIC{MAC: "90:b8:d0:00:00:02", IP: "10.2.45.234",
+			Network: testIntranetNetwork, Primary: true},
+		&compute.NIC{MAC: "90:b8:d0:00:00:06", IP: "192.168.0.8",
+			Network: testPrivateNetwork})
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public", "192.168.0.0/16"},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 1 || removed[0] != "90:b8:d0:00:00:01" {
+		t.Errorf("Expected only the public NIC of the violation to be removed: %v",
+			removed)
+	}
+}
+
+func TestAuditAccountDoesNotCountEmptyRemovalAsRemediated(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"192.168.0.0/16"},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 0 {
+		t.Errorf("Expected no NICs to be removed: %v", removed)
+	}
+
+	if run.AlertCount != 1 || run.AlertsRemediated != 0 {
+		t.Errorf("Expected the alert not to be remediated: %+v", run)
+	}
+
+	if len(sink.remediations) != 1 || !sink.remediations[0].removedNothing() {
+		t.Errorf("Expected the remediation to report that nothing was removed: %+v",
+			sink.remediations)
+	}
+}
+
+func TestAuditAccountPrefersNicGroupNetworksToRemove(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{testIntranetNetwork},
+		NicGroupNetworksToRemove: map[string][]string{
+			"public-and-intranet": {"public"},
+		},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 1 || removed[0] != "90:b8:d0:00:00:01" {
+		t.Errorf("Expected the nic group networks to be removed: %v", removed)
+	}
+
+	if run.NICsBlocked != 0 {
+		t.Errorf("Expected the account networks not to be used: %+v", run)
+	}
+}
+
+func TestAuditAccountWithoutRemediationLeavesNICs(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	auditErr := auditAccount(Account{AccountName: "some.user"},
+		config.NicGroups, config, run, sink)
+
+	if auditErr != nil {
+		t.Fatal(auditErr)
+	}
+
+	if len(sink.alerts) != 1 || len(fake.removedMACs()) != 0 {
+		t.Errorf("Expected an alert without removals. Alerts: %v Removed: %v",
+			len(sink.alerts), fake.removedMACs())
+	}
+}
+
+func TestIsIPUnavailableOnlyMatchesCloudAPIRefusal(t *testing.T) {
+	if !isIPUnavailable(&tritonerrors.APIError{StatusCode: http.StatusConflict,
+		Code: "InvalidArgument", Message: "IP is already in use"}) {
+		t.Error("Expected an invalid argument to report the IP as unavailable")
+	}
+
+	if isIPUnavailable(&tritonerrors.APIError{StatusCode: http.StatusInternalServerError,
+		Code: "InternalError"}) {
+		t.Error("Expected an internal error not to report the IP as unavailable")
+	}
+
+	if isIPUnavailable(errors.New("unexpected EOF")) {
+		t.Error("Expected a decoding error not to report the IP as unavailable")
+	}
+}
+
+func TestTritonCloudAPIAgainstFakeServer(t *testing.T) {
+	privateKey, keyErr := rsa.GenerateKey(rand.Reader, 2048)
+
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+
+	keyPath := filepath.Join(dir, "id_rsa")
+	keyPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+
+	if writeErr := ioutil.WriteFile(keyPath, keyPem, 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	fake := newTestFakeCloudAPI()
+	server := newFakeCloudAPIServer(fake, "some.user", &privateKey.PublicKey)
+	defer server.Close()
+
+	account := Account{
+		AccountName: "some.user",
+		TritonUrl:   server.URL,
+		KeyPath:     keyPath,
+		KeyId:       sshMD5Fingerprint(&privateKey.PublicKey),
+	}
+
+	client, clientErr := setupTritonClient(account)
+
+	if clientErr != nil {
+		t.Fatal(clientErr)
+	}
+
+	instances, listErr := client.ListInstances(context.Background())
+
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+
+	if len(instances) != 2 {
+		t.Fatalf("Expected 2 instances. Actually: %v", len(instances))
+	}
+
+	nics, nicsErr := client.ListNICs(context.Background(), instances[0].ID)
+
+	if nicsErr != nil || len(nics) != 2 {
+		t.Fatalf("Expected 2 NICs. Actually: %v %v", len(nics), nicsErr)
+	}
+
+	removeErr := client.RemoveNIC(context.Background(), instances[0].ID, nics[0].MAC)
+
+	if removeErr != nil {
+		t.Fatal(removeErr)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 1 {
+		t.Errorf("Expected NIC to be removed by the fake server: %v", removed)
+	}
+
+	removeErr = client.RemoveNIC(context.Background(), instances[0].ID, probeMAC)
+
+	if apiErr, ok := asAPIError(removeErr); !ok || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected CloudAPI to answer that the NIC doesn't exist: %v",
+			removeErr)
+	}
+}
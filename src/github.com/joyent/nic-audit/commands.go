@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runCommand executes the command specified as positional arguments on the
+// command line instead of performing an audit.
+func runCommand(args []string, config Configuration) error {
+	switch args[0] {
+	case "spool":
+		return runSpoolCommand(args[1:], config)
+	case "export-inventory":
+		return runExportInventoryCommand(args[1:], config)
+	case "plan":
+		return runPlanCommand(args[1:], config)
+	case "apply":
+		if len(args) != 1 {
+			return fmt.Errorf("Usage: apply")
+		}
+
+		return runApplyCommand(config)
+	case "journal":
+		return runJournalCommand(args[1:], config)
+	case "restore":
+		if len(args) != 3 {
+			return fmt.Errorf("Usage: restore <instance id> <mac>")
+		}
+
+		return restoreNIC(config, args[1], args[2])
+	default:
+		return fmt.Errorf("Unknown command [%v]", strings.Join(args, " "))
+	}
+}
+
+// runSpoolCommand lists or flushes the spooled alert emails.
+func runSpoolCommand(args []string, config Configuration) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: spool list|flush")
+	}
+
+	configs := spoolingEmailConfigs(config)
+
+	if len(configs) < 1 {
+		return fmt.Errorf("No spool_dir has been configured for email alerts")
+	}
+
+	switch args[0] {
+	case "list":
+		for _, emailConfig := range configs {
+			messages, listErr := listSpooledEmails(emailConfig.SpoolDir)
+
+			if listErr != nil {
+				return listErr
+			}
+
+			for _, message := range messages {
+				fmt.Printf("%v\t%v\t%v attempt(s)\t%v\t%v\n", message.ID,
+					message.Created.Format("2006-01-02T15:04:05Z07:00"),
+					message.Attempts, message.Subject, message.LastError)
+			}
+		}
+	case "flush":
+		for _, emailConfig := range configs {
+			delivered, flushErr := flushSpool(emailConfig, true)
+			log.Printf("Delivered %v spooled email(s) from [%v]\n", delivered,
+				emailConfig.SpoolDir)
+
+			if flushErr != nil {
+				return flushErr
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown spool command [%v]. Usage: spool list|flush",
+			args[0])
+	}
+
+	return nil
+}
+
+// runExportInventoryCommand writes the inventory of every configured account
+// to the specified file or to STDOUT.
+func runExportInventoryCommand(args []string, config Configuration) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: export-inventory [path]")
+	}
+
+	if len(args) < 1 || args[0] == "-" {
+		return exportInventory(config, os.Stdout)
+	}
+
+	file, createErr := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if createErr != nil {
+		return createErr
+	}
+
+	exportErr := exportInventory(config, file)
+	closeErr := file.Close()
+
+	if exportErr != nil {
+		return exportErr
+	}
+
+	return closeErr
+}
+
+// runJournalCommand lists the entries of the remediation journal.
+func runJournalCommand(args []string, config Configuration) error {
+	if len(args) != 1 || args[0] != "list" {
+		return fmt.Errorf("Usage: journal list")
+	}
+
+	if len(config.Remediation.Journal) < 1 {
+		return fmt.Errorf("No remediation journal has been configured")
+	}
+
+	entries, readErr := readJournal(config.Remediation.Journal)
+
+	if readErr != nil {
+		return readErr
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			entry.Time.Format("2006-01-02T15:04:05Z07:00"), entry.Action,
+			accountInDatacenter(entry.Account, entry.Datacenter), entry.Instance,
+			entry.MAC, entry.Network, entry.IP, entry.NicGroup)
+	}
+
+	return nil
+}
+
+// runPlanCommand shows or approves the entries of the remediation plan.
+func runPlanCommand(args []string, config Configuration) error {
+	usage := fmt.Errorf("Usage: plan show|approve all|<id> ...")
+
+	if len(args) < 1 {
+		return usage
+	}
+
+	switch args[0] {
+	case "show":
+		plan, _, loadErr := loadVerifiedPlan(config.Remediation)
+
+		if loadErr != nil {
+			return loadErr
+		}
+
+		fmt.Printf("Plan created %v\n", plan.Created.Format("2006-01-02T15:04:05Z07:00"))
+
+		for _, entry := range plan.Entries {
+			approval := "pending"
+			if entry.Approved {
+				approval = "approved by " + entry.ApprovedBy
+			}
+
+			fmt.Printf("%v\t%v\t%v\t%v (%v)\t%v\t%v\t%v\t%v\n", entry.ID,
+				approval, accountInDatacenter(entry.Account, entry.Datacenter),
+				entry.InstanceName, entry.Instance,
+				entry.NicGroup, entry.MAC, entry.IP, entry.Network)
+		}
+	case "approve":
+		if len(args) < 2 {
+			return usage
+		}
+
+		return approvePlan(config.Remediation, args[1:], os.Getenv("USER"))
+	default:
+		return usage
+	}
+
+	return nil
+}
+
+// runApplyCommand removes the NICs of the approved entries of the
+// remediation plan and reports the outcome of each.
+func runApplyCommand(config Configuration) error {
+	outcomes, applyErr := applyPlan(config)
+
+	if applyErr != nil {
+		return applyErr
+	}
+
+	var ids []int
+	for id := range outcomes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	failures := 0
+
+	for _, id := range ids {
+		outcome := outcomes[id]
+		detail := ""
+
+		if outcome.Err != nil {
+			detail = outcome.Err.Error()
+		}
+
+		if outcome.Outcome != nicRemoved {
+			failures++
+		}
+
+		fmt.Printf("%v\t%v\t%v\t%v\t%v\n", id, outcome.Outcome, outcome.MAC,
+			outcome.IP, detail)
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%v of %v approved NIC removals weren't applied",
+			failures, len(ids))
+	}
+
+	return nil
+}
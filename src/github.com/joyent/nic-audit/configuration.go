@@ -8,9 +8,7 @@
 package main
 
 import (
-	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 )
@@ -22,20 +20,36 @@ import (
 
 // Configuration contains all of the configuration values for the application.
 type Configuration struct {
-	EmailAlerts          EmailAlerts         `json:"email_alerts"`
-	PrivateNetworkBlocks []string            `json:"private_network_blocks"`
-	NicGroups            map[string][]string `json:"nic_groups"`
-	Accounts             []Account           `json:"accounts"`
+	EmailAlerts          EmailAlerts            `json:"email_alerts"`
+	AlertSinks           []AlertSinkConfig      `json:"alert_sinks"`
+	Metrics              MetricsConfig          `json:"metrics"`
+	CloudAPIRetry        RetryConfig            `json:"cloudapi_retry"`
+	Remediation          RemediationConfig      `json:"remediation"`
+	PrivateNetworkBlocks []string               `json:"private_network_blocks"`
+	NicGroups            map[string][]string    `json:"nic_groups"`
+	NicGroupSeverities   map[string]string      `json:"nic_group_severities"`
+	NetworkRules         map[string]NetworkRule `json:"network_rules"`
+	FirewallAudit        FirewallAuditConfig    `json:"firewall_audit"`
+	Accounts             []Account              `json:"accounts"`
 }
 
 // EmailAlerts contains the configuration needed to send an email to alert when
 // an offending network match is found.
 type EmailAlerts struct {
-	SmtpServer     string `json:"smtp_server"`
-	SmtpPort       int    `json:"smtp_port"`
-	SmtpIdentity   string `json:"smtp_identity"`
-	SmtpUser       string `json:"smtp_user"`
-	SmtpPassword   string `json:"smtp_password"`
+	SmtpServer   string `json:"smtp_server"`
+	SmtpPort     int    `json:"smtp_port"`
+	SmtpIdentity string `json:"smtp_identity"`
+	SmtpUser     string `json:"smtp_user"`
+	SmtpPassword string `json:"smtp_password"`
+	// TLS mode (none, starttls or tls), CA bundle, certificate name to
+	// verify and client certificate used to connect to the SMTP server
+	SmtpTLS        string `json:"smtp_tls"`
+	SmtpCAFile     string `json:"smtp_ca_file"`
+	SmtpServerName string `json:"smtp_server_name"`
+	SmtpClientCert string `json:"smtp_client_cert"`
+	SmtpClientKey  string `json:"smtp_client_key"`
+	// Authentication mechanism (plain, login or cram-md5)
+	SmtpAuth       string `json:"smtp_auth"`
 	To             []string
 	CC             []string
 	BCC            []string
@@ -43,6 +57,66 @@ type EmailAlerts struct {
 	FromName       string `json:"from_name"`
 	Subject        string
 	AdditionalBody string `json:"additional_body"`
+	// Directory in which undeliverable emails are kept to be retried and
+	// the maximum age of a spooled email (e.g. "72h") before it is dropped
+	SpoolDir    string `json:"spool_dir"`
+	SpoolMaxAge string `json:"spool_max_age"`
+	// Named sets of recipients that accounts can reference by email_route
+	Routes map[string]EmailRoute `json:"routes"`
+	// Additional escalation recipients for alerts of a nic group
+	NicGroupRecipients map[string]EmailRoute `json:"nic_group_recipients"`
+	// Optional templates overriding the default subject and bodies
+	SubjectTemplate string `json:"subject_template"`
+	TextTemplate    string `json:"text_template"`
+	HTMLTemplate    string `json:"html_template"`
+}
+
+// MetricsConfig contains the configuration for exposing Prometheus metrics
+// either over HTTP or as a file for the node exporter textfile collector.
+type MetricsConfig struct {
+	ListenAddress string `json:"listen_address"`
+	Textfile      string `json:"textfile"`
+}
+
+// RemediationConfig contains the configuration for removing offending NICs.
+type RemediationConfig struct {
+	// How long to wait for a removed NIC to disappear from its instance
+	// (e.g. "2m") and how often to check
+	VerifyTimeout  string `json:"verify_timeout"`
+	VerifyInterval string `json:"verify_interval"`
+	// Allow removing the primary NIC of an instance
+	AllowPrimary bool `json:"allow_primary"`
+	// Maximum number of NICs and instances changed in a single run, where
+	// zero is unlimited
+	MaxNICsPerRun      int `json:"max_nics_per_run"`
+	MaxInstancesPerRun int `json:"max_instances_per_run"`
+	// Report the remediation actions that would be taken without taking them
+	DryRun bool `json:"dry_run"`
+	// Append-only file recording every NIC removed so that it can be restored
+	Journal string `json:"journal"`
+	// Write proposed NIC removals to a plan file signed with the key in
+	// plan_key_file to be approved and applied instead of removing them
+	RequireApproval bool   `json:"require_approval"`
+	PlanFile        string `json:"plan_file"`
+	PlanKeyFile     string `json:"plan_key_file"`
+	// Age (e.g. "24h") after which a plan is stale and won't be applied
+	PlanMaxAge string `json:"plan_max_age"`
+	// File recording when each violation was first seen and the grace
+	// periods of nic groups whose violations are only remediated once they
+	// have persisted
+	StateFile    string                       `json:"state_file"`
+	GracePeriods map[string]GracePeriodConfig `json:"grace_periods"`
+	// Maximum number of instances remediated per minute across every
+	// account, where zero is unlimited
+	RemediationRate float64 `json:"remediation_rate"`
+	// Halt remediation of an account when more than this percentage of its
+	// instances are in violation, where zero disables the circuit breaker
+	CircuitBreakerPercent float64 `json:"circuit_breaker_percent"`
+	// Only remediate alerts of at least this severity
+	MinSeverity string `json:"min_severity"`
+	// Skip the startup check that the audit credentials of accounts with a
+	// remediation credential can't remove NICs
+	SkipReadOnlyCheck bool `json:"skip_read_only_check"`
 }
 
 // Account contains the configuration details describing a single Triton
@@ -54,16 +128,55 @@ type Account struct {
 	KeyPath          string   `json:"key_path"`
 	KeyId            string   `json:"key_id"`
 	NetworksToRemove []string `json:"networks_to_remove"`
+	// Optional CloudAPI URLs of the data centers to audit by name, or
+	// discovery of the data centers from the CloudAPI at triton_url. The
+	// account is audited in each data center
+	Datacenters         map[string]string `json:"datacenters"`
+	DiscoverDatacenters bool              `json:"discover_datacenters"`
+	// Name of the data center of triton_url, set for each data center when
+	// the account has several
+	Datacenter string `json:"datacenter"`
+	// Optional RBAC sub-user of the account that owns the key and roles
+	// of that user to assume for every request
+	User  string   `json:"user"`
+	Roles []string `json:"roles"`
+	// Optional identity used to remediate instead of the key, user and
+	// roles above, which are then expected to be read-only
+	RemediationCredential *Credential `json:"remediation_credential"`
+	// Optional members of each nic group to remove when that group is
+	// matched. networks_to_remove is used for nic groups that aren't listed
+	NicGroupNetworksToRemove map[string][]string `json:"nic_group_networks_to_remove"`
+	// Optional actions taken against instances that match each nic group
+	// instead of removing NICs
+	RemediationActions map[string][]RemediationAction `json:"remediation_actions"`
+	// Optional maximum number of instances of this account remediated per
+	// minute and per run, where zero is unlimited
+	RemediationRate              float64 `json:"remediation_rate"`
+	MaxRemediatedInstancesPerRun int     `json:"max_remediated_instances_per_run"`
+	// Optional recipients of alert emails for this account, given either
+	// directly or as the name of one of the email routes
+	Email      *EmailRoute `json:"email"`
+	EmailRoute string      `json:"email_route"`
+}
+
+// networksToRemove returns the networks to remove from an instance that
+// matched the specified nic group.
+func (a Account) networksToRemove(nicGroup string) []string {
+	if networks, ok := a.NicGroupNetworksToRemove[nicGroup]; ok {
+		return networks
+	}
+
+	return a.NetworksToRemove
 }
 
 // readConfigFromFile parses a json5 configuration from the specified path.
 func readConfigFromFile(configFile string) (Configuration, error) {
 	if !exists(configFile) {
-		log.Fatalf("Configuration file [%v] doesn't exist", configFile)
+		configFatalf("Configuration file [%v] doesn't exist", configFile)
 	}
 
 	if !isReadable(configFile) {
-		log.Fatalf("Configuration file [%v] is not accessible", configFile)
+		configFatalf("Configuration file [%v] is not accessible", configFile)
 	}
 
 	reader, fileOpenErr := os.Open(configFile)
@@ -91,27 +204,115 @@ func readConfig(reader io.Reader) (Configuration, error) {
 }
 
 // validateConfiguration verifies if a given configuration instance has the
-// correct settings.
-func validateConfiguration(config Configuration) {
+// correct settings. The private keys of the accounts are only checked when
+// requireKeys is set.
+func validateConfiguration(config Configuration, requireKeys bool) {
+	if _, retryErr := newRetryPolicy(config.CloudAPIRetry); retryErr != nil {
+		configFatalf("%v", retryErr)
+	}
+
+	if _, policyErr := newRemediationPolicy(config.Remediation); policyErr != nil {
+		configFatalf("%v", policyErr)
+	}
+
+	if severityErr := validateSeverities(config); severityErr != nil {
+		configFatalf("%v", severityErr)
+	}
+
+	if nicGroupsErr := validateNicGroups(config.NicGroups); nicGroupsErr != nil {
+		configFatalf("%v", nicGroupsErr)
+	}
+
+	if _, ok := config.NicGroups[firewallAlertGroup]; ok {
+		configFatalf("The nic group name [%v] is reserved for firewall audit "+
+			"alerts", firewallAlertGroup)
+	}
+
+	if firewallErr := validateFirewallAudit(config.FirewallAudit, config.NicGroups); firewallErr != nil {
+		configFatalf("%v", firewallErr)
+	}
+
+	if _, rulesErr := newNetworkRules(config.NetworkRules, config.NicGroups); rulesErr != nil {
+		configFatalf("%v", rulesErr)
+	}
+
+	if _, graceErr := newGracePeriods(config.Remediation, config.NicGroups); graceErr != nil {
+		configFatalf("%v", graceErr)
+	}
+
+	if config.Remediation.RequireApproval && !isReadable(config.Remediation.PlanKeyFile) {
+		configFatalf("Remediation plan key [%v] isn't accessible",
+			config.Remediation.PlanKeyFile)
+	}
+
 	for _, account := range config.Accounts {
-		if !exists(account.KeyPath) {
-			msg := fmt.Sprintf("Unable to audit account [%v] because "+
+		if requireKeys && !exists(account.KeyPath) {
+			configFatalf("Unable to audit account [%v] because "+
 				"private key doesn't exist [%v]", account.AccountName, account.KeyPath)
-			log.Fatal(msg)
 		}
 
-		if !isReadable(account.KeyPath) {
-			msg := fmt.Sprintf("Unable to audit account [%v] because "+
+		if requireKeys && !isReadable(account.KeyPath) {
+			configFatalf("Unable to audit account [%v] because "+
 				"private key isn't accessible [%v]", account.AccountName, account.KeyPath)
-			log.Fatal(msg)
 		}
 
 		for _, network := range account.NetworksToRemove {
 			if !isValidNetwork(network) {
-				msg := fmt.Sprintf("Network [%v] for account [%v] is "+
+				configFatalf("Network [%v] for account [%v] is "+
 					"not a valid configuration value. It must be a "+
 					"UUID, CIDR or the string 'public'", network, account)
-				log.Fatal(msg)
+			}
+		}
+
+		if rbacErr := validateRBAC(account); rbacErr != nil {
+			configFatalf("%v", rbacErr)
+		}
+
+		if account.RemediationCredential != nil {
+			remediation := account.remediationAccount()
+
+			if requireKeys && !isReadable(remediation.KeyPath) {
+				configFatalf("Remediation private key of account [%v] isn't "+
+					"accessible [%v]", account.AccountName, remediation.KeyPath)
+			}
+
+			if rbacErr := validateRBAC(remediation); rbacErr != nil {
+				configFatalf("Remediation credential: %v", rbacErr)
+			}
+		}
+
+		if datacentersErr := validateDatacenters(account); datacentersErr != nil {
+			configFatalf("%v", datacentersErr)
+		}
+
+		if account.RemediationRate < 0 ||
+			account.MaxRemediatedInstancesPerRun < 0 {
+			configFatalf("Remediation limits for account [%v] can't be "+
+				"negative", account.AccountName)
+		}
+
+		if actionsErr := validateRemediationActions(account, config.NicGroups,
+			config.NetworkRules, config.Remediation.RequireApproval &&
+				!config.Remediation.DryRun); actionsErr != nil {
+			configFatalf("%v", actionsErr)
+		}
+
+		for nicGroup, networks := range account.NicGroupNetworksToRemove {
+			members, ok := config.NicGroups[nicGroup]
+
+			if !ok {
+				configFatalf("Unknown nic group [%v] in the networks to "+
+					"remove for account [%v]", nicGroup, account.AccountName)
+			}
+
+			memberSet := toSet(members)
+
+			for _, network := range networks {
+				if !memberSet[network] {
+					configFatalf("Network [%v] to remove for nic group [%v] "+
+						"of account [%v] isn't a member of the nic group",
+						network, nicGroup, account.AccountName)
+				}
 			}
 		}
 	}
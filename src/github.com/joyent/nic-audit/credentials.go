@@ -0,0 +1,284 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+	"github.com/joyent/triton-go/network"
+)
+
+// probeMAC is the MAC address of the NIC that the read-only identity of an
+// account is asked to remove to verify that it isn't allowed to. The probe
+// can't remove a NIC even when the request is authorized: the all-zero
+// address isn't a valid unicast MAC address, so it is never assigned to a
+// NIC. CloudAPI authorizes the request against the instance before it looks
+// up the NIC, answering NotAuthorized when the identity may not remove NICs
+// and ResourceNotFound when it may.
+const probeMAC = "00:00:00:00:00:00"
+
+// unverifiedCredentialsError is returned when the audit credentials of an
+// account couldn't be checked, as opposed to being found to be writable.
+type unverifiedCredentialsError struct {
+	account string
+	err     error
+}
+
+func (u unverifiedCredentialsError) Error() string {
+	return fmt.Sprintf("Unable to verify that the audit credentials of "+
+		"account [%v] are read-only: %v", u.account, u.err)
+}
+
+// Credential is an identity used to authenticate to CloudAPI as an account
+// in place of the key, user and roles of the account.
+type Credential struct {
+	KeyPath string   `json:"key_path"`
+	KeyId   string   `json:"key_id"`
+	User    string   `json:"user"`
+	Roles   []string `json:"roles"`
+}
+
+// remediationAccount returns the account authenticating with its
+// remediation credential, or the account as it is when it has none.
+func (a Account) remediationAccount() Account {
+	if a.RemediationCredential == nil {
+		return a
+	}
+
+	credential := *a.RemediationCredential
+	remediation := a
+	remediation.KeyPath = credential.KeyPath
+	remediation.KeyId = credential.KeyId
+	remediation.User = credential.User
+	remediation.Roles = credential.Roles
+	remediation.RemediationCredential = nil
+
+	return remediation
+}
+
+// remediationCloudAPI returns the client used to remediate the alerts of an
+// account. Accounts with a remediation credential get a client that is only
+// created once remediation makes its first request, while other accounts
+// remediate with the client of the audit.
+func remediationCloudAPI(account Account, auditClient cloudAPI) cloudAPI {
+	if account.RemediationCredential == nil {
+		return auditClient
+	}
+
+	return &lazyCloudAPI{account: account.remediationAccount()}
+}
+
+// lazyCloudAPI creates the CloudAPI client of an account when the first
+// request is made.
+type lazyCloudAPI struct {
+	once    sync.Once
+	account Account
+	client  cloudAPI
+	err     error
+}
+
+// get returns the client of the account, creating it when needed.
+func (l *lazyCloudAPI) get() (cloudAPI, error) {
+	l.once.Do(func() {
+		log.Printf("Authenticating to remediate account [%v] with key [%v]\n",
+			l.account.AccountName, l.account.KeyId)
+		l.client, l.err = newCloudAPI(l.account)
+	})
+
+	return l.client, l.err
+}
+
+func (l *lazyCloudAPI) ListInstances(ctx context.Context) ([]*compute.Instance, error) {
+	api, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+
+	return api.ListInstances(ctx)
+}
+
+func (l *lazyCloudAPI) ListNICs(ctx context.Context, instanceID string) ([]*compute.NIC, error) {
+	api, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+
+	return api.ListNICs(ctx, instanceID)
+}
+
+func (l *lazyCloudAPI) RemoveNIC(ctx context.Context, instanceID string, mac string) error {
+	api, err := l.get()
+	if err != nil {
+		return err
+	}
+
+	return api.RemoveNIC(ctx, instanceID, mac)
+}
+
+func (l *lazyCloudAPI) AddNIC(ctx context.Context, instanceID string,
+	networkID string, ip string) (*compute.NIC, error) {
+
+	api, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+
+	return api.AddNIC(ctx, instanceID, networkID, ip)
+}
+
+func (l *lazyCloudAPI) ListNetworks(ctx context.Context) ([]*network.Network, error) {
+	api, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+
+	return api.ListNetworks(ctx)
+}
+
+func (l *lazyCloudAPI) StopInstance(ctx context.Context, instanceID string) error {
+	api, err := l.get()
+	if err != nil {
+		return err
+	}
+
+	return api.StopInstance(ctx, instanceID)
+}
+
+func (l *lazyCloudAPI) EnableFirewall(ctx context.Context, instanceID string) error {
+	api, err := l.get()
+	if err != nil {
+		return err
+	}
+
+	return api.EnableFirewall(ctx, instanceID)
+}
+
+func (l *lazyCloudAPI) AddTags(ctx context.Context, instanceID string,
+	tags map[string]string) error {
+
+	api, err := l.get()
+	if err != nil {
+		return err
+	}
+
+	return api.AddTags(ctx, instanceID, tags)
+}
+
+func (l *lazyCloudAPI) UpdateMetadata(ctx context.Context, instanceID string,
+	metadata map[string]string) error {
+
+	api, err := l.get()
+	if err != nil {
+		return err
+	}
+
+	return api.UpdateMetadata(ctx, instanceID, metadata)
+}
+
+func (l *lazyCloudAPI) ListFirewallRules(ctx context.Context,
+	instanceID string) ([]*network.FirewallRule, error) {
+
+	api, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+
+	return api.ListFirewallRules(ctx, instanceID)
+}
+
+func (l *lazyCloudAPI) ListDatacenters(ctx context.Context) ([]*compute.DataCenter, error) {
+	api, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+
+	return api.ListDatacenters(ctx)
+}
+
+// isNotAuthorized determines if CloudAPI refused a request because the
+// identity isn't allowed to make it.
+func isNotAuthorized(err error) bool {
+	apiErr, ok := asAPIError(err)
+
+	return ok && apiErr.StatusCode == http.StatusForbidden
+}
+
+// verifyReadOnlyCredentials checks that the identity used to audit each
+// account with a remediation credential can't remove NICs, in every data
+// center of the account, unless skip_read_only_check is set. The identity
+// is asked to remove a NIC that can't exist from one of the instances, and
+// CloudAPI authorizing the request fails the check. A data center that
+// can't be checked because CloudAPI can't be reached returns an
+// unverifiedCredentialsError, while one without instances is reported as
+// unverified and skipped.
+func verifyReadOnlyCredentials(config Configuration) error {
+	if config.Remediation.SkipReadOnlyCheck {
+		return nil
+	}
+
+	ctx := context.Background()
+
+	for _, configured := range config.Accounts {
+		if configured.RemediationCredential == nil {
+			continue
+		}
+
+		accounts, datacentersErr := accountDatacenters(configured)
+
+		if datacentersErr != nil {
+			return unverifiedCredentialsError{configured.AccountName,
+				datacentersErr}
+		}
+
+		for _, account := range accounts {
+			name := accountInDatacenter(account.AccountName, account.Datacenter)
+			api, apiErr := newCloudAPI(account)
+
+			if apiErr != nil {
+				return apiErr
+			}
+
+			instances, instancesErr := api.ListInstances(ctx)
+
+			if instancesErr != nil {
+				return unverifiedCredentialsError{name, instancesErr}
+			}
+
+			if len(instances) < 1 {
+				log.Printf("WARNING: the audit credentials of account [%v] "+
+					"are unverified because it has no instances\n", name)
+				continue
+			}
+
+			removeErr := api.RemoveNIC(ctx, instances[0].ID, probeMAC)
+
+			if isNotAuthorized(removeErr) {
+				log.Printf("Verified that the audit credentials of account "+
+					"[%v] are read-only\n", name)
+				continue
+			}
+
+			if _, answered := asAPIError(removeErr); removeErr != nil && !answered {
+				return unverifiedCredentialsError{name, removeErr}
+			}
+
+			return fmt.Errorf("The audit credentials of account [%v] "+
+				"aren't read-only; CloudAPI authorized removing a NIC "+
+				"(%v)", name, removeErr)
+		}
+	}
+
+	return nil
+}
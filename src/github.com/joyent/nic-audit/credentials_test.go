@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+import (
+	tritonerrors "github.com/joyent/triton-go/errors"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// errNotAuthorized is the error CloudAPI returns for requests the identity
+// isn't allowed to make.
+var errNotAuthorized = &tritonerrors.APIError{StatusCode: 403,
+	Code: "NotAuthorized", Message: "You are not authorized to do that"}
+
+func testCredentialAccount() Account {
+	return Account{
+		AccountName:      "some.user",
+		Datacenter:       "us-east-1",
+		KeyPath:          "/keys/auditor",
+		User:             "auditor",
+		NetworksToRemove: []string{"public"},
+		RemediationCredential: &Credential{
+			KeyPath: "/keys/remediator",
+			User:    "remediator",
+			Roles:   []string{"remediate"},
+		},
+	}
+}
+
+func TestRemediationAccountUsesRemediationCredential(t *testing.T) {
+	remediation := testCredentialAccount().remediationAccount()
+
+	if remediation.KeyPath != "/keys/remediator" || remediation.User != "remediator" ||
+		len(remediation.Roles) != 1 || remediation.Datacenter != "us-east-1" ||
+		remediation.RemediationCredential != nil {
+		t.Errorf("Unexpected remediation account: %+v", remediation)
+	}
+}
+
+// useCredentialFakes substitutes one fake CloudAPI for each user and counts
+// the clients created for each user.
+func useCredentialFakes(fakes map[string]*fakeCloudAPI) (map[string]int, func()) {
+	created := make(map[string]int)
+	restore := useCloudAPIFactory(func(account Account) (cloudAPI, error) {
+		created[account.User]++
+		return fakes[account.User], nil
+	})
+
+	return created, restore
+}
+
+func TestAuditRemediatesWithRemediationCredential(t *testing.T) {
+	auditor := newTestFakeCloudAPI()
+	remediator := newTestFakeCloudAPI()
+	created, restore := useCredentialFakes(map[string]*fakeCloudAPI{
+		"auditor":    auditor,
+		"remediator": remediator,
+	})
+	defer restore()
+
+	config := testAuditConfiguration()
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(testCredentialAccount(), config.NicGroups, config,
+		run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if created["auditor"] != 1 || created["remediator"] != 1 {
+		t.Errorf("Expected one client for each credential: %v", created)
+	}
+
+	if removed := auditor.removedMACs(); len(removed) != 0 {
+		t.Errorf("Expected no NICs removed with the audit credentials: %v", removed)
+	}
+
+	if removed := remediator.removedMACs(); len(removed) != 1 {
+		t.Errorf("Expected the public NIC to be removed: %v", removed)
+	}
+}
+
+func TestAuditOnlyCreatesRemediationClientWhenRemediating(t *testing.T) {
+	auditor := newFakeCloudAPI()
+	auditor.addInstance("91ddcc19-b7f9-47b8-8258-f2741bd44112", "compliant")
+	created, restore := useCredentialFakes(map[string]*fakeCloudAPI{
+		"auditor": auditor,
+	})
+	defer restore()
+
+	config := testAuditConfiguration()
+
+	if err := auditAccount(testCredentialAccount(), config.NicGroups, config,
+		&AuditRun{}, &recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if created["remediator"] != 0 {
+		t.Errorf("Expected no remediation client: %v", created)
+	}
+}
+
+func TestVerifyReadOnlyCredentials(t *testing.T) {
+	auditor := newTestFakeCloudAPI()
+	_, restore := useCredentialFakes(map[string]*fakeCloudAPI{
+		"auditor": auditor,
+	})
+	defer restore()
+
+	config := testAuditConfiguration()
+	config.Accounts = []Account{testCredentialAccount()}
+
+	if err := verifyReadOnlyCredentials(config); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+
+	auditor.removeErrors[normalizeMAC(probeMAC)] = errNotAuthorized
+
+	if err := verifyReadOnlyCredentials(config); err != nil {
+		t.Error(err)
+	}
+
+	if removed := auditor.removedMACs(); len(removed) != 0 {
+		t.Errorf("Expected no NICs to be removed: %v", removed)
+	}
+}
+
+func TestVerifyReadOnlyCredentialsCanBeSkipped(t *testing.T) {
+	auditor := newTestFakeCloudAPI()
+	created, restore := useCredentialFakes(map[string]*fakeCloudAPI{
+		"auditor": auditor,
+	})
+	defer restore()
+
+	config := testAuditConfiguration()
+	config.Remediation.SkipReadOnlyCheck = true
+	config.Accounts = []Account{testCredentialAccount()}
+
+	if err := verifyReadOnlyCredentials(config); err != nil || created["auditor"] != 0 {
+		t.Errorf("Expected the check to be skipped: %v", err)
+	}
+}
+
+func TestVerifyReadOnlyCredentialsReportsUnreachableCloudAPI(t *testing.T) {
+	auditor := newTestFakeCloudAPI()
+	_, restore := useCredentialFakes(map[string]*fakeCloudAPI{
+		"auditor": auditor,
+	})
+	defer restore()
+
+	config := testAuditConfiguration()
+	config.Accounts = []Account{testCredentialAccount()}
+	auditor.removeErrors[normalizeMAC(probeMAC)] = errors.New(
+		"dial tcp 10.0.0.1:443: connection refused")
+
+	err := verifyReadOnlyCredentials(config)
+
+	if _, unverified := err.(unverifiedCredentialsError); !unverified {
+		t.Errorf("Expected the credentials to be unverified. Actually: %v", err)
+	}
+}
+
+func TestIsNotAuthorizedOnlyMatchesCloudAPIErrors(t *testing.T) {
+	if !isNotAuthorized(errNotAuthorized) ||
+		!isNotAuthorized(pkgerrors.Wrap(errNotAuthorized, "Error removing NIC")) {
+		t.Error("Expected CloudAPI to refuse the request")
+	}
+
+	if isNotAuthorized(errors.New("NotAuthorized: proxy refused the request")) {
+		t.Error("Expected errors that aren't from CloudAPI not to match")
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// validateDatacenters checks the data centers of an account.
+func validateDatacenters(account Account) error {
+	if len(account.Datacenters) > 0 && account.DiscoverDatacenters {
+		return fmt.Errorf("Account [%v] can either list datacenters or "+
+			"discover them, but not both", account.AccountName)
+	}
+
+	if account.DiscoverDatacenters && len(account.TritonUrl) < 1 {
+		return fmt.Errorf("Account [%v] needs a triton_url to discover its "+
+			"datacenters", account.AccountName)
+	}
+
+	for name, tritonURL := range account.Datacenters {
+		if parsed, parseErr := url.Parse(tritonURL); parseErr != nil ||
+			len(parsed.Scheme) < 1 || len(parsed.Host) < 1 {
+			return fmt.Errorf("Invalid CloudAPI URL [%v] for datacenter [%v] "+
+				"of account [%v]", tritonURL, name, account.AccountName)
+		}
+	}
+
+	return nil
+}
+
+// accountDatacenters returns a copy of the account for each of its data
+// centers with the CloudAPI URL and name of that data center. The data
+// centers are either those listed for the account or those discovered from
+// the CloudAPI at its triton_url. An account without data centers is
+// returned as it is.
+func accountDatacenters(account Account) ([]Account, error) {
+	datacenters := account.Datacenters
+
+	if account.DiscoverDatacenters {
+		client, clientErr := newCloudAPI(account)
+
+		if clientErr != nil {
+			return nil, clientErr
+		}
+
+		discovered, listErr := client.ListDatacenters(context.Background())
+
+		if listErr != nil {
+			return nil, fmt.Errorf("Unable to discover the datacenters of "+
+				"account [%v]: %v", account.AccountName, listErr)
+		}
+
+		datacenters = make(map[string]string, len(discovered))
+		for _, datacenter := range discovered {
+			datacenters[datacenter.Name] = datacenter.URL
+		}
+	}
+
+	if len(datacenters) < 1 {
+		return []Account{account}, nil
+	}
+
+	names := make([]string, 0, len(datacenters))
+	for name := range datacenters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	accounts := make([]Account, 0, len(names))
+
+	for _, name := range names {
+		datacenterAccount := account
+		datacenterAccount.Datacenter = name
+		datacenterAccount.TritonUrl = datacenters[name]
+		datacenterAccount.Datacenters = nil
+		datacenterAccount.DiscoverDatacenters = false
+		accounts = append(accounts, datacenterAccount)
+	}
+
+	return accounts, nil
+}
+
+// findDatacenterAccount returns the configured account with the specified
+// name for the specified data center, which is empty for accounts that
+// don't list or discover data centers. Several account blocks can share a
+// name, so the CloudAPI URL the account was audited with picks among them.
+// An empty URL, as in entries recorded before the URL was, matches the first
+// of them.
+func findDatacenterAccount(config Configuration, accountName string,
+	datacenter string, tritonURL string) (Account, error) {
+
+	configured := false
+	var datacentersErr error
+
+	for _, candidate := range config.Accounts {
+		if candidate.AccountName != accountName {
+			continue
+		}
+
+		configured = true
+		accounts := []Account{candidate}
+
+		if len(datacenter) > 0 && datacenter != candidate.Datacenter {
+			var listErr error
+			accounts, listErr = accountDatacenters(candidate)
+
+			if listErr != nil {
+				datacentersErr = listErr
+				continue
+			}
+		}
+
+		for _, account := range accounts {
+			if (len(datacenter) < 1 || account.Datacenter == datacenter) &&
+				(len(tritonURL) < 1 || account.TritonUrl == tritonURL) {
+				return account, nil
+			}
+		}
+	}
+
+	if !configured {
+		return Account{}, fmt.Errorf("Account [%v] isn't configured",
+			accountName)
+	}
+
+	if datacentersErr != nil {
+		return Account{}, datacentersErr
+	}
+
+	if len(tritonURL) > 0 {
+		return Account{}, fmt.Errorf("Account [%v] with CloudAPI URL [%v] "+
+			"isn't configured", accountInDatacenter(accountName, datacenter),
+			tritonURL)
+	}
+
+	return Account{}, fmt.Errorf("Datacenter [%v] of account [%v] isn't "+
+		"configured", datacenter, accountName)
+}
+
+// accountInDatacenter names an account together with its data center, such
+// as "some.user/us-east-1", for listings of the journal and plan.
+func accountInDatacenter(accountName string, datacenter string) string {
+	if len(datacenter) < 1 {
+		return accountName
+	}
+
+	return accountName + "/" + datacenter
+}
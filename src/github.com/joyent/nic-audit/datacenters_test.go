@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+)
+
+func TestAccountDatacentersListsConfiguredDatacenters(t *testing.T) {
+	account := Account{
+		AccountName: "some.user",
+		Datacenters: map[string]string{
+			"us-west-1": "https://us-west-1.api.example.com",
+			"us-east-1": "https://us-east-1.api.example.com",
+		},
+	}
+
+	accounts, err := accountDatacenters(account)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accounts) != 2 || accounts[0].Datacenter != "us-east-1" ||
+		accounts[0].TritonUrl != "https://us-east-1.api.example.com" ||
+		accounts[1].Datacenter != "us-west-1" || accounts[1].AccountName != "some.user" {
+		t.Errorf("Unexpected datacenter accounts: %+v", accounts)
+	}
+}
+
+func TestAccountDatacentersDiscoversDatacenters(t *testing.T) {
+	fake := newFakeCloudAPI()
+	fake.datacenters = []*compute.DataCenter{
+		{Name: "us-east-1", URL: "https://us-east-1.api.example.com"},
+		{Name: "eu-ams-1", URL: "https://eu-ams-1.api.example.com"},
+	}
+	defer useFakeCloudAPI(fake)()
+
+	accounts, err := accountDatacenters(Account{
+		AccountName:         "some.user",
+		TritonUrl:           "https://us-east-1.api.example.com",
+		DiscoverDatacenters: true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accounts) != 2 || accounts[0].Datacenter != "eu-ams-1" ||
+		accounts[0].TritonUrl != "https://eu-ams-1.api.example.com" ||
+		accounts[0].DiscoverDatacenters {
+		t.Errorf("Unexpected datacenter accounts: %+v", accounts)
+	}
+}
+
+func TestValidateDatacentersRejectsListAndDiscovery(t *testing.T) {
+	account := Account{
+		AccountName:         "some.user",
+		TritonUrl:           "https://us-east-1.api.example.com",
+		Datacenters:         map[string]string{"us-east-1": "https://us-east-1.api.example.com"},
+		DiscoverDatacenters: true,
+	}
+
+	if err := validateDatacenters(account); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+
+	account.DiscoverDatacenters = false
+	account.Datacenters["us-west-1"] = "us-west-1"
+
+	if err := validateDatacenters(account); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
+
+func TestRunAuditAuditsEveryDatacenterOfAccount(t *testing.T) {
+	east := newTestFakeCloudAPI()
+	west := newFakeCloudAPI()
+	west.addInstance("91ddcc19-b7f9-47b8-8258-f2741bd44112", "compliant",
+		&compute.NIC{MAC: "90:b8:d0:00:00:03", IP: "192.168.0.7",
+			Network: testPrivateNetwork, Primary: true})
+
+	var audited []string
+	defer useCloudAPIFactory(func(account Account) (cloudAPI, error) {
+		audited = append(audited, account.Datacenter)
+
+		if account.Datacenter == "us-west-1" {
+			return west, nil
+		}
+
+		return east, nil
+	})()
+
+	config := testAuditConfiguration()
+	config.Accounts = []Account{{
+		AccountName: "some.user",
+		Datacenters: map[string]string{
+			"us-east-1": "https://us-east-1.api.example.com",
+			"us-west-1": "https://us-west-1.api.example.com",
+		},
+		NetworksToRemove: []string{"public"},
+	}}
+
+	run := runAudit(config)
+
+	if len(audited) != 2 || audited[0] != "us-east-1" || audited[1] != "us-west-1" {
+		t.Errorf("Expected both datacenters to be audited: %v", audited)
+	}
+
+	if run.AccountsAudited != 2 || run.InstancesScanned != 3 ||
+		run.AlertCount != 1 || run.AlertsRemediated != 1 {
+		t.Errorf("Unexpected audit run: %+v", run)
+	}
+
+	if removed := east.removedMACs(); len(removed) != 1 {
+		t.Errorf("Expected the public NIC to be removed in us-east-1: %v", removed)
+	}
+}
+
+func TestFindDatacenterAccountMatchesCloudAPIURL(t *testing.T) {
+	config := Configuration{Accounts: []Account{
+		{AccountName: "some.user", TritonUrl: "https://one.api.example.com",
+			KeyId: "one"},
+		{AccountName: "some.user", TritonUrl: "https://two.api.example.com",
+			KeyId: "two"},
+	}}
+
+	account, err := findDatacenterAccount(config, "some.user", "",
+		"https://two.api.example.com")
+
+	if err != nil || account.KeyId != "two" {
+		t.Errorf("Expected the second account block: %+v %v", account, err)
+	}
+
+	if account, err := findDatacenterAccount(config, "some.user", "", ""); err != nil ||
+		account.KeyId != "one" {
+		t.Errorf("Expected the first account block: %+v %v", account, err)
+	}
+
+	if _, err := findDatacenterAccount(config, "some.user", "",
+		"https://three.api.example.com"); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
+
+func TestDatacenterSuffixDescribesDatacenter(t *testing.T) {
+	if suffix := datacenterSuffix("us-east-1"); suffix != " in datacenter [us-east-1]" {
+		t.Errorf("Unexpected datacenter suffix: %q", suffix)
+	}
+
+	if suffix := datacenterSuffix(""); suffix != "" {
+		t.Errorf("Unexpected datacenter suffix: %q", suffix)
+	}
+}
@@ -0,0 +1,345 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"text/template"
+)
+
+import (
+	"github.com/jordan-wright/email"
+)
+
+// defaultTextTemplate renders the plain text body of an alert email.
+const defaultTextTemplate = `Instances with offending network combinations have been found.
+{{range .Alerts}}
+======================================================
+ Offending network match detected
+======================================================
+  Account: {{.Account.AccountName}}
+  Account Description: {{.Account.Description}}
+{{- if .Account.Datacenter}}
+  Datacenter: {{.Account.Datacenter}}
+{{- end}}
+  Triton URL: {{.Account.TritonUrl}}
+  Match Group: {{.NicGroupName}}
+  Severity: {{.Severity}}
+  Networks Matched: {{.NicGroupIds}}
+{{- if .Violation}}
+  Violation: {{.Violation}}
+{{- end}}
+  Instance ID: {{.Instance.ID}}
+  Instance Name: {{.Instance.Name}}
+  Instance IPs: {{.Instance.IPs}}
+  Instance Firewall Enabled: {{.Instance.FirewallEnabled}}
+  Instance Networks: {{.Instance.Networks}}
+{{- if .GraceStage}}
+  Grace Period: {{.GraceStage}}, first seen {{.FirstSeen.Format "2006-01-02T15:04:05Z07:00"}}, remediation after {{.RemediateAt.Format "2006-01-02T15:04:05Z07:00"}}
+{{- end}}
+{{- if .Remediation}}{{if .Remediation.Deferred}}
+  Remediation Deferred: {{.Remediation.Deferred}}
+{{- else if or (not .Remediation.Err) .Remediation.NetworksRemoved}}
+  Instance Networks Removed: {{.Remediation.NetworksRemoved}}
+{{- end}}
+{{- range .Remediation.NICs}}
+  NIC {{.MAC}} {{.IP}} ({{.Network}}): {{.Outcome}}{{if .Err}} - {{.Err}}{{end}}
+{{- end}}
+{{- range .Remediation.Actions}}
+  Action {{.Action}}: {{.Outcome}}{{if .Err}} - {{.Err}}{{end}}
+{{- end}}{{end}}
+{{end}}
+{{- if .AdditionalBody}}
+
+{{.AdditionalBody}}
+{{end}}`
+
+// defaultHTMLTemplate renders the HTML body of an alert email.
+const defaultHTMLTemplate = `<html>
+<body>
+<p>Instances with offending network combinations have been found in
+account <b>{{.Account.AccountName}}</b> ({{.Account.Description}}).</p>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr>
+<th>Severity</th>
+<th>Datacenter</th>
+<th>Match Group</th>
+<th>Networks Matched</th>
+<th>Instance ID</th>
+<th>Instance Name</th>
+<th>Instance IPs</th>
+<th>Firewall Enabled</th>
+<th>Instance Networks</th>
+<th>Remediation</th>
+</tr>
+{{- range .Alerts}}
+<tr>
+<td>{{.Severity}}</td>
+<td>{{.Account.Datacenter}}</td>
+<td>{{.NicGroupName}}{{if .Violation}}<br>{{.Violation}}{{end}}</td>
+<td>{{range .NicGroupIds}}{{.}}<br>{{end}}</td>
+<td>{{.Instance.ID}}</td>
+<td>{{.Instance.Name}}</td>
+<td>{{range .Instance.IPs}}{{.}}<br>{{end}}</td>
+<td>{{.Instance.FirewallEnabled}}</td>
+<td>{{range .Instance.Networks}}{{.}}<br>{{end}}</td>
+<td>{{if .GraceStage}}Grace period {{.GraceStage}}, remediation after {{.RemediateAt.Format "2006-01-02T15:04:05Z07:00"}}<br>{{end}}{{if .Remediation}}{{if .Remediation.Deferred}}Deferred: {{.Remediation.Deferred}}<br>{{end}}{{if .Remediation.Err}}Failed: {{.Remediation.Err}}<br>{{end}}{{range .Remediation.NICs}}{{.Network}} ({{.MAC}} {{.IP}}): {{.Outcome}}{{if .Err}} - {{.Err}}{{end}}<br>{{end}}{{range .Remediation.Actions}}{{.Action}}: {{.Outcome}}{{if .Err}} - {{.Err}}{{end}}<br>{{end}}{{end}}</td>
+</tr>
+{{- end}}
+</table>
+{{- if not .Account.Datacenter}}
+<p>Triton URL: {{.Account.TritonUrl}}</p>
+{{- end}}
+{{- if .AdditionalBody}}
+<p>{{.AdditionalBody}}</p>
+{{- end}}
+</body>
+</html>
+`
+
+// emailAlert pairs an alert with the result of any remediation so that both
+// can be rendered together in an email.
+type emailAlert struct {
+	Alert
+	Remediation *RemediationResult
+}
+
+// emailTemplateData is the data made available to the subject and body
+// templates of an alert email.
+type emailTemplateData struct {
+	Account        Account
+	Alerts         []*emailAlert
+	Run            *AuditRun
+	AdditionalBody string
+	// Highest severity of the alerts
+	Severity string
+}
+
+// emailDigest is a single email containing the alerts for one account that
+// is delivered to one set of recipients.
+type emailDigest struct {
+	account Account
+	route   EmailRoute
+	alerts  []*emailAlert
+}
+
+// emailSink aggregates alerts per Triton account and recipients and sends a
+// single email for each digest when the run ends.
+type emailSink struct {
+	config     EmailAlerts
+	subject    *template.Template
+	textBody   *template.Template
+	htmlBody   *htmltemplate.Template
+	digestKeys []string
+	digests    map[string]*emailDigest
+	alerts     map[string][]*emailAlert
+}
+
+// newEmailSink creates an alert sink that sends email using the specified
+// configuration. An error is returned if any of the templates are invalid.
+func newEmailSink(config EmailAlerts) (*emailSink, error) {
+	if smtpErr := validateSMTPSettings(config); smtpErr != nil {
+		return nil, smtpErr
+	}
+
+	if _, maxAgeErr := spoolMaxAge(config); maxAgeErr != nil {
+		return nil, maxAgeErr
+	}
+
+	subjectText := config.SubjectTemplate
+	if len(subjectText) < 1 {
+		subjectText = config.Subject
+	}
+
+	textText := config.TextTemplate
+	if len(textText) < 1 {
+		textText = defaultTextTemplate
+	}
+
+	htmlText := config.HTMLTemplate
+	if len(htmlText) < 1 {
+		htmlText = defaultHTMLTemplate
+	}
+
+	subject, subjectErr := template.New("subject").Parse(subjectText)
+	if subjectErr != nil {
+		return nil, fmt.Errorf("Invalid email subject template: %v", subjectErr)
+	}
+
+	textBody, textErr := template.New("text").Parse(textText)
+	if textErr != nil {
+		return nil, fmt.Errorf("Invalid email text template: %v", textErr)
+	}
+
+	htmlBody, htmlErr := htmltemplate.New("html").Parse(htmlText)
+	if htmlErr != nil {
+		return nil, fmt.Errorf("Invalid email HTML template: %v", htmlErr)
+	}
+
+	sink := &emailSink{
+		config:   config,
+		subject:  subject,
+		textBody: textBody,
+		htmlBody: htmlBody,
+	}
+	sink.reset()
+
+	return sink, nil
+}
+
+// reset discards all of the aggregated alerts.
+func (s *emailSink) reset() {
+	s.digestKeys = nil
+	s.digests = make(map[string]*emailDigest)
+	s.alerts = make(map[string][]*emailAlert)
+}
+
+func (s *emailSink) BeginRun(run *AuditRun) error {
+	s.reset()
+
+	if len(s.config.SpoolDir) < 1 {
+		return nil
+	}
+
+	// Retry any messages that couldn't be delivered by a previous run
+	_, flushErr := flushSpool(s.config, false)
+
+	return flushErr
+}
+
+func (s *emailSink) EmitAlert(alert Alert) error {
+	account := alert.Account
+	entry := &emailAlert{Alert: alert}
+	s.alerts[account.AccountName] = append(s.alerts[account.AccountName], entry)
+
+	for _, route := range alertEmailRoutes(s.config, alert) {
+		key := account.AccountName + "\x00" + route.key()
+		digest, ok := s.digests[key]
+
+		if !ok {
+			digest = &emailDigest{account: account, route: route}
+			s.digests[key] = digest
+			s.digestKeys = append(s.digestKeys, key)
+		}
+
+		digest.alerts = append(digest.alerts, entry)
+	}
+
+	return nil
+}
+
+func (s *emailSink) EmitRemediation(alert Alert, result RemediationResult) error {
+	alerts := s.alerts[alert.Account.AccountName]
+
+	for i := len(alerts) - 1; i >= 0; i-- {
+		if alerts[i].Instance.ID == alert.Instance.ID &&
+			alerts[i].NicGroupName == alert.NicGroupName {
+			alerts[i].Remediation = &result
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *emailSink) EndRun(run *AuditRun) error {
+	var firstErr error
+
+	for _, key := range s.digestKeys {
+		digest := s.digests[key]
+		data := emailTemplateData{
+			Account:        digest.account,
+			Alerts:         digest.alerts,
+			Run:            run,
+			AdditionalBody: s.config.AdditionalBody,
+			Severity:       highestSeverity(digest.alerts),
+		}
+
+		subject, text, html, renderErr := s.render(data)
+
+		if renderErr == nil {
+			renderErr = emailAlerts(s.config, digest.route,
+				severityPrefix(data.Severity)+subject, text, html)
+		}
+
+		if renderErr != nil && firstErr == nil {
+			firstErr = renderErr
+		}
+	}
+
+	return firstErr
+}
+
+// render executes the subject, text and HTML templates for the specified
+// data.
+func (s *emailSink) render(data emailTemplateData) (string, []byte, []byte, error) {
+	var subject, text, html bytes.Buffer
+
+	if err := s.subject.Execute(&subject, data); err != nil {
+		return "", nil, nil, fmt.Errorf("Error rendering email subject: %v", err)
+	}
+
+	if err := s.textBody.Execute(&text, data); err != nil {
+		return "", nil, nil, fmt.Errorf("Error rendering email text: %v", err)
+	}
+
+	if err := s.htmlBody.Execute(&html, data); err != nil {
+		return "", nil, nil, fmt.Errorf("Error rendering email HTML: %v", err)
+	}
+
+	return subject.String(), text.Bytes(), html.Bytes(), nil
+}
+
+// emailAlerts emails the specified subject along with the plain text and
+// HTML bodies to the recipients of the specified route as a multipart
+// message. Typically the body would contain an aggregation of all of the
+// email alerts triggered per account.
+func emailAlerts(emailAlertConfig EmailAlerts, route EmailRoute, subject string,
+	text []byte, html []byte) error {
+
+	mail := email.NewEmail()
+	mail.From = fmt.Sprintf("%v <%v>", emailAlertConfig.FromName,
+		emailAlertConfig.From)
+
+	mail.To = route.To
+	mail.Bcc = route.BCC
+	mail.Cc = route.CC
+	mail.Subject = subject
+	mail.Text = text
+	mail.HTML = html
+
+	serverWithPort := fmt.Sprintf("%v:%v", emailAlertConfig.SmtpServer,
+		emailAlertConfig.SmtpPort)
+
+	mailErr := sendMail(emailAlertConfig, mail)
+
+	if mailErr == nil {
+		return nil
+	}
+
+	auditMetrics.add(metricEmailFailures, "", 1)
+
+	if len(emailAlertConfig.SpoolDir) > 0 {
+		spoolErr := spoolEmail(emailAlertConfig.SpoolDir, mail, mailErr)
+
+		if spoolErr != nil {
+			return fmt.Errorf("Error sending alert email using SMTP server "+
+				"[%v] and unable to spool it to [%v]. %v. %v", serverWithPort,
+				emailAlertConfig.SpoolDir, mailErr, spoolErr)
+		}
+
+		return fmt.Errorf("Error sending alert email using SMTP server [%v], "+
+			"spooled to [%v] for retry. %v", serverWithPort,
+			emailAlertConfig.SpoolDir, mailErr)
+	}
+
+	return fmt.Errorf("Error sending alert email using SMTP server [%v]. %v",
+		serverWithPort, mailErr)
+}
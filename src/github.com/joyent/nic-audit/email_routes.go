@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// EmailRoute is a set of recipients that receive alert emails.
+type EmailRoute struct {
+	To  []string
+	CC  []string
+	BCC []string
+}
+
+// isEmpty determines if the route has no recipients at all.
+func (r EmailRoute) isEmpty() bool {
+	return len(r.To) < 1 && len(r.CC) < 1 && len(r.BCC) < 1
+}
+
+// key returns a string that uniquely identifies the recipients of a route.
+func (r EmailRoute) key() string {
+	return strings.Join(r.To, ",") + "|" + strings.Join(r.CC, ",") + "|" +
+		strings.Join(r.BCC, ",")
+}
+
+// addresses returns the set of bare email addresses for all recipients of
+// the route.
+func (r EmailRoute) addresses() map[string]bool {
+	addresses := make(map[string]bool)
+
+	for _, recipients := range [][]string{r.To, r.CC, r.BCC} {
+		for _, recipient := range recipients {
+			addresses[bareAddress(recipient)] = true
+		}
+	}
+
+	return addresses
+}
+
+// without returns a copy of the route with the specified addresses removed.
+func (r EmailRoute) without(addresses map[string]bool) EmailRoute {
+	filter := func(recipients []string) []string {
+		var remaining []string
+
+		for _, recipient := range recipients {
+			if !addresses[bareAddress(recipient)] {
+				remaining = append(remaining, recipient)
+			}
+		}
+
+		return remaining
+	}
+
+	return EmailRoute{
+		To:  filter(r.To),
+		CC:  filter(r.CC),
+		BCC: filter(r.BCC),
+	}
+}
+
+// bareAddress strips the display name from an email address so that
+// recipients can be compared.
+func bareAddress(recipient string) string {
+	address, parseErr := mail.ParseAddress(recipient)
+
+	if parseErr != nil {
+		return strings.ToLower(strings.TrimSpace(recipient))
+	}
+
+	return strings.ToLower(address.Address)
+}
+
+// accountEmailRoute determines the recipients that own an account. The
+// recipients declared on the account take precedence over a named route,
+// which in turn takes precedence over the default recipients.
+func accountEmailRoute(config EmailAlerts, account Account) EmailRoute {
+	if account.Email != nil && !account.Email.isEmpty() {
+		return *account.Email
+	}
+
+	if len(account.EmailRoute) > 0 {
+		if route, ok := config.Routes[account.EmailRoute]; ok {
+			return route
+		}
+	}
+
+	return EmailRoute{
+		To:  config.To,
+		CC:  config.CC,
+		BCC: config.BCC,
+	}
+}
+
+// alertEmailRoutes returns every set of recipients that should receive the
+// specified alert: the owners of the account and any escalation recipients
+// of the nic group that were not already included. Escalation recipients
+// aren't included while the alert is in the first stage of a grace period.
+func alertEmailRoutes(config EmailAlerts, alert Alert) []EmailRoute {
+	accountRoute := accountEmailRoute(config, alert.Account)
+	routes := make([]EmailRoute, 0, 2)
+
+	if !accountRoute.isEmpty() {
+		routes = append(routes, accountRoute)
+	}
+
+	escalation, ok := config.NicGroupRecipients[alert.NicGroupName]
+
+	if ok && alert.GraceStage != graceAlerted {
+		escalation = escalation.without(accountRoute.addresses())
+
+		if !escalation.isEmpty() {
+			routes = append(routes, escalation)
+		}
+	}
+
+	return routes
+}
+
+// validateEmailRoutes verifies that every routing key referenced by an
+// account has been defined.
+func validateEmailRoutes(config EmailAlerts, accounts []Account) error {
+	for _, account := range accounts {
+		if len(account.EmailRoute) < 1 {
+			continue
+		}
+
+		if _, ok := config.Routes[account.EmailRoute]; !ok {
+			return fmt.Errorf("Email route [%v] for account [%v] is not "+
+				"defined in the email routes", account.EmailRoute,
+				account.AccountName)
+		}
+	}
+
+	return nil
+}
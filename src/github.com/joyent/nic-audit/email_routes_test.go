@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"testing"
+)
+
+func testRoutingConfig() EmailAlerts {
+	return EmailAlerts{
+		To: []string{"sysadmin@some.site"},
+		Routes: map[string]EmailRoute{
+			"team-b": {To: []string{"team-b@some.site"}},
+		},
+		NicGroupRecipients: map[string]EmailRoute{
+			"public-and-intranet": {
+				To: []string{"Security <security@some.site>", "team-b@some.site"},
+			},
+		},
+	}
+}
+
+func TestAccountEmailRoutePrefersAccountRecipients(t *testing.T) {
+	account := Account{
+		AccountName: "team-a",
+		Email:       &EmailRoute{To: []string{"team-a@some.site"}},
+		EmailRoute:  "team-b",
+	}
+
+	route := accountEmailRoute(testRoutingConfig(), account)
+
+	if len(route.To) != 1 || route.To[0] != "team-a@some.site" {
+		t.Errorf("Unexpected route: %+v", route)
+	}
+}
+
+func TestAccountEmailRouteUsesRoutingKey(t *testing.T) {
+	account := Account{AccountName: "team-b", EmailRoute: "team-b"}
+
+	route := accountEmailRoute(testRoutingConfig(), account)
+
+	if len(route.To) != 1 || route.To[0] != "team-b@some.site" {
+		t.Errorf("Unexpected route: %+v", route)
+	}
+}
+
+func TestAccountEmailRouteDefaultsToGlobalRecipients(t *testing.T) {
+	route := accountEmailRoute(testRoutingConfig(), Account{AccountName: "other"})
+
+	if len(route.To) != 1 || route.To[0] != "sysadmin@some.site" {
+		t.Errorf("Unexpected route: %+v", route)
+	}
+}
+
+func TestAlertEmailRoutesAddsEscalationWithoutDuplicates(t *testing.T) {
+	alert := Alert{
+		Account:      Account{AccountName: "team-b", EmailRoute: "team-b"},
+		NicGroupName: "public-and-intranet",
+	}
+
+	routes := alertEmailRoutes(testRoutingConfig(), alert)
+
+	if len(routes) != 2 {
+		t.Fatalf("Expected 2 routes. Actually: %+v", routes)
+	}
+
+	if len(routes[1].To) != 1 || routes[1].To[0] != "Security <security@some.site>" {
+		t.Errorf("Expected escalation to exclude account owners: %+v", routes[1])
+	}
+}
+
+func TestAlertEmailRoutesDefersEscalationDuringGracePeriod(t *testing.T) {
+	alert := Alert{
+		Account:      Account{AccountName: "team-b", EmailRoute: "team-b"},
+		NicGroupName: "public-and-intranet",
+		GraceStage:   graceAlerted,
+	}
+
+	if routes := alertEmailRoutes(testRoutingConfig(), alert); len(routes) != 1 {
+		t.Errorf("Expected only the account owners. Actually: %+v", routes)
+	}
+
+	alert.GraceStage = graceEscalated
+
+	if routes := alertEmailRoutes(testRoutingConfig(), alert); len(routes) != 2 {
+		t.Errorf("Expected the escalation recipients. Actually: %+v", routes)
+	}
+}
+
+func TestEmailSinkSplitsDigestsByAccountOwner(t *testing.T) {
+	sink, err := newEmailSink(testRoutingConfig())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink.EmitAlert(Alert{
+		Account:      Account{AccountName: "team-a"},
+		NicGroupName: "private-and-intranet",
+	})
+	sink.EmitAlert(Alert{
+		Account:      Account{AccountName: "team-b", EmailRoute: "team-b"},
+		NicGroupName: "private-and-intranet",
+	})
+
+	if len(sink.digestKeys) != 2 {
+		t.Fatalf("Expected 2 digests. Actually: %v", len(sink.digestKeys))
+	}
+
+	for _, key := range sink.digestKeys {
+		digest := sink.digests[key]
+
+		if len(digest.alerts) != 1 ||
+			digest.alerts[0].Account.AccountName != digest.account.AccountName {
+			t.Errorf("Digest for [%v] contains alerts for other accounts",
+				digest.account.AccountName)
+		}
+	}
+}
+
+func TestValidateEmailRoutesRejectsUndefinedRoute(t *testing.T) {
+	accounts := []Account{{AccountName: "team-c", EmailRoute: "team-c"}}
+
+	if err := validateEmailRoutes(testRoutingConfig(), accounts); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"errors"
+	"github.com/joyent/triton-go/compute"
+	"strings"
+	"testing"
+)
+
+func testEmailAlertData() emailTemplateData {
+	account := Account{
+		AccountName: "some.user",
+		Description: "Test account",
+	}
+
+	alert := Alert{
+		Account:      account,
+		NicGroupName: "public-and-intranet",
+		NicGroupIds:  []string{"public", "e70b8c02-91b8-11e7-ae1f-9392cd8e4bf7"},
+		Instance: compute.Instance{
+			ID:   "4167e82f-2bd8-46c0-ad4b-7899398c8720",
+			Name: "<script>alert('x')</script>",
+			IPs:  []string{"165.122.33.44"},
+		},
+	}
+
+	return emailTemplateData{
+		Account:        account,
+		Alerts:         []*emailAlert{{Alert: alert}},
+		Run:            &AuditRun{},
+		AdditionalBody: "Contact <security@some.site>",
+	}
+}
+
+func TestEmailRenderEscapesInstanceNameInHTML(t *testing.T) {
+	sink, err := newEmailSink(EmailAlerts{Subject: "Alert"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, html, renderErr := sink.render(testEmailAlertData())
+
+	if renderErr != nil {
+		t.Fatal(renderErr)
+	}
+
+	if strings.Contains(string(html), "<script>") {
+		t.Errorf("Instance name wasn't escaped in HTML body: %s", html)
+	}
+
+	if strings.Contains(string(html), "<security@some.site>") {
+		t.Errorf("Additional body wasn't escaped in HTML body: %s", html)
+	}
+}
+
+func TestEmailRenderIncludesTextBodyWithAdditionalBody(t *testing.T) {
+	sink, err := newEmailSink(EmailAlerts{Subject: "Alert"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, text, _, renderErr := sink.render(testEmailAlertData())
+
+	if renderErr != nil {
+		t.Fatal(renderErr)
+	}
+
+	if !strings.Contains(string(text), "Instance Name: <script>") {
+		t.Errorf("Text body is missing instance name: %s", text)
+	}
+
+	if !strings.Contains(string(text), "Contact <security@some.site>") {
+		t.Errorf("Text body is missing additional body: %s", text)
+	}
+}
+
+func TestEmailRenderIncludesOutcomeOfEveryNIC(t *testing.T) {
+	sink, err := newEmailSink(EmailAlerts{Subject: "Alert"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testEmailAlertData()
+	data.Alerts[0].Remediation = &RemediationResult{
+		NetworksRemoved: []string{"public"},
+		NICs: []NICRemoval{
+			{MAC: "90:b8:d0:00:00:01", IP: "165.122.33.44",
+				Network: "public", Outcome: nicRemoved},
+			{MAC: "90:b8:d0:00:00:05", IP: "165.122.33.45",
+				Network: "public", Outcome: nicFailed,
+				Err: errors.New("NIC is busy")},
+		},
+	}
+
+	_, text, html, renderErr := sink.render(data)
+
+	if renderErr != nil {
+		t.Fatal(renderErr)
+	}
+
+	for _, expected := range []string{
+		"NIC 90:b8:d0:00:00:01 165.122.33.44 (public): removed",
+		"NIC 90:b8:d0:00:00:05 165.122.33.45 (public): failed - NIC is busy",
+	} {
+		if !strings.Contains(string(text), expected) {
+			t.Errorf("Text body is missing [%v]: %s", expected, text)
+		}
+	}
+
+	if !strings.Contains(string(html), "public (90:b8:d0:00:00:05 165.122.33.45): failed - NIC is busy") {
+		t.Errorf("HTML body is missing failed NIC: %s", html)
+	}
+}
+
+func TestEmailRenderUsesSubjectTemplate(t *testing.T) {
+	config := EmailAlerts{
+		SubjectTemplate: "[{{.Account.AccountName}}] {{len .Alerts}} violations",
+	}
+	sink, err := newEmailSink(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, _, _, renderErr := sink.render(testEmailAlertData())
+
+	if renderErr != nil {
+		t.Fatal(renderErr)
+	}
+
+	if subject != "[some.user] 1 violations" {
+		t.Errorf("Unexpected subject: %v", subject)
+	}
+}
+
+func TestNewEmailSinkRejectsInvalidTemplate(t *testing.T) {
+	_, err := newEmailSink(EmailAlerts{HTMLTemplate: "{{.Broken"})
+
+	if err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Process exit codes. An exit code of 1 is reserved for unexpected fatal
+// errors.
+const (
+	exitClean                = 0
+	exitConfigError          = 2
+	exitPartialFailure       = 3
+	exitViolationsFound      = 4
+	exitViolationsRemediated = 5
+)
+
+// Conditions that can be selected with --fail-on to produce a non-zero
+// exit code.
+const (
+	failOnPartial    = "partial"
+	failOnViolations = "violations"
+	failOnRemediated = "remediated"
+)
+
+// defaultFailOn is the list of conditions that are fatal by default.
+const defaultFailOn = failOnPartial + "," + failOnViolations + "," + failOnRemediated
+
+// configFatalf logs a configuration error and exits with the configuration
+// error exit code.
+func configFatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	os.Exit(exitConfigError)
+}
+
+// parseFailOn parses the comma delimited list of conditions that should
+// produce a non-zero exit code.
+func parseFailOn(input string) (map[string]bool, error) {
+	failOn := make(map[string]bool)
+
+	for _, element := range strings.Split(input, ",") {
+		condition := strings.TrimSpace(element)
+
+		switch condition {
+		case "":
+			continue
+		case failOnPartial, failOnViolations, failOnRemediated:
+			failOn[condition] = true
+		default:
+			return nil, fmt.Errorf("Unknown --fail-on condition [%v]. It must "+
+				"be one of '%v', '%v' or '%v'", condition, failOnPartial,
+				failOnViolations, failOnRemediated)
+		}
+	}
+
+	return failOn, nil
+}
+
+// exitCodeForRun determines the exit code for a completed audit run. The
+// most severe condition selected by failOn is reported: a partial failure,
+// then violations that were not remediated and lastly violations that were
+// all remediated. Only violations of at least minSeverity are considered,
+// unless it is empty.
+func exitCodeForRun(run *AuditRun, failOn map[string]bool, minSeverity string) int {
+	if run.AccountsFailed > 0 && failOn[failOnPartial] {
+		return exitPartialFailure
+	}
+
+	alerts, remediated := run.AlertCount, run.AlertsRemediated
+
+	if len(minSeverity) > 0 {
+		alerts, remediated = 0, 0
+
+		for severity, count := range run.AlertsBySeverity {
+			if severityAtLeast(severity, minSeverity) {
+				alerts += count
+				remediated += run.RemediatedBySeverity[severity]
+			}
+		}
+	}
+
+	unremediated := alerts - remediated
+
+	if unremediated > 0 && failOn[failOnViolations] {
+		return exitViolationsFound
+	}
+
+	if remediated > 0 && failOn[failOnRemediated] {
+		return exitViolationsRemediated
+	}
+
+	return exitClean
+}
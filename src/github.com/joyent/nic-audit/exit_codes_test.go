@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"testing"
+)
+
+func TestExitCodeForRunIsCleanWithoutViolations(t *testing.T) {
+	failOn, _ := parseFailOn(defaultFailOn)
+	run := &AuditRun{AccountsAudited: 2, InstancesScanned: 10}
+
+	if code := exitCodeForRun(run, failOn, ""); code != exitClean {
+		t.Errorf("Expected exit code %v. Actually: %v", exitClean, code)
+	}
+}
+
+func TestExitCodeForRunReportsUnremediatedViolations(t *testing.T) {
+	failOn, _ := parseFailOn(defaultFailOn)
+	run := &AuditRun{AlertCount: 3, AlertsRemediated: 2}
+
+	if code := exitCodeForRun(run, failOn, ""); code != exitViolationsFound {
+		t.Errorf("Expected exit code %v. Actually: %v", exitViolationsFound, code)
+	}
+}
+
+func TestExitCodeForRunReportsRemediatedViolations(t *testing.T) {
+	failOn, _ := parseFailOn(defaultFailOn)
+	run := &AuditRun{AlertCount: 2, AlertsRemediated: 2}
+
+	if code := exitCodeForRun(run, failOn, ""); code != exitViolationsRemediated {
+		t.Errorf("Expected exit code %v. Actually: %v", exitViolationsRemediated, code)
+	}
+}
+
+func TestExitCodeForRunPrefersPartialFailure(t *testing.T) {
+	failOn, _ := parseFailOn(defaultFailOn)
+	run := &AuditRun{AlertCount: 2, AccountsFailed: 1}
+
+	if code := exitCodeForRun(run, failOn, ""); code != exitPartialFailure {
+		t.Errorf("Expected exit code %v. Actually: %v", exitPartialFailure, code)
+	}
+}
+
+func TestExitCodeForRunIgnoresConditionsNotSelected(t *testing.T) {
+	failOn, _ := parseFailOn("partial")
+	run := &AuditRun{AlertCount: 2, AlertsRemediated: 1}
+
+	if code := exitCodeForRun(run, failOn, ""); code != exitClean {
+		t.Errorf("Expected exit code %v. Actually: %v", exitClean, code)
+	}
+}
+
+func TestExitCodeForRunOnlyConsidersViolationsOfMinimumSeverity(t *testing.T) {
+	failOn, _ := parseFailOn(defaultFailOn)
+	run := &AuditRun{
+		AlertCount:           3,
+		AlertsRemediated:     1,
+		AlertsBySeverity:     map[string]int{severityLow: 2, severityHigh: 1},
+		RemediatedBySeverity: map[string]int{severityHigh: 1},
+	}
+
+	if code := exitCodeForRun(run, failOn, severityHigh); code != exitViolationsRemediated {
+		t.Errorf("Expected exit code %v. Actually: %v", exitViolationsRemediated, code)
+	}
+
+	if code := exitCodeForRun(run, failOn, severityCritical); code != exitClean {
+		t.Errorf("Expected exit code %v. Actually: %v", exitClean, code)
+	}
+
+	if code := exitCodeForRun(run, failOn, severityLow); code != exitViolationsFound {
+		t.Errorf("Expected exit code %v. Actually: %v", exitViolationsFound, code)
+	}
+}
+
+func TestParseFailOnRejectsUnknownCondition(t *testing.T) {
+	if _, err := parseFailOn("violations,everything"); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
@@ -9,7 +9,9 @@ package main
 
 import (
 	"golang.org/x/sys/unix"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 // exists function that determines if a given path exists.
@@ -27,3 +29,35 @@ func exists(filePath string) (exists bool) {
 func isReadable(path string) (readable bool) {
 	return unix.Access(path, unix.R_OK) == nil
 }
+
+// writeFileAtomically writes data to a temporary file in the directory of
+// the path and renames it over the path, so that readers never see a
+// partially written file.
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	tmp, tmpErr := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+
+	if tmpErr != nil {
+		return tmpErr
+	}
+
+	_, writeErr := tmp.Write(data)
+	closeErr := tmp.Close()
+
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+
+	if writeErr == nil {
+		writeErr = os.Chmod(tmp.Name(), perm)
+	}
+
+	if writeErr == nil {
+		writeErr = os.Rename(tmp.Name(), path)
+	}
+
+	if writeErr != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return writeErr
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+	"github.com/joyent/triton-go/network"
+)
+
+// firewallAlertGroup is the name used in place of a nic group for alerts of
+// the firewall audit.
+const firewallAlertGroup = "firewall"
+
+// ruleFirewall is the rule type of alerts of the firewall audit.
+const ruleFirewall = "firewall"
+
+// defaultSensitivePorts are the ports that shouldn't be open to any host
+// when no sensitive ports are configured.
+var defaultSensitivePorts = []int{22, 3389}
+
+// FirewallAuditConfig contains the configuration for auditing the Cloud
+// Firewall of instances with public NICs.
+type FirewallAuditConfig struct {
+	Enabled bool `json:"enabled"`
+	// Ports that rules must not allow from any host
+	SensitivePorts []int `json:"sensitive_ports"`
+	// Sensitive ports for instances matching a nic group instead of
+	// sensitive_ports
+	NicGroupSensitivePorts map[string][]int `json:"nic_group_sensitive_ports"`
+	// Severity of the firewall alerts
+	Severity string `json:"severity"`
+}
+
+// validateFirewallAudit checks the sensitive ports of the firewall audit.
+func validateFirewallAudit(config FirewallAuditConfig, nicGroups map[string][]string) error {
+	validPorts := func(ports []int) bool {
+		for _, port := range ports {
+			if port < 1 || port > 65535 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if !validPorts(config.SensitivePorts) {
+		return fmt.Errorf("Invalid firewall audit sensitive_ports %v",
+			config.SensitivePorts)
+	}
+
+	for nicGroup, ports := range config.NicGroupSensitivePorts {
+		if _, ok := nicGroups[nicGroup]; !ok {
+			return fmt.Errorf("Unknown nic group [%v] in the firewall audit "+
+				"sensitive ports", nicGroup)
+		}
+
+		if !validPorts(ports) {
+			return fmt.Errorf("Invalid firewall audit sensitive ports %v for "+
+				"nic group [%v]", ports, nicGroup)
+		}
+	}
+
+	return nil
+}
+
+// sensitivePorts returns the sensitive ports of an instance that matched
+// the specified nic groups.
+func (c FirewallAuditConfig) sensitivePorts(matched []string) []int {
+	var ports []int
+	found := false
+
+	for _, nicGroup := range matched {
+		if groupPorts, ok := c.NicGroupSensitivePorts[nicGroup]; ok {
+			ports = append(ports, groupPorts...)
+			found = true
+		}
+	}
+
+	if found {
+		return ports
+	}
+
+	if len(c.SensitivePorts) > 0 {
+		return c.SensitivePorts
+	}
+
+	return defaultSensitivePorts
+}
+
+var (
+	firewallAnyPattern      = regexp.MustCompile(`\bANY\b`)
+	firewallAllPortsPattern = regexp.MustCompile(`\bPORTS?\s+ALL\b`)
+	firewallPortPattern     = regexp.MustCompile(`(\d+)(?:\s*-\s*(\d+))?`)
+)
+
+// exposedPorts returns the sensitive ports that a Cloud Firewall rule allows
+// from any host, for example "FROM any TO all vms ALLOW tcp PORT 22".
+func exposedPorts(rule string, sensitive []int) []int {
+	upper := strings.ToUpper(rule)
+	to := strings.Index(upper, " TO ")
+	allow := strings.Index(upper, " ALLOW ")
+
+	if to < 0 || allow < to || !firewallAnyPattern.MatchString(upper[:to]) {
+		return nil
+	}
+
+	action := strings.Fields(upper[allow+len(" ALLOW "):])
+
+	if len(action) < 2 || (action[0] != "TCP" && action[0] != "UDP") {
+		return nil
+	}
+
+	ports := strings.Join(action[1:], " ")
+
+	if firewallAllPortsPattern.MatchString(ports) {
+		return sensitive
+	}
+
+	var exposed []int
+
+	for _, port := range sensitive {
+		for _, match := range firewallPortPattern.FindAllStringSubmatch(ports, -1) {
+			low, _ := strconv.Atoi(match[1])
+			high := low
+
+			if len(match[2]) > 0 {
+				high, _ = strconv.Atoi(match[2])
+			}
+
+			if port >= low && port <= high {
+				exposed = append(exposed, port)
+				break
+			}
+		}
+	}
+
+	return exposed
+}
+
+// hasPublicIP determines if any of the IPs of the instance is public.
+func hasPublicIP(instance compute.Instance, privateNetworkBlocks []string) bool {
+	for _, ip := range instance.IPs {
+		if isPublicIP(net.ParseIP(ip), privateNetworkBlocks) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// firewallViolations describes how the firewall of an instance fails to
+// protect it given the rules that apply to it.
+func firewallViolations(instance compute.Instance, rules []*network.FirewallRule,
+	sensitive []int) []string {
+
+	if !instance.FirewallEnabled {
+		return []string{"Firewall is disabled"}
+	}
+
+	var violations []string
+
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+
+		if ports := exposedPorts(rule.Rule, sensitive); len(ports) > 0 {
+			violations = append(violations, fmt.Sprintf("Rule [%v] allows any "+
+				"host to ports %v: %v", rule.ID, ports, rule.Rule))
+		}
+	}
+
+	return violations
+}
+
+// createAlertsForFirewalls audits the Cloud Firewall of every instance with
+// a public NIC and aggregates an alert for each instance whose firewall is
+// disabled or allows any host to a sensitive port. The nic group alerts
+// determine the sensitive ports of the instances that matched a nic group.
+func createAlertsForFirewalls(account Account, instances []*compute.Instance,
+	nicGroupAlerts list.List, client cloudAPI, config Configuration) list.List {
+
+	alerts := list.New()
+	audit := config.FirewallAudit
+
+	if !audit.Enabled {
+		return *alerts
+	}
+
+	matched := make(map[string][]string)
+	for e := nicGroupAlerts.Front(); e != nil; e = e.Next() {
+		alert := e.Value.(Alert)
+		matched[alert.Instance.ID] = append(matched[alert.Instance.ID],
+			alert.NicGroupName)
+	}
+
+	for _, instance := range instances {
+		if !hasPublicIP(*instance, config.PrivateNetworkBlocks) {
+			continue
+		}
+
+		var rules []*network.FirewallRule
+
+		if instance.FirewallEnabled {
+			var rulesErr error
+			rules, rulesErr = client.ListFirewallRules(context.Background(),
+				instance.ID)
+
+			if rulesErr != nil {
+				log.Printf("Unable to audit the firewall rules of instance "+
+					"[%v]: %v\n", instance.ID, rulesErr)
+				continue
+			}
+		}
+
+		violations := firewallViolations(*instance, rules,
+			audit.sensitivePorts(matched[instance.ID]))
+
+		if len(violations) > 0 {
+			alerts.PushBack(Alert{
+				Instance:     *instance,
+				Account:      account,
+				NicGroupName: firewallAlertGroup,
+				NicGroupIds:  []string{"public"},
+				RuleType:     ruleFirewall,
+				Violation:    strings.Join(violations, "; "),
+			})
+		}
+	}
+
+	return *alerts
+}
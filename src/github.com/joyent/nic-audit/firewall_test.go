@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/joyent/triton-go/network"
+)
+
+func TestExposedPorts(t *testing.T) {
+	sensitive := []int{22, 3389}
+
+	for rule, expected := range map[string][]int{
+		"FROM any TO all vms ALLOW tcp PORT 22":                        {22},
+		"FROM any TO vm abc ALLOW tcp (PORT 22 AND PORT 3389)":         {22, 3389},
+		"FROM any TO all vms ALLOW tcp PORTS 1 - 1024":                 {22},
+		"FROM any TO all vms ALLOW udp PORT all":                       {22, 3389},
+		"FROM (subnet 10.0.0.0/8 OR any) TO all vms ALLOW tcp PORT 22": {22},
+		"FROM any TO all vms ALLOW tcp PORT 443":                       nil,
+		"FROM subnet 10.0.0.0/8 TO all vms ALLOW tcp PORT 22":          nil,
+		"FROM any TO all vms BLOCK tcp PORT 22":                        nil,
+		"FROM any TO all vms ALLOW icmp TYPE 8 CODE 0":                 nil,
+	} {
+		if ports := exposedPorts(rule, sensitive); !reflect.DeepEqual(ports, expected) {
+			t.Errorf("Expected %v to expose %v. Actually: %v", rule, expected, ports)
+		}
+	}
+}
+
+func TestAuditAccountAlertsDisabledFirewall(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.NicGroups = map[string][]string{}
+	config.FirewallAudit.Enabled = true
+	sink := &recordingSink{}
+
+	if err := auditAccount(Account{AccountName: "some.user"}, config.NicGroups,
+		config, &AuditRun{}, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.alerts) != 1 || sink.alerts[0].Instance.Name != "offender" ||
+		sink.alerts[0].NicGroupName != firewallAlertGroup ||
+		sink.alerts[0].Violation != "Firewall is disabled" {
+		t.Errorf("Expected an alert for the public instance: %+v", sink.alerts)
+	}
+}
+
+func TestAuditAccountAlertsRulesOpenToAnyHost(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	fake.instances[0].FirewallEnabled = true
+	fake.rules[testOffenderID] = []*network.FirewallRule{
+		{ID: "web", Enabled: true, Rule: "FROM any TO all vms ALLOW tcp PORT 443"},
+		{ID: "ssh", Enabled: true, Rule: "FROM any TO all vms ALLOW tcp PORT 22"},
+		{ID: "off", Enabled: false, Rule: "FROM any TO all vms ALLOW tcp PORT 3389"},
+	}
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.FirewallAudit.Enabled = true
+	sink := &recordingSink{}
+
+	if err := auditAccount(Account{AccountName: "some.user"}, config.NicGroups,
+		config, &AuditRun{}, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.alerts) != 2 || sink.alerts[1].NicGroupName != firewallAlertGroup {
+		t.Fatalf("Expected a nic group and a firewall alert: %+v", sink.alerts)
+	}
+
+	violation := sink.alerts[1].Violation
+
+	if !strings.Contains(violation, "[ssh]") || strings.Contains(violation, "[web]") ||
+		strings.Contains(violation, "[off]") {
+		t.Errorf("Expected only the SSH rule to be reported: %v", violation)
+	}
+}
+
+func TestAuditAccountUsesSensitivePortsOfMatchedNicGroup(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	fake.instances[0].FirewallEnabled = true
+	fake.rules[testOffenderID] = []*network.FirewallRule{
+		{ID: "ssh", Enabled: true, Rule: "FROM any TO all vms ALLOW tcp PORT 22"},
+	}
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.FirewallAudit = FirewallAuditConfig{
+		Enabled: true,
+		NicGroupSensitivePorts: map[string][]int{
+			"public-and-intranet": {5432},
+		},
+	}
+	sink := &recordingSink{}
+
+	if err := auditAccount(Account{AccountName: "some.user"}, config.NicGroups,
+		config, &AuditRun{}, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.alerts) != 1 {
+		t.Errorf("Expected only the nic group alert: %+v", sink.alerts)
+	}
+}
+
+func TestValidateFirewallAuditRejectsInvalidPorts(t *testing.T) {
+	nicGroups := testAuditConfiguration().NicGroups
+
+	for _, config := range []FirewallAuditConfig{
+		{SensitivePorts: []int{0}},
+		{NicGroupSensitivePorts: map[string][]int{"unknown": {22}}},
+		{NicGroupSensitivePorts: map[string][]int{"public-and-intranet": {70000}}},
+	} {
+		if err := validateFirewallAudit(config, nicGroups); err == nil {
+			t.Errorf("Expected error for %+v and none was thrown", config)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// Stages of a violation of a nic group with a grace period.
+const (
+	// The owners have been alerted and the violation isn't yet escalated
+	graceAlerted = "alerted"
+	// The escalation recipients of the nic group are alerted as well
+	graceEscalated = "escalated"
+	// The grace period has expired and the violation is remediated
+	graceExpired = "expired"
+)
+
+// GracePeriodConfig contains the durations (e.g. "4h") after a violation of
+// a nic group was first seen when it is escalated and when it is
+// remediated.
+type GracePeriodConfig struct {
+	EscalateAfter  string `json:"escalate_after"`
+	RemediateAfter string `json:"remediate_after"`
+}
+
+// gracePeriod is a validated grace period of a nic group.
+type gracePeriod struct {
+	escalateAfter  time.Duration
+	remediateAfter time.Duration
+}
+
+// stage returns the stage of a violation first seen at the specified time.
+func (g gracePeriod) stage(firstSeen time.Time, now time.Time) string {
+	age := now.Sub(firstSeen)
+
+	switch {
+	case age >= g.remediateAfter:
+		return graceExpired
+	case age >= g.escalateAfter:
+		return graceEscalated
+	}
+
+	return graceAlerted
+}
+
+// newGracePeriods validates the grace periods of the remediation
+// configuration against the configured nic groups.
+func newGracePeriods(config RemediationConfig,
+	nicGroups map[string][]string) (map[string]gracePeriod, error) {
+
+	if len(config.GracePeriods) > 0 && len(config.StateFile) < 1 {
+		return nil, fmt.Errorf("Remediation grace periods need a state_file " +
+			"to record when violations were first seen")
+	}
+
+	periods := make(map[string]gracePeriod, len(config.GracePeriods))
+
+	for nicGroup, periodConfig := range config.GracePeriods {
+		if _, ok := nicGroups[nicGroup]; !ok {
+			return nil, fmt.Errorf("Unknown nic group [%v] in the remediation "+
+				"grace periods", nicGroup)
+		}
+
+		remediateAfter, remediateErr := time.ParseDuration(periodConfig.RemediateAfter)
+
+		if remediateErr != nil || remediateAfter < 0 {
+			return nil, fmt.Errorf("Invalid remediate_after [%v] in the grace "+
+				"period of nic group [%v]", periodConfig.RemediateAfter, nicGroup)
+		}
+
+		var escalateAfter time.Duration
+
+		if len(periodConfig.EscalateAfter) > 0 {
+			var escalateErr error
+			escalateAfter, escalateErr = time.ParseDuration(periodConfig.EscalateAfter)
+
+			if escalateErr != nil || escalateAfter < 0 || escalateAfter > remediateAfter {
+				return nil, fmt.Errorf("Invalid escalate_after [%v] in the grace "+
+					"period of nic group [%v]", periodConfig.EscalateAfter, nicGroup)
+			}
+		}
+
+		periods[nicGroup] = gracePeriod{
+			escalateAfter:  escalateAfter,
+			remediateAfter: remediateAfter,
+		}
+	}
+
+	return periods, nil
+}
+
+// violationKey identifies a single violation of a nic group by an instance.
+type violationKey struct {
+	Account    string `json:"account"`
+	Datacenter string `json:"datacenter,omitempty"`
+	Instance   string `json:"instance"`
+	NicGroup   string `json:"nic_group"`
+}
+
+// violationRecord is a violation as persisted in the state file.
+type violationRecord struct {
+	violationKey
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// violationState keeps track of when each violation was first seen across
+// audit runs. Violations that are no longer found when an account is
+// audited are forgotten, so a violation that reappears starts a new grace
+// period.
+type violationState struct {
+	path     string
+	previous map[violationKey]time.Time
+	current  map[violationKey]time.Time
+	audited  map[violationKey]bool
+}
+
+// newViolationState creates an empty state saved to the specified path, or
+// never saved when the path is empty.
+func newViolationState(path string) *violationState {
+	return &violationState{
+		path:     path,
+		previous: make(map[violationKey]time.Time),
+		current:  make(map[violationKey]time.Time),
+		audited:  make(map[violationKey]bool),
+	}
+}
+
+// loadViolationState reads the violations recorded in the state file at the
+// specified path. A missing state file is treated as empty.
+func loadViolationState(path string) (*violationState, error) {
+	state := newViolationState(path)
+	data, readErr := ioutil.ReadFile(path)
+
+	if os.IsNotExist(readErr) {
+		return state, nil
+	}
+
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var records []violationRecord
+
+	if unmarshalErr := json.Unmarshal(data, &records); unmarshalErr != nil {
+		return nil, fmt.Errorf("Invalid violation state file [%v]: %v", path,
+			unmarshalErr)
+	}
+
+	for _, record := range records {
+		state.previous[record.violationKey] = record.FirstSeen
+	}
+
+	return state, nil
+}
+
+// firstSeen returns the time the violation of the alert was first seen,
+// recording the specified time for a new violation.
+func (s *violationState) firstSeen(alert Alert, now time.Time) time.Time {
+	key := violationKey{
+		Account:    alert.Account.AccountName,
+		Datacenter: alert.Account.Datacenter,
+		Instance:   alert.Instance.ID,
+		NicGroup:   alert.NicGroupName,
+	}
+
+	seen, ok := s.current[key]
+
+	if !ok {
+		seen, ok = s.previous[key]
+	}
+
+	if !ok {
+		seen = now
+	}
+
+	s.current[key] = seen
+
+	return seen
+}
+
+// markAudited records that every violation of the account in its data
+// center has been seen by this run.
+func (s *violationState) markAudited(account Account) {
+	s.audited[auditedKey(account.AccountName, account.Datacenter)] = true
+}
+
+// auditedKey identifies an account in a data center among the audited
+// accounts.
+func auditedKey(accountName string, datacenter string) violationKey {
+	return violationKey{Account: accountName, Datacenter: datacenter}
+}
+
+// save atomically replaces the state file with the violations seen by this
+// run and those of accounts that couldn't be audited.
+func (s *violationState) save() error {
+	if len(s.path) < 1 {
+		return nil
+	}
+
+	records := make([]violationRecord, 0, len(s.current))
+
+	for key, seen := range s.current {
+		records = append(records, violationRecord{key, seen})
+	}
+
+	for key, seen := range s.previous {
+		if _, ok := s.current[key]; !ok && !s.audited[auditedKey(key.Account, key.Datacenter)] {
+			records = append(records, violationRecord{key, seen})
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i].violationKey, records[j].violationKey
+
+		if a.Account != b.Account {
+			return a.Account < b.Account
+		}
+
+		if a.Datacenter != b.Datacenter {
+			return a.Datacenter < b.Datacenter
+		}
+
+		if a.Instance != b.Instance {
+			return a.Instance < b.Instance
+		}
+
+		return a.NicGroup < b.NicGroup
+	})
+
+	data, marshalErr := json.MarshalIndent(records, "", "  ")
+
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	return writeFileAtomically(s.path, append(data, '\n'), 0600)
+}
+
+// applyGracePeriods records when each alert's violation was first seen and
+// sets the grace period stage of alerts for nic groups with a grace period.
+func applyGracePeriods(alerts list.List, state *violationState,
+	periods map[string]gracePeriod, now time.Time) list.List {
+
+	if state == nil {
+		return alerts
+	}
+
+	staged := list.New()
+
+	for e := alerts.Front(); e != nil; e = e.Next() {
+		alert := e.Value.(Alert)
+		alert.FirstSeen = state.firstSeen(alert, now)
+
+		if period, ok := periods[alert.NicGroupName]; ok {
+			alert.GraceStage = period.stage(alert.FirstSeen, now)
+			alert.RemediateAt = alert.FirstSeen.Add(period.remediateAfter)
+		}
+
+		staged.PushBack(alert)
+	}
+
+	return *staged
+}
+
+// inGracePeriod determines if remediation of the alert is deferred because
+// its grace period hasn't expired.
+func (a Alert) inGracePeriod() bool {
+	return a.GraceStage == graceAlerted || a.GraceStage == graceEscalated
+}
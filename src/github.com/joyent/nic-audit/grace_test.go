@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testGraceConfiguration returns a configuration with a grace period for
+// the test nic group along with a function that removes the state
+// directory.
+func testGraceConfiguration(t *testing.T) (Configuration, func()) {
+	dir, cleanup := testTempDir(t)
+
+	config := testAuditConfiguration()
+	config.Remediation = RemediationConfig{
+		StateFile: filepath.Join(dir, "state.json"),
+		GracePeriods: map[string]GracePeriodConfig{
+			"public-and-intranet": {EscalateAfter: "4h", RemediateAfter: "24h"},
+		},
+	}
+	config.Accounts = []Account{{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}}
+
+	return config, cleanup
+}
+
+func TestGracePeriodStages(t *testing.T) {
+	period := gracePeriod{escalateAfter: 4 * time.Hour, remediateAfter: 24 * time.Hour}
+	now := time.Now()
+
+	for age, expected := range map[time.Duration]string{
+		0:              graceAlerted,
+		5 * time.Hour:  graceEscalated,
+		24 * time.Hour: graceExpired,
+	} {
+		if stage := period.stage(now.Add(-age), now); stage != expected {
+			t.Errorf("Expected stage [%v] after %v. Actually: %v", expected, age, stage)
+		}
+	}
+}
+
+func TestAuditDefersRemediationDuringGracePeriod(t *testing.T) {
+	config, cleanup := testGraceConfiguration(t)
+	defer cleanup()
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	run := runAudit(config)
+
+	if len(fake.removedMACs()) != 0 {
+		t.Errorf("Expected no NICs to be removed: %v", fake.removedMACs())
+	}
+
+	if run.AlertCount != 1 || run.AlertsInGracePeriod != 1 {
+		t.Errorf("Expected the alert to be in its grace period: %+v", run)
+	}
+
+	state, loadErr := loadViolationState(config.Remediation.StateFile)
+
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	if len(state.previous) != 1 {
+		t.Errorf("Expected the violation to be recorded: %+v", state.previous)
+	}
+}
+
+func TestAuditRemediatesAfterGracePeriodExpires(t *testing.T) {
+	config, cleanup := testGraceConfiguration(t)
+	defer cleanup()
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	state := newViolationState(config.Remediation.StateFile)
+	state.current[violationKey{
+		Account:  "some.user",
+		Instance: testOffenderID,
+		NicGroup: "public-and-intranet",
+	}] = time.Now().Add(-25 * time.Hour)
+
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	run := runAudit(config)
+
+	if removed := fake.removedMACs(); len(removed) != 1 || removed[0] != "90:b8:d0:00:00:01" {
+		t.Errorf("Expected the public NIC to be removed: %v", removed)
+	}
+
+	if run.AlertsRemediated != 1 || run.AlertsInGracePeriod != 0 {
+		t.Errorf("Expected the alert to be remediated: %+v", run)
+	}
+}
+
+func TestViolationStateForgetsResolvedViolations(t *testing.T) {
+	config, cleanup := testGraceConfiguration(t)
+	defer cleanup()
+
+	state := newViolationState(config.Remediation.StateFile)
+	resolved := violationKey{Account: "some.user", Instance: "resolved",
+		NicGroup: "public-and-intranet"}
+	unaudited := violationKey{Account: "other.user", Instance: "unaudited",
+		NicGroup: "public-and-intranet"}
+	state.previous[resolved] = time.Now()
+	state.previous[unaudited] = time.Now()
+	state.markAudited(Account{AccountName: "some.user"})
+
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, loadErr := loadViolationState(config.Remediation.StateFile)
+
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	if _, ok := saved.previous[resolved]; ok {
+		t.Error("Expected the resolved violation to be forgotten")
+	}
+
+	if _, ok := saved.previous[unaudited]; !ok {
+		t.Error("Expected the violation of the unaudited account to be kept")
+	}
+}
+
+func TestNewGracePeriodsRejectsInvalidConfiguration(t *testing.T) {
+	nicGroups := testAuditConfiguration().NicGroups
+
+	for _, config := range []RemediationConfig{
+		{GracePeriods: map[string]GracePeriodConfig{
+			"public-and-intranet": {RemediateAfter: "24h"}}},
+		{StateFile: "state.json", GracePeriods: map[string]GracePeriodConfig{
+			"unknown": {RemediateAfter: "24h"}}},
+		{StateFile: "state.json", GracePeriods: map[string]GracePeriodConfig{
+			"public-and-intranet": {EscalateAfter: "48h", RemediateAfter: "24h"}}},
+		{StateFile: "state.json", GracePeriods: map[string]GracePeriodConfig{
+			"public-and-intranet": {}}},
+	} {
+		if _, err := newGracePeriods(config, nicGroups); err == nil {
+			t.Errorf("Expected error for %+v and none was thrown", config)
+		}
+	}
+}
+
+func TestAuditAccountRejectsGracePeriodsWithoutStateFile(t *testing.T) {
+	config, cleanup := testGraceConfiguration(t)
+	defer cleanup()
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config.Remediation.StateFile = ""
+
+	if err := auditAccount(config.Accounts[0], config.NicGroups, config,
+		&AuditRun{}, &recordingSink{}); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 0 {
+		t.Errorf("Expected no NICs to be removed: %v", removed)
+	}
+}
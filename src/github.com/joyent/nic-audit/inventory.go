@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+	"github.com/joyent/triton-go/network"
+)
+
+// defaultInventoryAccount is the account name used for inventory records
+// that don't identify their account.
+const defaultInventoryAccount = "inventory"
+
+// inventoryRecord is a single instance in an inventory file. It has the
+// same shape as the output of `triton instance list -j` with the addition
+// of the account that owns the instance and its NICs.
+type inventoryRecord struct {
+	compute.Instance
+	Account    string         `json:"account,omitempty"`
+	Datacenter string         `json:"datacenter,omitempty"`
+	NICs       []*compute.NIC `json:"nics,omitempty"`
+}
+
+// errOfflineInventory is returned when a mutating call is made against an
+// offline inventory.
+var errOfflineInventory = errors.New("Remediation isn't possible when " +
+	"auditing an offline inventory")
+
+// inventoryCloudAPI is a read only cloudAPI backed by the records of an
+// inventory file for a single account.
+type inventoryCloudAPI struct {
+	records []*inventoryRecord
+}
+
+func (i *inventoryCloudAPI) ListInstances(ctx context.Context) ([]*compute.Instance, error) {
+	instances := make([]*compute.Instance, 0, len(i.records))
+
+	for _, record := range i.records {
+		instance := record.Instance
+		instances = append(instances, &instance)
+	}
+
+	return instances, nil
+}
+
+func (i *inventoryCloudAPI) ListNICs(ctx context.Context, instanceID string) ([]*compute.NIC, error) {
+	for _, record := range i.records {
+		if record.ID == instanceID {
+			return record.NICs, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Instance [%v] isn't in the inventory", instanceID)
+}
+
+func (i *inventoryCloudAPI) RemoveNIC(ctx context.Context, instanceID string, mac string) error {
+	return errOfflineInventory
+}
+
+func (i *inventoryCloudAPI) AddNIC(ctx context.Context, instanceID string,
+	networkID string, ip string) (*compute.NIC, error) {
+
+	return nil, errOfflineInventory
+}
+
+func (i *inventoryCloudAPI) ListNetworks(ctx context.Context) ([]*network.Network, error) {
+	return nil, nil
+}
+
+func (i *inventoryCloudAPI) StopInstance(ctx context.Context, instanceID string) error {
+	return errOfflineInventory
+}
+
+func (i *inventoryCloudAPI) EnableFirewall(ctx context.Context, instanceID string) error {
+	return errOfflineInventory
+}
+
+func (i *inventoryCloudAPI) AddTags(ctx context.Context, instanceID string,
+	tags map[string]string) error {
+
+	return errOfflineInventory
+}
+
+func (i *inventoryCloudAPI) UpdateMetadata(ctx context.Context, instanceID string,
+	metadata map[string]string) error {
+
+	return errOfflineInventory
+}
+
+// ListFirewallRules returns no rules since inventories don't contain them,
+// so only disabled firewalls are found in an offline audit.
+func (i *inventoryCloudAPI) ListFirewallRules(ctx context.Context,
+	instanceID string) ([]*network.FirewallRule, error) {
+
+	return nil, nil
+}
+
+// ListDatacenters returns no data centers since an inventory doesn't
+// describe them.
+func (i *inventoryCloudAPI) ListDatacenters(ctx context.Context) ([]*compute.DataCenter, error) {
+	return nil, nil
+}
+
+// readInventory parses inventory records from either a JSON array or a
+// stream of JSON objects as written by `triton instance list -j`.
+func readInventory(reader io.Reader) ([]*inventoryRecord, error) {
+	buffered := bufio.NewReader(reader)
+	decoder := json.NewDecoder(buffered)
+
+	first, peekErr := peekNonSpace(buffered)
+
+	if peekErr == io.EOF {
+		return nil, nil
+	}
+
+	if peekErr != nil {
+		return nil, peekErr
+	}
+
+	if first == '[' {
+		var records []*inventoryRecord
+		decodeErr := decoder.Decode(&records)
+		return records, decodeErr
+	}
+
+	var records []*inventoryRecord
+
+	for {
+		record := &inventoryRecord{}
+		decodeErr := decoder.Decode(record)
+
+		if decodeErr == io.EOF {
+			return records, nil
+		}
+
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+
+		records = append(records, record)
+	}
+}
+
+// peekNonSpace returns the first character in the reader that isn't white
+// space without consuming it.
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		next, peekErr := reader.Peek(1)
+
+		if peekErr != nil {
+			return 0, peekErr
+		}
+
+		switch next[0] {
+		case ' ', '\t', '\r', '\n':
+			reader.ReadByte()
+		default:
+			return next[0], nil
+		}
+	}
+}
+
+// readInventoryFromFile parses the inventory file at the specified path.
+func readInventoryFromFile(path string) ([]*inventoryRecord, error) {
+	file, openErr := os.Open(path)
+
+	if openErr != nil {
+		return nil, openErr
+	}
+
+	defer file.Close()
+
+	return readInventory(file)
+}
+
+// useInventory switches the audit to the records of an inventory file. The
+// returned configuration contains an account for every account and data
+// center found in the inventory, taken from the configuration when it is
+// known, with remediation disabled.
+func useInventory(config Configuration, records []*inventoryRecord) Configuration {
+	configured := make(map[string]Account, len(config.Accounts))
+	for _, account := range config.Accounts {
+		configured[account.AccountName] = account
+	}
+
+	grouped := make(map[string][]*inventoryRecord)
+	var accounts []Account
+
+	for _, record := range records {
+		name := record.Account
+		if len(name) < 1 {
+			name = defaultInventoryAccount
+		}
+
+		key := name + "\x00" + record.Datacenter
+
+		if _, ok := grouped[key]; !ok {
+			account, ok := configured[name]
+
+			if !ok {
+				account = Account{
+					AccountName: name,
+					Description: "Offline inventory",
+				}
+			}
+
+			account.Datacenter = record.Datacenter
+			account.Datacenters = nil
+			account.DiscoverDatacenters = false
+			account.NetworksToRemove = nil
+			account.NicGroupNetworksToRemove = nil
+			account.RemediationActions = nil
+			account.RemediationCredential = nil
+			accounts = append(accounts, account)
+		}
+
+		grouped[key] = append(grouped[key], record)
+	}
+
+	newCloudAPI = func(account Account) (cloudAPI, error) {
+		key := account.AccountName + "\x00" + account.Datacenter
+		return &inventoryCloudAPI{records: grouped[key]}, nil
+	}
+
+	config.Accounts = accounts
+	// Offline audits don't age the violations seen by CloudAPI audits
+	config.Remediation.StateFile = ""
+
+	return config
+}
+
+// exportInventory writes the instances and NICs of every configured account
+// to the writer in the inventory format.
+func exportInventory(config Configuration, writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	ctx := context.Background()
+
+	for _, configured := range config.Accounts {
+		accounts, datacentersErr := accountDatacenters(configured)
+
+		if datacentersErr != nil {
+			return datacentersErr
+		}
+
+		for _, account := range accounts {
+			if exportErr := exportAccountInventory(ctx, account, encoder); exportErr != nil {
+				return exportErr
+			}
+		}
+	}
+
+	return nil
+}
+
+// exportAccountInventory writes the instances and NICs of an account in a
+// single data center to the encoder.
+func exportAccountInventory(ctx context.Context, account Account,
+	encoder *json.Encoder) error {
+
+	log.Printf("Exporting inventory for account [%v]\n",
+		accountInDatacenter(account.AccountName, account.Datacenter))
+
+	client, clientErr := newCloudAPI(account)
+
+	if clientErr != nil {
+		return clientErr
+	}
+
+	instances, instancesErr := client.ListInstances(ctx)
+
+	if instancesErr != nil {
+		return instancesErr
+	}
+
+	for _, instance := range instances {
+		nics, nicsErr := client.ListNICs(ctx, instance.ID)
+
+		if nicsErr != nil {
+			return nicsErr
+		}
+
+		record := inventoryRecord{
+			Instance:   *instance,
+			Account:    account.AccountName,
+			Datacenter: account.Datacenter,
+			NICs:       nics,
+		}
+
+		if encodeErr := encoder.Encode(record); encodeErr != nil {
+			return encodeErr
+		}
+	}
+
+	return nil
+}
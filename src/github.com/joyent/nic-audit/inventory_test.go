@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testInventoryStream = `
+{"id":"4167e82f-2bd8-46c0-ad4b-7899398c8720","name":"offender","ips":["165.122.33.44","10.2.45.234"],"networks":["14323a83-b0e3-44e8-bd67-fc7078cc94ba","e70b8c02-91b8-11e7-ae1f-9392cd8e4bf7"],"account":"some.user","nics":[{"mac":"90:b8:d0:00:00:01","ip":"165.122.33.44","network":"14323a83-b0e3-44e8-bd67-fc7078cc94ba","primary":true}]}
+{"id":"91ddcc19-b7f9-47b8-8258-f2741bd44112","name":"compliant","ips":["192.168.0.7"],"networks":["70294144-7680-43d2-9ed0-897ce1658f80"]}
+`
+
+func TestReadInventoryParsesObjectStream(t *testing.T) {
+	records, err := readInventory(strings.NewReader(testInventoryStream))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records. Actually: %v", len(records))
+	}
+
+	if records[0].Name != "offender" || records[0].Account != "some.user" ||
+		len(records[0].NICs) != 1 || len(records[0].IPs) != 2 {
+		t.Errorf("Unexpected first record: %+v", records[0])
+	}
+}
+
+func TestReadInventoryParsesArray(t *testing.T) {
+	input := `[{"id":"a","name":"one"},{"id":"b","name":"two"}]`
+	records, err := readInventory(strings.NewReader(input))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || records[1].Name != "two" {
+		t.Errorf("Unexpected records: %+v", records)
+	}
+}
+
+func TestAuditOfInventoryFindsViolationsWithoutRemediation(t *testing.T) {
+	records, err := readInventory(strings.NewReader(testInventoryStream))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// useInventory replaces newCloudAPI until it is restored
+	defer useCloudAPIFactory(newCloudAPI)()
+
+	config := testAuditConfiguration()
+	config.Accounts = []Account{{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}}
+	config = useInventory(config, records)
+
+	if len(config.Accounts) != 2 {
+		t.Fatalf("Expected an account per inventory account: %+v", config.Accounts)
+	}
+
+	sink := &recordingSink{}
+	run := &AuditRun{}
+
+	for _, account := range config.Accounts {
+		if len(account.NetworksToRemove) > 0 {
+			t.Errorf("Expected remediation to be disabled for [%v]",
+				account.AccountName)
+		}
+
+		if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(sink.alerts) != 1 || sink.alerts[0].Instance.Name != "offender" {
+		t.Errorf("Expected a single alert for the offending instance: %+v",
+			sink.alerts)
+	}
+
+	if len(sink.remediations) != 0 {
+		t.Errorf("Expected no remediation: %+v", sink.remediations)
+	}
+}
+
+func TestExportInventoryCanBeReadBack(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := Configuration{Accounts: []Account{{AccountName: "some.user"}}}
+	var buffer bytes.Buffer
+
+	if err := exportInventory(config, &buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	records, readErr := readInventory(&buffer)
+
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	if len(records) != 2 || records[0].Account != "some.user" ||
+		len(records[0].NICs) != 2 {
+		t.Errorf("Unexpected exported records: %+v", records)
+	}
+}
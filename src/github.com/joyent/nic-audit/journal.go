@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Journal entry actions.
+const (
+	journalRemoved  = "removed"
+	journalRestored = "restored"
+)
+
+// journalEntry records a single NIC removed by remediation or restored by
+// the restore command.
+type journalEntry struct {
+	Time         time.Time `json:"time"`
+	Action       string    `json:"action"`
+	Account      string    `json:"account"`
+	Datacenter   string    `json:"datacenter,omitempty"`
+	TritonURL    string    `json:"triton_url,omitempty"`
+	Instance     string    `json:"instance"`
+	InstanceName string    `json:"instance_name"`
+	MAC          string    `json:"mac"`
+	Network      string    `json:"network"`
+	IP           string    `json:"ip"`
+	Primary      bool      `json:"primary"`
+	NicGroup     string    `json:"nic_group,omitempty"`
+	// RemovedMAC is the MAC address of the removed NIC that a restored
+	// NIC replaces.
+	RemovedMAC string `json:"removed_mac,omitempty"`
+}
+
+// appendJournal appends an entry to the journal file at the specified path,
+// creating the file if it doesn't exist.
+func appendJournal(path string, entry journalEntry) error {
+	file, openErr := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+
+	if openErr != nil {
+		return openErr
+	}
+
+	line, marshalErr := json.Marshal(entry)
+
+	if marshalErr != nil {
+		file.Close()
+		return marshalErr
+	}
+
+	_, writeErr := file.Write(append(line, '\n'))
+
+	if writeErr == nil {
+		writeErr = file.Sync()
+	}
+
+	closeErr := file.Close()
+
+	if writeErr != nil {
+		return writeErr
+	}
+
+	return closeErr
+}
+
+// journalRemoval records a NIC removed from the instance of an alert. An
+// error writing the journal is logged rather than stopping remediation.
+func journalRemoval(path string, alert Alert, removal NICRemoval) {
+	if len(path) < 1 {
+		return
+	}
+
+	journalErr := appendJournal(path, journalEntry{
+		Time:         time.Now().UTC(),
+		Action:       journalRemoved,
+		Account:      alert.Account.AccountName,
+		Datacenter:   alert.Account.Datacenter,
+		TritonURL:    alert.Account.TritonUrl,
+		Instance:     alert.Instance.ID,
+		InstanceName: alert.Instance.Name,
+		MAC:          removal.MAC,
+		Network:      removal.NetworkID,
+		IP:           removal.IP,
+		Primary:      removal.Primary,
+		NicGroup:     alert.NicGroupName,
+	})
+
+	if journalErr != nil {
+		log.Printf("ERROR: unable to journal removal of NIC [%v] from "+
+			"instance [%v] to [%v]: %v\n", removal.MAC, alert.Instance.ID,
+			path, journalErr)
+	}
+}
+
+// readJournal reads every entry of the journal file at the specified path.
+func readJournal(path string) ([]journalEntry, error) {
+	file, openErr := os.Open(path)
+
+	if openErr != nil {
+		return nil, openErr
+	}
+
+	defer file.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) < 1 {
+			continue
+		}
+
+		var entry journalEntry
+
+		if unmarshalErr := json.Unmarshal(scanner.Bytes(), &entry); unmarshalErr != nil {
+			return nil, fmt.Errorf("Invalid journal entry on line %v of [%v]: %v",
+				line, path, unmarshalErr)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// findRemoval returns the latest removal of the NIC with the specified MAC
+// address from the instance, unless the NIC has been restored since.
+func findRemoval(entries []journalEntry, instanceID string, mac string) (journalEntry, error) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+
+		if entry.Instance != instanceID {
+			continue
+		}
+
+		if entry.Action == journalRestored &&
+			strings.EqualFold(entry.RemovedMAC, mac) {
+			return journalEntry{}, fmt.Errorf("NIC [%v] of instance [%v] "+
+				"has already been restored as NIC [%v]", mac, instanceID,
+				entry.MAC)
+		}
+
+		if entry.Action == journalRemoved && strings.EqualFold(entry.MAC, mac) {
+			return entry, nil
+		}
+	}
+
+	return journalEntry{}, fmt.Errorf("No removal of NIC [%v] from instance "+
+		"[%v] in the journal", mac, instanceID)
+}
+
+// restoreNIC re-adds a NIC removed by remediation to the same network,
+// requesting the IP it had before, and journals the restored NIC.
+func restoreNIC(config Configuration, instanceID string, mac string) error {
+	path := config.Remediation.Journal
+
+	if len(path) < 1 {
+		return fmt.Errorf("No remediation journal has been configured")
+	}
+
+	entries, readErr := readJournal(path)
+
+	if readErr != nil {
+		return readErr
+	}
+
+	removal, removalErr := findRemoval(entries, instanceID, mac)
+
+	if removalErr != nil {
+		return removalErr
+	}
+
+	account, accountErr := findDatacenterAccount(config, removal.Account,
+		removal.Datacenter, removal.TritonURL)
+
+	if accountErr != nil {
+		return accountErr
+	}
+
+	client, clientErr := newCloudAPI(account.remediationAccount())
+
+	if clientErr != nil {
+		return clientErr
+	}
+
+	log.Printf("Restoring NIC on network [%v] with IP [%v] to instance [%v]\n",
+		removal.Network, removal.IP, instanceID)
+
+	nic, addErr := client.AddNIC(context.Background(), instanceID,
+		removal.Network, removal.IP)
+
+	if addErr != nil {
+		return addErr
+	}
+
+	if nic.IP != removal.IP {
+		log.Printf("Restored NIC was assigned IP [%v] instead of [%v]\n",
+			nic.IP, removal.IP)
+	}
+
+	restored := removal
+	restored.Time = time.Now().UTC()
+	restored.Action = journalRestored
+	restored.MAC = nic.MAC
+	restored.RemovedMAC = removal.MAC
+	restored.IP = nic.IP
+	restored.Primary = nic.Primary
+
+	return appendJournal(path, restored)
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemediationJournalsRemovedNICs(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	journal := filepath.Join(dir, "journal.ndjson")
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.Remediation.Journal = journal
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}
+
+	if err := auditAccount(account, config.NicGroups, config, &AuditRun{},
+		&recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, readErr := readJournal(journal)
+
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected a single journal entry: %+v", entries)
+	}
+
+	entry := entries[0]
+
+	if entry.Action != journalRemoved || entry.Account != "some.user" ||
+		entry.Instance != "4167e82f-2bd8-46c0-ad4b-7899398c8720" ||
+		entry.MAC != "90:b8:d0:00:00:01" || entry.Network != testPublicNetwork ||
+		entry.IP != "165.122.33.44" || entry.NicGroup != "public-and-intranet" ||
+		entry.Time.IsZero() {
+		t.Errorf("Unexpected journal entry: %+v", entry)
+	}
+}
+
+func TestRestoreNICReAddsNICWithSameIP(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	journal := filepath.Join(dir, "journal.ndjson")
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.Remediation.Journal = journal
+	config.Accounts = []Account{{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}}
+	instanceID := "4167e82f-2bd8-46c0-ad4b-7899398c8720"
+
+	if err := auditAccount(config.Accounts[0], config.NicGroups, config,
+		&AuditRun{}, &recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreNIC(config, instanceID, "90:B8:D0:00:00:01"); err != nil {
+		t.Fatal(err)
+	}
+
+	nics, _ := fake.ListNICs(context.Background(), instanceID)
+	restored := false
+
+	for _, nic := range nics {
+		if nic.Network == testPublicNetwork && nic.IP == "165.122.33.44" {
+			restored = true
+		}
+	}
+
+	if !restored {
+		t.Errorf("Expected the public NIC to be restored: %+v", nics)
+	}
+
+	entries, _ := readJournal(journal)
+
+	if len(entries) != 2 || entries[1].Action != journalRestored ||
+		entries[1].IP != "165.122.33.44" {
+		t.Errorf("Expected the restore to be journaled: %+v", entries)
+	}
+}
+
+func TestRestoreNICUsesAccountBlockOfRemoval(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	journal := filepath.Join(dir, "journal.ndjson")
+
+	east := newFakeCloudAPI()
+	west := newTestFakeCloudAPI()
+	fakes := map[string]*fakeCloudAPI{
+		"https://us-east-1.api.example.com": east,
+		"https://us-west-1.api.example.com": west,
+	}
+	defer useCloudAPIFactory(func(account Account) (cloudAPI, error) {
+		return fakes[account.TritonUrl], nil
+	})()
+
+	config := testAuditConfiguration()
+	config.Remediation.Journal = journal
+	config.Accounts = []Account{{
+		AccountName:      "some.user",
+		TritonUrl:        "https://us-east-1.api.example.com",
+		Datacenter:       "us-east-1",
+		NetworksToRemove: []string{"public"},
+	}, {
+		AccountName:      "some.user",
+		TritonUrl:        "https://us-west-1.api.example.com",
+		Datacenter:       "us-west-1",
+		NetworksToRemove: []string{"public"},
+	}}
+
+	if err := auditAccount(config.Accounts[1], config.NicGroups, config,
+		&AuditRun{}, &recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := readJournal(journal)
+
+	if len(entries) != 1 || entries[0].TritonURL != config.Accounts[1].TritonUrl {
+		t.Fatalf("Expected the CloudAPI URL to be journaled: %+v", entries)
+	}
+
+	if err := restoreNIC(config, testOffenderID, "90:b8:d0:00:00:01"); err != nil {
+		t.Fatal(err)
+	}
+
+	nics, _ := west.ListNICs(context.Background(), testOffenderID)
+
+	if len(nics) != 2 {
+		t.Errorf("Expected the NIC to be restored in us-west-1: %+v", nics)
+	}
+}
+
+func TestRestoreNICRequiresJournalEntry(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	journal := filepath.Join(dir, "journal.ndjson")
+
+	if err := appendJournal(journal, journalEntry{
+		Action:   journalRemoved,
+		Account:  "some.user",
+		Instance: "4167e82f-2bd8-46c0-ad4b-7899398c8720",
+		MAC:      "90:b8:d0:00:00:01",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := Configuration{
+		Remediation: RemediationConfig{Journal: journal},
+		Accounts:    []Account{{AccountName: "some.user"}},
+	}
+
+	if err := restoreNIC(config, "4167e82f-2bd8-46c0-ad4b-7899398c8720",
+		"90:b8:d0:00:00:09"); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
+
+func TestRestoreNICRefusesRestoredNIC(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	journal := filepath.Join(dir, "journal.ndjson")
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.Remediation.Journal = journal
+	config.Accounts = []Account{{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}}
+	instanceID := "4167e82f-2bd8-46c0-ad4b-7899398c8720"
+
+	if err := auditAccount(config.Accounts[0], config.NicGroups, config,
+		&AuditRun{}, &recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreNIC(config, instanceID, "90:B8:D0:00:00:01"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreNIC(config, instanceID, "90:b8:d0:00:00:01"); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+
+	nics, _ := fake.ListNICs(context.Background(), instanceID)
+	public := 0
+
+	for _, nic := range nics {
+		if nic.Network == testPublicNetwork {
+			public++
+		}
+	}
+
+	if public != 1 {
+		t.Errorf("Expected a single public NIC to be restored: %+v", nics)
+	}
+}
+
+func TestReadJournalRejectsInvalidEntries(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	journal := filepath.Join(dir, "journal.ndjson")
+
+	if err := ioutil.WriteFile(journal, []byte("{\"action\":\"removed\"}\nnot json\n"),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readJournal(journal); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
@@ -8,7 +8,11 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"sync/atomic"
+	"time"
 )
 
 import (
@@ -17,41 +21,208 @@ import (
 
 // main is the entry point to the application.
 func main() {
-	configFile := parseCLIFlagsForConfigFilePath()
+	options := parseCLIFlags()
+	configFile := options.ConfigFile
 
 	log.Println("NIC Compliance Auditing Tool")
-	log.Println("https://github.com/joyent/nic-audit\n")
+	log.Print("https://github.com/joyent/nic-audit\n\n")
 	log.Printf("Reading configuration from: %v\n", configFile)
 
 	config, configErr := readConfigFromFile(configFile)
-	validateConfiguration(config)
 
 	if configErr != nil {
-		log.Fatalf("Error reading configuration. Details: %v\n", configErr)
+		configFatalf("Error reading configuration. Details: %v\n", configErr)
 	}
 
+	validateConfiguration(config, len(options.Inventory) < 1)
+	cloudAPIRetryPolicy, _ = newRetryPolicy(config.CloudAPIRetry)
+
+	if len(options.Inventory) > 0 {
+		log.Printf("Auditing offline inventory from: %v\n", options.Inventory)
+		records, inventoryErr := readInventoryFromFile(options.Inventory)
+
+		if inventoryErr != nil {
+			configFatalf("Error reading inventory. Details: %v\n", inventoryErr)
+		}
+
+		config = useInventory(config, records)
+	}
+
+	if getopt.NArgs() > 0 {
+		commandErr := runCommand(getopt.Args(), config)
+
+		if commandErr != nil {
+			log.Fatalf("ERROR: %v\n", commandErr)
+		}
+
+		return
+	}
+
+	// Credentials that couldn't be checked fail the start like a partial
+	// failure, since CloudAPI may only be unavailable for a while
+	credentialsErr := verifyReadOnlyCredentials(config)
+
+	if _, unverified := credentialsErr.(unverifiedCredentialsError); unverified {
+		log.Printf("ERROR: %v\n", credentialsErr)
+		os.Exit(exitPartialFailure)
+	} else if credentialsErr != nil {
+		configFatalf("%v", credentialsErr)
+	}
+
+	startMetricsServer(config.Metrics)
+
+	for {
+		run := runAudit(config)
+
+		if options.Interval <= 0 {
+			os.Exit(exitCodeForRun(run, options.FailOn, options.FailSeverity))
+		}
+
+		log.Printf("Next audit in %v\n", options.Interval)
+		time.Sleep(options.Interval)
+	}
+}
+
+// cliOptions contains the values of the command line options.
+type cliOptions struct {
+	ConfigFile   string
+	Interval     time.Duration
+	FailOn       map[string]bool
+	FailSeverity string
+	Inventory    string
+}
+
+// runAudit audits every configured account and delivers the resulting
+// alerts to the configured alert sinks. A summary of the run is returned.
+func runAudit(config Configuration) *AuditRun {
+	sink, sinkErr := buildAlertSinks(config)
+
+	if sinkErr != nil {
+		configFatalf("Error configuring alert sinks. Details: %v\n", sinkErr)
+	}
+
+	run := &AuditRun{Started: time.Now()}
+
+	if len(config.Remediation.StateFile) > 0 {
+		state, stateErr := loadViolationState(config.Remediation.StateFile)
+
+		// Without the recorded state every violation starts a new grace
+		// period, and the unreadable state file is left as it is
+		if stateErr != nil {
+			log.Printf("ERROR: unable to read violation state: %v\n", stateErr)
+			state = newViolationState("")
+		}
+
+		run.violations = state
+	}
+
+	retriesBefore := atomic.LoadInt64(&cloudAPIRetries)
+	sink.BeginRun(run)
+
 	for i := 0; i < len(config.Accounts); i++ {
-		account := config.Accounts[i]
-		auditErr := auditAccount(account, config.NicGroups, config)
+		accounts, datacentersErr := accountDatacenters(config.Accounts[i])
+
+		if datacentersErr != nil {
+			log.Printf("ERROR: %v", datacentersErr)
+			run.AccountsFailed++
+			auditMetrics.add(metricAuditErrors,
+				accountMetricLabels(config.Accounts[i]), 1)
+			continue
+		}
+
+		for _, account := range accounts {
+			auditErr := auditAccount(account, config.NicGroups, config, run, sink)
+
+			if auditErr != nil {
+				if len(account.Datacenter) > 0 {
+					auditErr = fmt.Errorf("Datacenter [%v] of account [%v]: %v",
+						account.Datacenter, account.AccountName, auditErr)
+				}
+
+				log.Printf("ERROR: %v", auditErr)
+				run.AccountsFailed++
+				auditMetrics.add(metricAuditErrors,
+					accountMetricLabels(account), 1)
+			}
+		}
+	}
+
+	run.Finished = time.Now()
+	run.CloudAPIRetries = int(atomic.LoadInt64(&cloudAPIRetries) - retriesBefore)
+
+	if run.violations != nil {
+		if stateErr := run.violations.save(); stateErr != nil {
+			log.Printf("ERROR: unable to write violation state: %v\n", stateErr)
+		}
+	}
 
-		if auditErr != nil {
-			log.Printf("ERROR: %v", auditErr)
+	if config.Remediation.RequireApproval {
+		if planErr := writeRunPlan(config.Remediation, run); planErr != nil {
+			log.Printf("ERROR: unable to write remediation plan: %v\n", planErr)
 		}
 	}
+	sink.EndRun(run)
+
+	auditMetrics.set(metricRunDurationSeconds, "",
+		run.Finished.Sub(run.Started).Seconds())
+
+	if len(config.Metrics.Textfile) > 0 {
+		textfileErr := auditMetrics.writeTextfile(config.Metrics.Textfile)
+
+		if textfileErr != nil {
+			log.Printf("ERROR: unable to write metrics to [%v]: %v\n",
+				config.Metrics.Textfile, textfileErr)
+		}
+	}
+
+	return run
 }
 
-// parseCLIFlagsForConfigFilePath parses the command line options
-// to determine the path to the required configuration file.
-func parseCLIFlagsForConfigFilePath() string {
+// parseCLIFlags parses the command line options including the path to the
+// required configuration file.
+func parseCLIFlags() cliOptions {
 	configPart := getopt.StringLong("config", 'c',
 		"/etc/nic-audit.json5",
 		"Path to JSON5 format configuration file")
+	intervalPart := getopt.DurationLong("interval", 'i', 0,
+		"Repeat the audit at this interval (e.g. 15m) instead of exiting")
+	inventoryPart := getopt.StringLong("inventory", 0, "",
+		"Audit the instances in this inventory file instead of CloudAPI")
+	failOnPart := getopt.StringLong("fail-on", 0, defaultFailOn,
+		"Comma delimited conditions that produce a non-zero exit code: "+
+			"partial, violations, remediated")
+	failSeverityPart := getopt.StringLong("fail-severity", 0, "",
+		"Only violations of at least this severity (info, low, medium, "+
+			"high or critical) produce a non-zero exit code")
+
+	getopt.SetParameters("[command ...]")
 
-	getopt.Parse()
+	// Unlike getopt.Parse, which exits with 1, invalid options exit with
+	// the configuration error exit code
+	if parseErr := getopt.Getopt(nil); parseErr != nil {
+		getopt.Usage()
+		configFatalf("%v", parseErr)
+	}
 
 	if len(*configPart) < 1 {
-		log.Fatal("Configuration file must be specified")
+		configFatalf("Configuration file must be specified")
+	}
+
+	failOn, failOnErr := parseFailOn(*failOnPart)
+
+	if failOnErr != nil {
+		configFatalf("%v", failOnErr)
 	}
 
-	return *configPart
+	if severityErr := validateSeverity(*failSeverityPart, "--fail-severity"); severityErr != nil {
+		configFatalf("%v", severityErr)
+	}
+
+	return cliOptions{
+		ConfigFile:   *configPart,
+		Interval:     *intervalPart,
+		FailOn:       failOn,
+		FailSeverity: *failSeverityPart,
+		Inventory:    *inventoryPart,
+	}
 }
@@ -15,3 +15,15 @@ func deleteByValue(m map[string]string, value interface{}) {
 		}
 	}
 }
+
+// toSet converts a list of strings into a map that can be used for
+// membership tests.
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+
+	for _, value := range values {
+		set[value] = true
+	}
+
+	return set
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the metrics exposed by the auditing tool.
+const (
+	metricInstancesScanned    = "nic_audit_instances_scanned"
+	metricViolations          = "nic_audit_violations"
+	metricNICsRemoved         = "nic_audit_nics_removed_total"
+	metricRemediationFailed   = "nic_audit_remediation_failures_total"
+	metricCloudAPIRequests    = "nic_audit_cloudapi_request_duration_seconds"
+	metricCloudAPIErrors      = "nic_audit_cloudapi_errors_total"
+	metricEmailFailures       = "nic_audit_email_send_failures_total"
+	metricLastSuccessfulRun   = "nic_audit_last_successful_run_timestamp_seconds"
+	metricAuditErrors         = "nic_audit_account_errors_total"
+	metricRunDurationSeconds  = "nic_audit_run_duration_seconds"
+	metricCloudAPIRetries     = "nic_audit_cloudapi_retries_total"
+	metricNICsBlocked         = "nic_audit_nics_blocked_total"
+	metricRemediationActions  = "nic_audit_remediation_actions_total"
+	metricRemediationDeferred = "nic_audit_remediation_deferred_total"
+)
+
+// metricDefinitions contains the type and help text of every metric.
+var metricDefinitions = map[string][2]string{
+	metricInstancesScanned:    {"gauge", "Number of instances scanned in the last audit of an account."},
+	metricViolations:          {"gauge", "Number of instances matching a nic group in the last audit of an account."},
+	metricNICsRemoved:         {"counter", "Number of NICs removed by remediation."},
+	metricRemediationFailed:   {"counter", "Number of instances for which remediation failed."},
+	metricCloudAPIRequests:    {"summary", "Latency of CloudAPI requests."},
+	metricCloudAPIErrors:      {"counter", "Number of CloudAPI requests that returned an error."},
+	metricEmailFailures:       {"counter", "Number of alert emails that couldn't be sent."},
+	metricLastSuccessfulRun:   {"gauge", "Unix time of the last successful audit of an account."},
+	metricAuditErrors:         {"counter", "Number of account audits that failed."},
+	metricRunDurationSeconds:  {"gauge", "Duration of the last audit run."},
+	metricCloudAPIRetries:     {"counter", "Number of CloudAPI requests retried after a transient failure."},
+	metricNICsBlocked:         {"counter", "Number of NIC removals blocked by the remediation safety limits."},
+	metricRemediationActions:  {"counter", "Number of remediation actions taken by action and outcome."},
+	metricRemediationDeferred: {"counter", "Number of instances whose remediation was deferred by the rate limits or circuit breaker."},
+}
+
+// auditMetrics collects the metrics for the lifetime of the process.
+var auditMetrics = newMetricsRegistry()
+
+// metricsRegistry is a minimal collection of metrics that can be rendered
+// in the Prometheus text exposition format.
+type metricsRegistry struct {
+	mutex  sync.Mutex
+	values map[string]map[string]float64
+}
+
+// newMetricsRegistry creates an empty metrics registry.
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		values: make(map[string]map[string]float64),
+	}
+}
+
+// metricLabels formats pairs of label names and values as a Prometheus
+// label set.
+func metricLabels(pairs ...string) string {
+	if len(pairs) < 2 {
+		return ""
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labels := make([]string, 0, len(pairs)/2)
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%v="%v"`, pairs[i],
+			escaper.Replace(pairs[i+1])))
+	}
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// accountMetricLabels formats the label set of a series for an account
+// followed by the specified pairs, including the data center of accounts
+// that are audited in several.
+func accountMetricLabels(account Account, pairs ...string) string {
+	labels := []string{"account", account.AccountName}
+
+	if len(account.Datacenter) > 0 {
+		labels = append(labels, "datacenter", account.Datacenter)
+	}
+
+	return metricLabels(append(labels, pairs...)...)
+}
+
+// add increments the specified series by delta.
+func (r *metricsRegistry) add(name string, labels string, delta float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.series(name)[labels] += delta
+}
+
+// set replaces the value of the specified series.
+func (r *metricsRegistry) set(name string, labels string, value float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.series(name)[labels] = value
+}
+
+// observe records a duration in a summary.
+func (r *metricsRegistry) observe(name string, labels string, duration time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.series(name + "_sum")[labels] += duration.Seconds()
+	r.series(name + "_count")[labels]++
+}
+
+// series returns the values of a metric, creating it if necessary. The
+// caller must hold the mutex.
+func (r *metricsRegistry) series(name string) map[string]float64 {
+	values, ok := r.values[name]
+
+	if !ok {
+		values = make(map[string]float64)
+		r.values[name] = values
+	}
+
+	return values
+}
+
+// writeTo renders every metric in the Prometheus text exposition format.
+func (r *metricsRegistry) writeTo(writer io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	names := make([]string, 0, len(metricDefinitions))
+	for name := range metricDefinitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+
+	for _, name := range names {
+		definition := metricDefinitions[name]
+		fmt.Fprintf(&buffer, "# HELP %v %v\n", name, definition[1])
+		fmt.Fprintf(&buffer, "# TYPE %v %v\n", name, definition[0])
+
+		seriesNames := []string{name}
+		if definition[0] == "summary" {
+			seriesNames = []string{name + "_sum", name + "_count"}
+		}
+
+		for _, seriesName := range seriesNames {
+			values := r.values[seriesName]
+			labels := make([]string, 0, len(values))
+
+			for label := range values {
+				labels = append(labels, label)
+			}
+			sort.Strings(labels)
+
+			for _, label := range labels {
+				fmt.Fprintf(&buffer, "%v%v %v\n", seriesName, label, values[label])
+			}
+		}
+	}
+
+	_, writeErr := writer.Write(buffer.Bytes())
+
+	return writeErr
+}
+
+// ServeHTTP exposes the metrics to a Prometheus scraper.
+func (r *metricsRegistry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.writeTo(writer)
+}
+
+// writeTextfile atomically writes the metrics to the specified file so that
+// they can be picked up by the node exporter textfile collector.
+func (r *metricsRegistry) writeTextfile(path string) error {
+	var buffer bytes.Buffer
+
+	if renderErr := r.writeTo(&buffer); renderErr != nil {
+		return renderErr
+	}
+
+	return writeFileAtomically(path, buffer.Bytes(), 0644)
+}
+
+// startMetricsServer serves the /metrics endpoint in the background on the
+// configured listen address.
+func startMetricsServer(config MetricsConfig) {
+	if len(config.ListenAddress) < 1 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", auditMetrics)
+
+	go func() {
+		log.Printf("Serving metrics on http://%v/metrics\n", config.ListenAddress)
+		serveErr := http.ListenAndServe(config.ListenAddress, mux)
+		log.Printf("ERROR: metrics server stopped: %v\n", serveErr)
+	}()
+}
+
+// observeCloudAPI records the latency and outcome of a CloudAPI request
+// that was started at the specified time.
+func observeCloudAPI(operation string, started time.Time, err error) {
+	labels := metricLabels("operation", operation)
+	auditMetrics.observe(metricCloudAPIRequests, labels, time.Since(started))
+
+	if err != nil {
+		auditMetrics.add(metricCloudAPIErrors, labels, 1)
+	}
+}
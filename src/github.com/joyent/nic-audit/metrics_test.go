@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricLabelsEscapesValues(t *testing.T) {
+	labels := metricLabels("account", `some "quoted" \\ user`)
+	expected := `{account="some \"quoted\" \\\\ user"}`
+
+	if labels != expected {
+		t.Errorf("Unexpected labels. Expected: %v Actually: %v", expected, labels)
+	}
+}
+
+func TestMetricsRegistryWritesExpositionFormat(t *testing.T) {
+	registry := newMetricsRegistry()
+	registry.add(metricNICsRemoved, metricLabels("account", "some.user"), 2)
+	registry.add(metricNICsRemoved, metricLabels("account", "some.user"), 1)
+	registry.observe(metricCloudAPIRequests, metricLabels("operation", "ListNICs"),
+		1500*time.Millisecond)
+
+	var buffer bytes.Buffer
+
+	if err := registry.writeTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	output := buffer.String()
+	expectedLines := []string{
+		"# TYPE nic_audit_nics_removed_total counter",
+		`nic_audit_nics_removed_total{account="some.user"} 3`,
+		"# TYPE nic_audit_cloudapi_request_duration_seconds summary",
+		`nic_audit_cloudapi_request_duration_seconds_sum{operation="ListNICs"} 1.5`,
+		`nic_audit_cloudapi_request_duration_seconds_count{operation="ListNICs"} 1`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Expected output to contain [%v]. Actually:\n%v", line, output)
+		}
+	}
+}
+
+func TestMetricsRegistryWritesTextfile(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+
+	registry := newMetricsRegistry()
+	registry.set(metricInstancesScanned, metricLabels("account", "some.user"), 12)
+
+	path := filepath.Join(dir, "nic_audit.prom")
+
+	if err := registry.writeTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, readErr := ioutil.ReadFile(path)
+
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	if !strings.Contains(string(data), `nic_audit_instances_scanned{account="some.user"} 12`) {
+		t.Errorf("Unexpected textfile contents:\n%s", data)
+	}
+}
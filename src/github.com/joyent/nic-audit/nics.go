@@ -9,8 +9,11 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
+	"strings"
+	"time"
 )
 
 import (
@@ -18,81 +21,405 @@ import (
 	"github.com/twinj/uuid"
 )
 
-// removeNICsBasedOnNetworks removes all NICs from the specified instance
-// where the NIC connects to one of the specified networks.
-func removeNICsBasedOnNetworks(networks []string,
-	instance compute.Instance, client compute.ComputeClient,
-	privateNetworkBlocks []string) ([]string, error) {
+// Outcomes of removing a single NIC.
+const (
+	nicRemoved = "removed"
+	nicPending = "pending"
+	nicFailed  = "failed"
+	nicBlocked = "blocked"
+	nicDryRun  = "dry-run"
+	nicPlanned = "planned"
+)
+
+// Defaults for verifying that removed NICs are gone.
+const (
+	defaultVerifyTimeout  = 2 * time.Minute
+	defaultVerifyInterval = 5 * time.Second
+)
+
+// NICRemoval describes the outcome of removing a single NIC. A NIC is only
+// reported as removed once it no longer appears on the instance and Err is
+// set when the removal failed or was blocked by a safety limit.
+type NICRemoval struct {
+	MAC       string
+	Network   string
+	NetworkID string
+	IP        string
+	Primary   bool
+	Outcome   string
+	Err       error
+}
+
+// remediationPolicy is the parsed form of RemediationConfig. It controls
+// which NICs may be removed and how long to wait for removed NICs to
+// disappear from an instance.
+type remediationPolicy struct {
+	verifyTimeout      time.Duration
+	verifyInterval     time.Duration
+	allowPrimary       bool
+	maxNICsPerRun      int
+	maxInstancesPerRun int
+	dryRun             bool
+	requireApproval    bool
+	planMaxAge         time.Duration
+	// Instances remediated per minute across every account and the
+	// percentage of an account's instances in violation that halts its
+	// remediation, where zero disables either
+	remediationRate       float64
+	circuitBreakerPercent float64
+	// Only alerts of at least this severity are remediated
+	minSeverity string
+	// Called for every NIC that CloudAPI accepted the removal of
+	onRemoved func(NICRemoval)
+}
+
+// newRemediationPolicy validates the remediation configuration, using
+// defaults for any settings that aren't set.
+func newRemediationPolicy(config RemediationConfig) (remediationPolicy, error) {
+	policy := remediationPolicy{
+		verifyTimeout:      defaultVerifyTimeout,
+		verifyInterval:     defaultVerifyInterval,
+		allowPrimary:       config.AllowPrimary,
+		maxNICsPerRun:      config.MaxNICsPerRun,
+		maxInstancesPerRun: config.MaxInstancesPerRun,
+		dryRun:             config.DryRun,
+		requireApproval:    config.RequireApproval,
+		planMaxAge:         defaultPlanMaxAge,
+
+		remediationRate:       config.RemediationRate,
+		circuitBreakerPercent: config.CircuitBreakerPercent,
+		minSeverity:           config.MinSeverity,
+	}
+
+	if policy.requireApproval &&
+		(len(config.PlanFile) < 1 || len(config.PlanKeyFile) < 1) {
+		return policy, fmt.Errorf("Remediation requiring approval needs " +
+			"a plan_file and plan_key_file")
+	}
+
+	if len(config.PlanMaxAge) > 0 {
+		maxAge, parseErr := time.ParseDuration(config.PlanMaxAge)
+
+		if parseErr != nil || maxAge <= 0 {
+			return policy, fmt.Errorf("Invalid remediation plan_max_age [%v]",
+				config.PlanMaxAge)
+		}
 
-	listNICsInput := compute.ListNICsInput{
-		InstanceID: instance.ID,
+		policy.planMaxAge = maxAge
 	}
 
-	nics, nicsErr := client.Instances().ListNICs(context.Background(), &listNICsInput)
+	if policy.maxNICsPerRun < 0 || policy.maxInstancesPerRun < 0 ||
+		policy.remediationRate < 0 {
+		return policy, fmt.Errorf("Remediation limits can't be negative")
+	}
+
+	if policy.circuitBreakerPercent < 0 || policy.circuitBreakerPercent > 100 {
+		return policy, fmt.Errorf("Invalid remediation circuit_breaker_percent "+
+			"[%v]", policy.circuitBreakerPercent)
+	}
+
+	if len(config.VerifyTimeout) > 0 {
+		timeout, parseErr := time.ParseDuration(config.VerifyTimeout)
+
+		if parseErr != nil || timeout < 0 {
+			return policy, fmt.Errorf("Invalid remediation verify_timeout [%v]",
+				config.VerifyTimeout)
+		}
+
+		policy.verifyTimeout = timeout
+	}
+
+	if len(config.VerifyInterval) > 0 {
+		interval, parseErr := time.ParseDuration(config.VerifyInterval)
+
+		if parseErr != nil || interval <= 0 {
+			return policy, fmt.Errorf("Invalid remediation verify_interval [%v]",
+				config.VerifyInterval)
+		}
+
+		policy.verifyInterval = interval
+	}
+
+	return policy, nil
+}
+
+// removeNICsBasedOnNetworks removes all NICs from the specified instance
+// where the NIC connects to one of the specified networks and to one of the
+// matched networks of the nic group that triggered the alert, so that only
+// NICs that are part of the violation are removed. It then waits for the
+// NICs to disappear from the instance as described by removeNICs.
+func removeNICsBasedOnNetworks(networks []string, matched []string,
+	instance compute.Instance, client cloudAPI,
+	privateNetworkBlocks []string, policy remediationPolicy,
+	run *AuditRun) ([]NICRemoval, error) {
+
+	nics, nicsErr := client.ListNICs(context.Background(), instance.ID)
 
 	if nicsErr != nil {
 		return nil, nicsErr
 	}
 
-	macs := make([]string, len(nics))
-	networksToRemove := make([]string, len(nics))
-	macCount := 0
+	var removals []NICRemoval
 
 	for _, nic := range nics {
+		if !nicMatchesAnyNetwork(nic, matched, privateNetworkBlocks) {
+			continue
+		}
+
 		for _, network := range networks {
-			if len(network) < 1 {
-				continue
+			if nicMatchesNetwork(nic, network, privateNetworkBlocks) {
+				removals = append(removals, NICRemoval{
+					MAC:       nic.MAC,
+					Network:   network,
+					NetworkID: nic.Network,
+					IP:        nic.IP,
+					Primary:   nic.Primary,
+					Outcome:   nicPending,
+				})
+				break
 			}
+		}
+	}
 
-			// If our "network" is another UUID it is a simple match
-			_, uuidErr := uuid.Parse(network)
-			if uuidErr == nil && nic.Network == network {
-				macs[macCount] = nic.MAC
-				networksToRemove[macCount] = network
-				macCount++
-				continue
+	if len(removals) < 1 {
+		log.Printf("No NICs of instance [%v] that are part of the violation "+
+			"are on the networks to remove %v\n", instance.ID, networks)
+		return nil, nil
+	}
+
+	return removeNICs(instance.ID, nics, removals, client, policy, run)
+}
+
+// removeNICs removes the NICs of the removals from the instance with the
+// specified current NICs and waits for them to disappear. A failure to
+// remove one NIC doesn't prevent the others from being removed; the outcome
+// of every NIC is returned along with an error if any of them failed. NICs
+// that would break the safety limits of the policy are blocked, and the
+// NICs and instances remediated are counted against the limits of the run.
+// When the policy is a dry run, the NICs that would be removed are only
+// reported.
+func removeNICs(instanceID string, nics []*compute.NIC, removals []NICRemoval,
+	client cloudAPI, policy remediationPolicy, run *AuditRun) ([]NICRemoval, error) {
+
+	attempts := guardRemovals(removals, nics, policy, run)
+
+	if policy.dryRun {
+		for i := range removals {
+			if removals[i].Outcome == nicPending {
+				log.Printf("Dry run of removing NIC for network [%v] with MAC "+
+					"[%v] from instance [%v]\n", removals[i].Network,
+					removals[i].MAC, instanceID)
+				removals[i].Outcome = nicDryRun
 			}
+		}
 
-			// If our "network" is a CIDR
-			_, ipNet, ipErr := net.ParseCIDR(network)
-			if ipErr == nil {
-				nicIp := net.ParseIP(nic.IP)
-				if ipNet.Contains(nicIp) {
-					macs[macCount] = nic.MAC
-					networksToRemove[macCount] = network
-					macCount++
-					continue
-				}
+		return removals, nil
+	}
+
+	if attempts > 0 {
+		run.InstancesRemediated++
+		run.NICsRemoved += attempts
+	}
+
+	failures := 0
+
+	for i := range removals {
+		removal := &removals[i]
+
+		if removal.Outcome == nicBlocked {
+			log.Printf("Not removing NIC with MAC [%v] from instance [%v]: %v\n",
+				removal.MAC, instanceID, removal.Err)
+			continue
+		}
+
+		log.Printf("Removing NIC for network [%v] with MAC [%v] from instance [%v]\n",
+			removal.Network, removal.MAC, instanceID)
+		removeErr := client.RemoveNIC(context.Background(), instanceID, removal.MAC)
+
+		if removeErr != nil {
+			log.Printf("Error removing NIC with MAC [%v] from instance [%v]: %v\n",
+				removal.MAC, instanceID, removeErr)
+			removal.Outcome = nicFailed
+			removal.Err = removeErr
+			failures++
+			continue
+		}
+
+		if policy.onRemoved != nil {
+			policy.onRemoved(*removal)
+		}
+	}
+
+	if failures < attempts {
+		waitForNICRemoval(client, instanceID, removals, policy)
+	}
+
+	if failures > 0 {
+		return removals, fmt.Errorf("Unable to remove %v of %v NICs from "+
+			"instance [%v]", failures, len(removals), instanceID)
+	}
+
+	return removals, nil
+}
+
+// guardRemovals blocks the removals that would remove a primary NIC when
+// that isn't allowed, leave the instance without any NICs or exceed the
+// per run limits. The number of removals that may proceed is returned.
+func guardRemovals(removals []NICRemoval, nics []*compute.NIC,
+	policy remediationPolicy, run *AuditRun) int {
+
+	primary := make(map[string]bool, len(nics))
+	for _, nic := range nics {
+		primary[strings.ToLower(nic.MAC)] = nic.Primary
+	}
+
+	block := func(removal *NICRemoval, format string, args ...interface{}) {
+		removal.Outcome = nicBlocked
+		removal.Err = fmt.Errorf(format, args...)
+	}
+
+	instanceLimitReached := policy.maxInstancesPerRun > 0 &&
+		run.InstancesRemediated >= policy.maxInstancesPerRun
+	allowed := 0
+
+	for i := range removals {
+		removal := &removals[i]
+
+		switch {
+		case instanceLimitReached:
+			block(removal, "Limit of %v instances remediated per run reached",
+				policy.maxInstancesPerRun)
+		case !policy.allowPrimary && primary[strings.ToLower(removal.MAC)]:
+			block(removal, "Removing the primary NIC isn't allowed")
+		case allowed+1 >= len(nics):
+			block(removal, "Removing the NIC would leave the instance without any NICs")
+		case policy.maxNICsPerRun > 0 &&
+			run.NICsRemoved+allowed >= policy.maxNICsPerRun:
+			block(removal, "Limit of %v NICs removed per run reached",
+				policy.maxNICsPerRun)
+		default:
+			allowed++
+		}
+	}
+
+	return allowed
+}
+
+// nicMatchesAnyNetwork returns true when the NIC connects to one of the
+// networks.
+func nicMatchesAnyNetwork(nic *compute.NIC, networks []string,
+	privateNetworkBlocks []string) bool {
+
+	for _, network := range networks {
+		if nicMatchesNetwork(nic, network, privateNetworkBlocks) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nicMatchesNetwork returns true when the NIC connects to the network given
+// as a UUID, one or more comma delimited CIDRs or the generalized "public"
+// network.
+func nicMatchesNetwork(nic *compute.NIC, network string,
+	privateNetworkBlocks []string) bool {
+
+	if len(network) < 1 {
+		return false
+	}
+
+	// If our "network" is another UUID it is a simple match
+	_, uuidErr := uuid.Parse(network)
+	if uuidErr == nil && nic.Network == network {
+		return true
+	}
+
+	// If our "network" is a CIDR
+	ipNets, ipErr := parseMultipleCIDRs(network)
+	if ipErr == nil {
+		for _, ipNet := range ipNets {
+			if ipNet.Contains(net.ParseIP(nic.IP)) {
+				return true
 			}
+		}
+	}
+
+	// If our "network" is generalized "public" network
+	return network == "public" &&
+		isPublicIP(net.ParseIP(nic.IP), privateNetworkBlocks)
+}
+
+// waitForNICRemoval polls the NICs of an instance until every pending
+// removal is gone or the verification timeout expires. Removals that are
+// still present when the timeout expires are left pending.
+func waitForNICRemoval(client cloudAPI, instanceID string,
+	removals []NICRemoval, policy remediationPolicy) {
+
+	deadline := time.Now().Add(policy.verifyTimeout)
 
-			// If our "network" is generalized "public" network
-			if network == "public" {
-				nicIp := net.ParseIP(nic.IP)
-				if isPublicIP(nicIp, privateNetworkBlocks) {
-					macs[macCount] = nic.MAC
-					networksToRemove[macCount] = network
-					macCount++
-					continue
+	for {
+		nics, nicsErr := client.ListNICs(context.Background(), instanceID)
+
+		if nicsErr != nil {
+			log.Printf("Unable to verify NIC removal from instance [%v]: %v\n",
+				instanceID, nicsErr)
+		}
+
+		pending := 0
+
+		for i := range removals {
+			removal := &removals[i]
+
+			if removal.Outcome != nicPending || nicsErr != nil {
+				if removal.Outcome == nicPending {
+					pending++
 				}
+				continue
+			}
+
+			if findNIC(nics, removal.MAC) != nil {
+				pending++
+			} else {
+				removal.Outcome = nicRemoved
 			}
 		}
+
+		remaining := deadline.Sub(time.Now())
+
+		if pending == 0 || remaining <= 0 {
+			return
+		}
+
+		if remaining > policy.verifyInterval {
+			remaining = policy.verifyInterval
+		}
+
+		time.Sleep(remaining)
 	}
+}
 
-	for i := 0; i < macCount; i++ {
-		mac := macs[i]
-		network := networksToRemove[i]
-		removeNICInput := compute.RemoveNICInput{
-			InstanceID: instance.ID,
-			MAC:        mac,
+// findNIC returns the NIC with the specified MAC address.
+func findNIC(nics []*compute.NIC, mac string) *compute.NIC {
+	for _, nic := range nics {
+		if strings.EqualFold(nic.MAC, mac) {
+			return nic
 		}
-		log.Printf("Removing NIC for network [%v] with MAC [%v] from instance [%v]\n",
-			mac, network, instance.ID)
-		removeErr := client.Instances().RemoveNIC(context.Background(), &removeNICInput)
+	}
 
-		if removeErr != nil {
-			return nil, removeErr
+	return nil
+}
+
+// networksWithOutcome returns the networks of the removals that ended with
+// the specified outcome.
+func networksWithOutcome(removals []NICRemoval, outcome string) []string {
+	var networks []string
+
+	for _, removal := range removals {
+		if removal.Outcome == outcome {
+			networks = append(networks, removal.Network)
 		}
 	}
 
-	return networksToRemove, nil
+	return networks
 }
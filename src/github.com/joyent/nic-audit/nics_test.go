@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+)
+
+// testGuardNICs returns a primary NIC on a public network, a second public
+// NIC and a private NIC.
+func testGuardNICs() []*compute.NIC {
+	return []*compute.NIC{
+		{MAC: "90:b8:d0:00:00:01", IP: "165.122.33.44", Primary: true},
+		{MAC: "90:b8:d0:00:00:05", IP: "165.122.33.45"},
+		{MAC: "90:b8:d0:00:00:02", IP: "10.2.45.234"},
+	}
+}
+
+// testRemovals creates a pending removal for each of the NICs.
+func testRemovals(nics []*compute.NIC) []NICRemoval {
+	removals := make([]NICRemoval, 0, len(nics))
+
+	for _, nic := range nics {
+		removals = append(removals, NICRemoval{
+			MAC:     nic.MAC,
+			Network: "public",
+			IP:      nic.IP,
+			Outcome: nicPending,
+		})
+	}
+
+	return removals
+}
+
+func outcomes(removals []NICRemoval) []string {
+	var result []string
+
+	for _, removal := range removals {
+		result = append(result, removal.Outcome)
+	}
+
+	return result
+}
+
+func TestGuardRemovalsBlocksPrimaryNIC(t *testing.T) {
+	nics := testGuardNICs()
+	removals := testRemovals(nics[:2])
+
+	allowed := guardRemovals(removals, nics, remediationPolicy{}, &AuditRun{})
+
+	if allowed != 1 || removals[0].Outcome != nicBlocked ||
+		removals[0].Err == nil || removals[1].Outcome != nicPending {
+		t.Errorf("Expected only the primary NIC to be blocked: %v", outcomes(removals))
+	}
+}
+
+func TestGuardRemovalsAllowsPrimaryNICWhenConfigured(t *testing.T) {
+	nics := testGuardNICs()
+	removals := testRemovals(nics[:2])
+	policy := remediationPolicy{allowPrimary: true}
+
+	if allowed := guardRemovals(removals, nics, policy, &AuditRun{}); allowed != 2 {
+		t.Errorf("Expected both NICs to be allowed: %v", outcomes(removals))
+	}
+}
+
+func TestGuardRemovalsNeverLeavesInstanceWithoutNICs(t *testing.T) {
+	nics := testGuardNICs()
+	removals := testRemovals(nics)
+	policy := remediationPolicy{allowPrimary: true}
+
+	allowed := guardRemovals(removals, nics, policy, &AuditRun{})
+
+	if allowed != 2 || removals[2].Outcome != nicBlocked {
+		t.Errorf("Expected the last NIC to be kept: %v", outcomes(removals))
+	}
+}
+
+func TestGuardRemovalsEnforcesNICLimitAcrossRun(t *testing.T) {
+	nics := testGuardNICs()
+	removals := testRemovals(nics[1:])
+	policy := remediationPolicy{maxNICsPerRun: 3}
+	run := &AuditRun{NICsRemoved: 2}
+
+	allowed := guardRemovals(removals, nics, policy, run)
+
+	if allowed != 1 || removals[0].Outcome != nicPending ||
+		removals[1].Outcome != nicBlocked {
+		t.Errorf("Expected a single NIC within the limit: %v", outcomes(removals))
+	}
+}
+
+func TestGuardRemovalsEnforcesInstanceLimitAcrossRun(t *testing.T) {
+	nics := testGuardNICs()
+	removals := testRemovals(nics[1:2])
+	policy := remediationPolicy{maxInstancesPerRun: 1}
+	run := &AuditRun{InstancesRemediated: 1}
+
+	if allowed := guardRemovals(removals, nics, policy, run); allowed != 0 {
+		t.Errorf("Expected the instance limit to block removal: %v",
+			outcomes(removals))
+	}
+}
+
+func TestNewRemediationPolicyRejectsInvalidValues(t *testing.T) {
+	configs := []RemediationConfig{
+		{VerifyTimeout: "soon"},
+		{VerifyInterval: "0s"},
+		{MaxNICsPerRun: -1},
+	}
+
+	for _, config := range configs {
+		if _, err := newRemediationPolicy(config); err == nil {
+			t.Errorf("Expected error for %+v and none was thrown", config)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+)
+
+// defaultPlanMaxAge is the age after which a remediation plan is considered
+// stale and is no longer applied.
+const defaultPlanMaxAge = 24 * time.Hour
+
+// nicStale is the outcome of a planned removal whose violation no longer
+// exists when the plan is applied.
+const nicStale = "stale"
+
+// PlanEntry is a single NIC removal proposed by an audit that must be
+// approved before it is applied.
+type PlanEntry struct {
+	ID           int        `json:"id"`
+	Account      string     `json:"account"`
+	Datacenter   string     `json:"datacenter,omitempty"`
+	TritonURL    string     `json:"triton_url,omitempty"`
+	Instance     string     `json:"instance"`
+	InstanceName string     `json:"instance_name"`
+	NicGroup     string     `json:"nic_group"`
+	MAC          string     `json:"mac"`
+	Network      string     `json:"network"`
+	NetworkID    string     `json:"network_id"`
+	IP           string     `json:"ip"`
+	Approved     bool       `json:"approved"`
+	ApprovedBy   string     `json:"approved_by,omitempty"`
+	ApprovedAt   *time.Time `json:"approved_at,omitempty"`
+}
+
+// remediationPlan is the file written by an audit that requires approval.
+// The signature is an HMAC of the rest of the plan so that a plan that was
+// changed other than by the plan commands is refused.
+type remediationPlan struct {
+	Created   time.Time   `json:"created"`
+	Entries   []PlanEntry `json:"entries"`
+	LastID    int         `json:"last_id"`
+	Signature string      `json:"signature,omitempty"`
+}
+
+// errInvalidPlanSignature is returned when a plan doesn't match its
+// signature.
+var errInvalidPlanSignature = errors.New("Remediation plan signature is " +
+	"invalid; the plan has been modified since it was signed")
+
+// newPlanEntry creates a plan entry for a NIC removal of an alert.
+func newPlanEntry(alert Alert, removal NICRemoval) PlanEntry {
+	return PlanEntry{
+		Account:      alert.Account.AccountName,
+		Datacenter:   alert.Account.Datacenter,
+		TritonURL:    alert.Account.TritonUrl,
+		Instance:     alert.Instance.ID,
+		InstanceName: alert.Instance.Name,
+		NicGroup:     alert.NicGroupName,
+		MAC:          removal.MAC,
+		Network:      removal.Network,
+		NetworkID:    removal.NetworkID,
+		IP:           removal.IP,
+	}
+}
+
+// planEntryKey identifies the NIC removal of a plan entry across audits.
+func planEntryKey(entry PlanEntry) string {
+	return entry.Account + "\x00" + entry.Datacenter + "\x00" +
+		entry.Instance + "\x00" + entry.NicGroup + "\x00" +
+		strings.ToLower(entry.MAC)
+}
+
+// sameRemoval determines if two plan entries for the same NIC propose the
+// same removal, so that an approval of one applies to the other.
+func sameRemoval(a PlanEntry, b PlanEntry) bool {
+	return a.IP == b.IP && a.NetworkID == b.NetworkID
+}
+
+// readPlanKey reads the secret used to sign remediation plans.
+func readPlanKey(path string) ([]byte, error) {
+	key, readErr := ioutil.ReadFile(path)
+
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	key = bytes.TrimSpace(key)
+
+	if len(key) < 1 {
+		return nil, fmt.Errorf("Plan key file [%v] is empty", path)
+	}
+
+	return key, nil
+}
+
+// planSignature returns the HMAC of the plan without its signature.
+func planSignature(plan remediationPlan, key []byte) (string, error) {
+	plan.Signature = ""
+	data, marshalErr := json.Marshal(plan)
+
+	if marshalErr != nil {
+		return "", marshalErr
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyPlan checks that the plan matches its signature.
+func verifyPlan(plan remediationPlan, key []byte) error {
+	expected, signErr := planSignature(plan, key)
+
+	if signErr != nil {
+		return signErr
+	}
+
+	if !hmac.Equal([]byte(expected), []byte(plan.Signature)) {
+		return errInvalidPlanSignature
+	}
+
+	return nil
+}
+
+// writePlan signs the plan and atomically replaces the plan file.
+func writePlan(path string, plan remediationPlan, key []byte) error {
+	signature, signErr := planSignature(plan, key)
+
+	if signErr != nil {
+		return signErr
+	}
+
+	plan.Signature = signature
+	data, marshalErr := json.MarshalIndent(plan, "", "  ")
+
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	return writeFileAtomically(path, append(data, '\n'), 0600)
+}
+
+// readPlan reads the plan file at the specified path.
+func readPlan(path string) (remediationPlan, error) {
+	var plan remediationPlan
+	data, readErr := ioutil.ReadFile(path)
+
+	if readErr != nil {
+		return plan, readErr
+	}
+
+	unmarshalErr := json.Unmarshal(data, &plan)
+
+	return plan, unmarshalErr
+}
+
+// writeRunPlan writes the NIC removals proposed by an audit run to the
+// plan file. Removals that were already in the previous plan keep their ID
+// and approval, removals that are new are numbered after every ID used so
+// far, and removals that weren't proposed again are dropped. The entries of
+// accounts that couldn't be audited by the run are kept as they were.
+func writeRunPlan(config RemediationConfig, run *AuditRun) error {
+	key, keyErr := readPlanKey(config.PlanKeyFile)
+
+	if keyErr != nil {
+		return keyErr
+	}
+
+	previous, readErr := readPlan(config.PlanFile)
+
+	if readErr == nil {
+		readErr = verifyPlan(previous, key)
+	}
+
+	if readErr != nil {
+		if !os.IsNotExist(readErr) {
+			log.Printf("ERROR: replacing remediation plan [%v] without "+
+				"keeping its approvals: %v\n", config.PlanFile, readErr)
+		}
+
+		previous = remediationPlan{}
+	}
+
+	previousEntries := make(map[string]PlanEntry, len(previous.Entries))
+	for _, entry := range previous.Entries {
+		previousEntries[planEntryKey(entry)] = entry
+
+		if entry.ID > previous.LastID {
+			previous.LastID = entry.ID
+		}
+	}
+
+	plan := remediationPlan{
+		Created: run.Started.UTC(),
+		Entries: make([]PlanEntry, 0, len(run.PlannedRemovals)),
+		LastID:  previous.LastID,
+	}
+	approved := 0
+
+	for _, entry := range run.PlannedRemovals {
+		planned, found := previousEntries[planEntryKey(entry)]
+
+		if found {
+			entry.ID = planned.ID
+		} else {
+			plan.LastID++
+			entry.ID = plan.LastID
+		}
+
+		if found && planned.Approved && sameRemoval(planned, entry) {
+			entry.Approved = true
+			entry.ApprovedBy = planned.ApprovedBy
+			entry.ApprovedAt = planned.ApprovedAt
+			approved++
+		}
+
+		plan.Entries = append(plan.Entries, entry)
+	}
+
+	for _, entry := range previous.Entries {
+		if run.wasAudited(entry.Account, entry.Datacenter, entry.TritonURL) {
+			continue
+		}
+
+		if entry.Approved {
+			approved++
+		}
+
+		plan.Entries = append(plan.Entries, entry)
+	}
+
+	log.Printf("Writing %v proposed NIC removal(s), %v of them approved, to "+
+		"plan [%v]\n", len(plan.Entries), approved, config.PlanFile)
+
+	return writePlan(config.PlanFile, plan, key)
+}
+
+// loadVerifiedPlan reads the configured plan and checks its signature.
+func loadVerifiedPlan(config RemediationConfig) (remediationPlan, []byte, error) {
+	if len(config.PlanFile) < 1 || len(config.PlanKeyFile) < 1 {
+		return remediationPlan{}, nil, fmt.Errorf("No remediation plan_file " +
+			"and plan_key_file have been configured")
+	}
+
+	key, keyErr := readPlanKey(config.PlanKeyFile)
+
+	if keyErr != nil {
+		return remediationPlan{}, nil, keyErr
+	}
+
+	plan, readErr := readPlan(config.PlanFile)
+
+	if readErr != nil {
+		return plan, nil, readErr
+	}
+
+	return plan, key, verifyPlan(plan, key)
+}
+
+// approvePlan marks the entries with the specified IDs, or every entry
+// when ids contains "all", as approved and re-signs the plan.
+func approvePlan(config RemediationConfig, ids []string, approver string) error {
+	plan, key, loadErr := loadVerifiedPlan(config)
+
+	if loadErr != nil {
+		return loadErr
+	}
+
+	selected := toSet(ids)
+	now := time.Now().UTC()
+	approved := 0
+
+	for i := range plan.Entries {
+		entry := &plan.Entries[i]
+
+		if !selected["all"] && !selected[fmt.Sprintf("%v", entry.ID)] {
+			continue
+		}
+
+		delete(selected, fmt.Sprintf("%v", entry.ID))
+		entry.Approved = true
+		entry.ApprovedBy = approver
+		entry.ApprovedAt = &now
+		approved++
+	}
+
+	delete(selected, "all")
+
+	if len(selected) > 0 {
+		var unknown []string
+		for id := range selected {
+			unknown = append(unknown, id)
+		}
+
+		return fmt.Errorf("Unknown plan entries: %v", strings.Join(unknown, ", "))
+	}
+
+	log.Printf("Approved %v plan entries\n", approved)
+
+	return writePlan(config.PlanFile, plan, key)
+}
+
+// applyPlan removes the NICs of the approved entries of the plan. A plan
+// with an invalid signature or older than the maximum age is refused, and
+// each entry is only applied if its NIC is still attached and the instance
+// still matches the nic group. The outcome of every approved entry is
+// returned.
+func applyPlan(config Configuration) (map[int]NICRemoval, error) {
+	policy, policyErr := newRemediationPolicy(config.Remediation)
+
+	if policyErr != nil {
+		return nil, policyErr
+	}
+
+	plan, _, loadErr := loadVerifiedPlan(config.Remediation)
+
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	if age := time.Since(plan.Created); age > policy.planMaxAge {
+		return nil, fmt.Errorf("Remediation plan created %v ago is older "+
+			"than %v; run a new audit", age, policy.planMaxAge)
+	}
+
+	// Group the approved entries so that each instance is checked once for
+	// every nic group
+	type planGroup struct {
+		account    string
+		datacenter string
+		tritonURL  string
+		instance   string
+		nicGroup   string
+		entries    []PlanEntry
+	}
+
+	var groups []*planGroup
+	groupsByKey := make(map[string]*planGroup)
+
+	for _, entry := range plan.Entries {
+		if !entry.Approved {
+			continue
+		}
+
+		key := entry.Account + "\x00" + entry.Datacenter + "\x00" +
+			entry.TritonURL + "\x00" + entry.Instance + "\x00" +
+			entry.NicGroup
+		group, ok := groupsByKey[key]
+
+		if !ok {
+			group = &planGroup{
+				account:    entry.Account,
+				datacenter: entry.Datacenter,
+				tritonURL:  entry.TritonURL,
+				instance:   entry.Instance,
+				nicGroup:   entry.NicGroup,
+			}
+			groupsByKey[key] = group
+			groups = append(groups, group)
+		}
+
+		group.entries = append(group.entries, entry)
+	}
+
+	outcomes := make(map[int]NICRemoval)
+	run := &AuditRun{Started: time.Now()}
+	instancesByAccount := make(map[string]map[string]*compute.Instance)
+	clients := make(map[string]cloudAPI)
+	accounts := make(map[string]Account)
+
+	for _, group := range groups {
+		fail := func(outcome string, err error) {
+			for _, entry := range group.entries {
+				outcomes[entry.ID] = NICRemoval{MAC: entry.MAC,
+					Network: entry.Network, NetworkID: entry.NetworkID,
+					IP: entry.IP, Outcome: outcome, Err: err}
+			}
+		}
+
+		accountKey := runAccountKey(group.account, group.datacenter,
+			group.tritonURL)
+		account, accountFound := accounts[accountKey]
+
+		if !accountFound {
+			var accountErr error
+			account, accountErr = findDatacenterAccount(config, group.account,
+				group.datacenter, group.tritonURL)
+
+			if accountErr != nil {
+				fail(nicFailed, accountErr)
+				continue
+			}
+
+			accounts[accountKey] = account
+		}
+
+		client, clientFound := clients[accountKey]
+
+		if !clientFound {
+			newClient, clientErr := newCloudAPI(account.remediationAccount())
+
+			if clientErr != nil {
+				fail(nicFailed, clientErr)
+				continue
+			}
+
+			client = newClient
+			clients[accountKey] = client
+		}
+
+		instances, instancesFound := instancesByAccount[accountKey]
+
+		if !instancesFound {
+			listed, listErr := client.ListInstances(context.Background())
+
+			if listErr != nil {
+				fail(nicFailed, listErr)
+				continue
+			}
+
+			instances = make(map[string]*compute.Instance, len(listed))
+			for _, instance := range listed {
+				instances[instance.ID] = instance
+			}
+
+			instancesByAccount[accountKey] = instances
+		}
+
+		instance, instanceFound := instances[group.instance]
+		networkIds, nicGroupFound := config.NicGroups[group.nicGroup]
+		matching := 0
+
+		if instanceFound && nicGroupFound {
+			var matchErr error
+			matching, matchErr = countMatchingNetworkIds(*instance, networkIds,
+				config.PrivateNetworkBlocks)
+
+			if matchErr != nil {
+				fail(nicFailed, matchErr)
+				continue
+			}
+		}
+
+		if !instanceFound || !nicGroupFound || matching != len(networkIds) {
+			fail(nicStale, fmt.Errorf("Instance [%v] no longer matches nic "+
+				"group [%v]", group.instance, group.nicGroup))
+			continue
+		}
+
+		nics, nicsErr := client.ListNICs(context.Background(), instance.ID)
+
+		if nicsErr != nil {
+			fail(nicFailed, nicsErr)
+			continue
+		}
+
+		var removals []NICRemoval
+		var ids []int
+
+		for _, entry := range group.entries {
+			current := findNIC(nics, entry.MAC)
+
+			if current == nil || current.IP != entry.IP {
+				outcomes[entry.ID] = NICRemoval{MAC: entry.MAC,
+					Network: entry.Network, NetworkID: entry.NetworkID,
+					IP: entry.IP, Outcome: nicStale,
+					Err: fmt.Errorf("NIC is no longer attached to the instance")}
+				continue
+			}
+
+			removals = append(removals, NICRemoval{
+				MAC:       current.MAC,
+				Network:   entry.Network,
+				NetworkID: current.Network,
+				IP:        current.IP,
+				Primary:   current.Primary,
+				Outcome:   nicPending,
+			})
+			ids = append(ids, entry.ID)
+		}
+
+		if len(removals) < 1 {
+			continue
+		}
+
+		alert := Alert{
+			Instance:     *instance,
+			Account:      account,
+			NicGroupName: group.nicGroup,
+			NicGroupIds:  networkIds,
+		}
+		groupPolicy := policy
+		groupPolicy.dryRun = false
+		groupPolicy.onRemoved = func(removal NICRemoval) {
+			journalRemoval(config.Remediation.Journal, alert, removal)
+		}
+
+		removals, _ = removeNICs(instance.ID, nics, removals, client,
+			groupPolicy, run)
+
+		for i, removal := range removals {
+			outcomes[ids[i]] = removal
+		}
+	}
+
+	return outcomes, nil
+}
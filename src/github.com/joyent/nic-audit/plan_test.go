@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+)
+
+const testOffenderID = "4167e82f-2bd8-46c0-ad4b-7899398c8720"
+
+// testPlanConfiguration returns a configuration requiring approval of NIC
+// removals along with a function that removes the plan directory.
+func testPlanConfiguration(t *testing.T) (Configuration, func()) {
+	dir, cleanup := testTempDir(t)
+
+	keyFile := filepath.Join(dir, "plan.key")
+
+	if writeErr := ioutil.WriteFile(keyFile, []byte("secret\n"), 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	config := testAuditConfiguration()
+	config.Remediation = RemediationConfig{
+		RequireApproval: true,
+		PlanFile:        filepath.Join(dir, "plan.json"),
+		PlanKeyFile:     keyFile,
+	}
+	config.Accounts = []Account{{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}}
+
+	return config, cleanup
+}
+
+func TestAuditRequiringApprovalWritesPlanInsteadOfRemoving(t *testing.T) {
+	config, cleanup := testPlanConfiguration(t)
+	defer cleanup()
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	run := runAudit(config)
+
+	if len(fake.removedMACs()) != 0 {
+		t.Errorf("Expected no NICs to be removed: %v", fake.removedMACs())
+	}
+
+	if run.AlertsRemediated != 0 {
+		t.Errorf("Expected no remediated alerts: %+v", run)
+	}
+
+	plan, _, loadErr := loadVerifiedPlan(config.Remediation)
+
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	if len(plan.Entries) != 1 {
+		t.Fatalf("Expected a single plan entry: %+v", plan.Entries)
+	}
+
+	entry := plan.Entries[0]
+
+	if entry.ID != 1 || entry.Instance != testOffenderID ||
+		entry.MAC != "90:b8:d0:00:00:01" || entry.NicGroup != "public-and-intranet" ||
+		entry.Approved {
+		t.Errorf("Unexpected plan entry: %+v", entry)
+	}
+}
+
+func TestApplyPlanOnlyRemovesApprovedNICs(t *testing.T) {
+	config, cleanup := testPlanConfiguration(t)
+	defer cleanup()
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	runAudit(config)
+
+	outcomes, applyErr := applyPlan(config)
+
+	if applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if len(outcomes) != 0 || len(fake.removedMACs()) != 0 {
+		t.Fatalf("Expected unapproved entries to be skipped: %+v", outcomes)
+	}
+
+	if err := approvePlan(config.Remediation, []string{"1"}, "operator"); err != nil {
+		t.Fatal(err)
+	}
+
+	outcomes, applyErr = applyPlan(config)
+
+	if applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if outcomes[1].Outcome != nicRemoved {
+		t.Errorf("Expected the approved NIC to be removed: %+v", outcomes)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 1 || removed[0] != "90:b8:d0:00:00:01" {
+		t.Errorf("Expected the public NIC to be removed: %v", removed)
+	}
+}
+
+func TestAuditRequiringApprovalKeepsApprovalsOfPreviousPlan(t *testing.T) {
+	config, cleanup := testPlanConfiguration(t)
+	defer cleanup()
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	runAudit(config)
+
+	if err := approvePlan(config.Remediation, []string{"1"}, "operator"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new offender appears before the next audit
+	fake.addInstance("0b3c1d96-1d9c-4a4b-9b3e-2a6f1c8d7e55", "new-offender",
+		&compute.NIC{MAC: "90:b8:d0:00:00:05", IP: "165.122.33.45",
+			Network: testPublicNetwork},
+		&compute.NIC{MAC: "90:b8:d0:00:00:06", IP: "10.2.45.236",
+			Network: testIntranetNetwork, Primary: true})
+
+	runAudit(config)
+
+	plan, _, loadErr := loadVerifiedPlan(config.Remediation)
+
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	if len(plan.Entries) != 2 {
+		t.Fatalf("Expected two plan entries: %+v", plan.Entries)
+	}
+
+	for _, entry := range plan.Entries {
+		switch entry.MAC {
+		case "90:b8:d0:00:00:01":
+			if entry.ID != 1 || !entry.Approved || entry.ApprovedBy != "operator" {
+				t.Errorf("Expected the approval to be kept: %+v", entry)
+			}
+		case "90:b8:d0:00:00:05":
+			if entry.ID != 2 || entry.Approved {
+				t.Errorf("Expected a new unapproved entry: %+v", entry)
+			}
+		default:
+			t.Errorf("Unexpected plan entry: %+v", entry)
+		}
+	}
+}
+
+func TestAuditRequiringApprovalKeepsPlanOfAccountsThatFailed(t *testing.T) {
+	config, cleanup := testPlanConfiguration(t)
+	defer cleanup()
+
+	restoreFake := useFakeCloudAPI(newTestFakeCloudAPI())
+	runAudit(config)
+	restoreFake()
+
+	if err := approvePlan(config.Remediation, []string{"1"}, "operator"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer useCloudAPIFactory(func(account Account) (cloudAPI, error) {
+		return nil, errors.New("unable to read private key")
+	})()
+
+	if run := runAudit(config); run.AccountsFailed != 1 {
+		t.Fatalf("Expected the account to fail: %+v", run)
+	}
+
+	plan, _, loadErr := loadVerifiedPlan(config.Remediation)
+
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	if len(plan.Entries) != 1 || plan.Entries[0].ID != 1 || !plan.Entries[0].Approved {
+		t.Errorf("Expected the approved entry to be kept: %+v", plan.Entries)
+	}
+}
+
+func TestApplyPlanSkipsViolationsThatNoLongerExist(t *testing.T) {
+	config, cleanup := testPlanConfiguration(t)
+	defer cleanup()
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	runAudit(config)
+
+	if err := approvePlan(config.Remediation, []string{"all"}, "operator"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner fixes the violation by removing the intranet NIC
+	fake.RemoveNIC(context.Background(), testOffenderID, "90:b8:d0:00:00:02")
+
+	outcomes, applyErr := applyPlan(config)
+
+	if applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if outcomes[1].Outcome != nicStale {
+		t.Errorf("Expected the entry to be stale: %+v", outcomes)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 1 {
+		t.Errorf("Expected the public NIC to be kept: %v", removed)
+	}
+}
+
+func TestApplyPlanRefusesModifiedPlan(t *testing.T) {
+	config, cleanup := testPlanConfiguration(t)
+	defer cleanup()
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	runAudit(config)
+
+	if err := approvePlan(config.Remediation, []string{"all"}, "operator"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(config.Remediation.PlanFile)
+	data = []byte(strings.Replace(string(data), "90:b8:d0:00:00:01",
+		"90:b8:d0:00:00:02", 1))
+	ioutil.WriteFile(config.Remediation.PlanFile, data, 0600)
+
+	if _, err := applyPlan(config); err != errInvalidPlanSignature {
+		t.Errorf("Expected the modified plan to be refused. Actually: %v", err)
+	}
+
+	if len(fake.removedMACs()) != 0 {
+		t.Errorf("Expected no NICs to be removed: %v", fake.removedMACs())
+	}
+}
+
+func TestApplyPlanRefusesStalePlan(t *testing.T) {
+	config, cleanup := testPlanConfiguration(t)
+	defer cleanup()
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config.Remediation.PlanMaxAge = "1ms"
+	runAudit(config)
+
+	if err := approvePlan(config.Remediation, []string{"all"}, "operator"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := applyPlan(config); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
+
+func TestApprovePlanRejectsUnknownEntries(t *testing.T) {
+	config, cleanup := testPlanConfiguration(t)
+	defer cleanup()
+
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	runAudit(config)
+
+	if err := approvePlan(config.Remediation, []string{"7"}, "operator"); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Causes of a deferred remediation.
+const (
+	deferCircuitBreaker = "circuit_breaker"
+	deferAccountLimit   = "account_limit"
+)
+
+// DeferredRemediation describes an instance whose remediation was skipped by
+// this run because of the remediation rate limits or circuit breaker.
+type DeferredRemediation struct {
+	Account      string
+	Datacenter   string
+	Instance     string
+	InstanceName string
+	NicGroup     string
+	Cause        string
+	Reason       string
+}
+
+// remediationLimiter paces the remediation of instances so that no more
+// than the global and per account rates are remediated per minute, and
+// caps the number of instances remediated per account in a single run.
+type remediationLimiter struct {
+	globalInterval time.Duration
+	lastGlobal     time.Time
+	lastAccount    map[string]time.Time
+	accountCounts  map[string]int
+	now            func() time.Time
+	sleep          func(time.Duration)
+}
+
+// newRemediationLimiter creates a limiter for the global rate of the
+// remediation policy.
+func newRemediationLimiter(policy remediationPolicy) *remediationLimiter {
+	return &remediationLimiter{
+		globalInterval: rateInterval(policy.remediationRate),
+		lastAccount:    make(map[string]time.Time),
+		accountCounts:  make(map[string]int),
+		now:            time.Now,
+		sleep:          time.Sleep,
+	}
+}
+
+// rateInterval converts a rate per minute to the interval between two
+// remediations, where a zero rate is unlimited.
+func rateInterval(perMinute float64) time.Duration {
+	if perMinute <= 0 {
+		return 0
+	}
+
+	return time.Duration(float64(time.Minute) / perMinute)
+}
+
+// deferral returns the reason that remediation of an instance of the
+// account is deferred, or an empty string when it can go ahead.
+func (l *remediationLimiter) deferral(account Account) string {
+	limit := account.MaxRemediatedInstancesPerRun
+
+	if limit > 0 && l.accountCounts[account.AccountName] >= limit {
+		return fmt.Sprintf("Limit of %v instances remediated per run for "+
+			"account [%v] reached", limit, account.AccountName)
+	}
+
+	return ""
+}
+
+// wait blocks until remediating another instance of the account doesn't
+// exceed the global or account rate.
+func (l *remediationLimiter) wait(account Account) {
+	next := l.lastGlobal.Add(l.globalInterval)
+
+	if last, ok := l.lastAccount[account.AccountName]; ok {
+		accountNext := last.Add(rateInterval(account.RemediationRate))
+
+		if accountNext.After(next) {
+			next = accountNext
+		}
+	}
+
+	if delay := next.Sub(l.now()); delay > 0 {
+		log.Printf("Waiting %v before remediating the next instance of "+
+			"account [%v]\n", delay, account.AccountName)
+		l.sleep(delay)
+	}
+}
+
+// record counts an instance of the account as remediated. Only
+// remediations that changed the instance are recorded.
+func (l *remediationLimiter) record(account Account) {
+	now := l.now()
+	l.lastGlobal = now
+	l.lastAccount[account.AccountName] = now
+	l.accountCounts[account.AccountName]++
+}
+
+// circuitBreakerReason returns the reason that remediation of an account is
+// halted when more than the policy's percentage of its instances are in
+// violation, or an empty string when the circuit breaker isn't tripped.
+func circuitBreakerReason(alerts list.List, instanceCount int,
+	policy remediationPolicy) string {
+
+	if policy.circuitBreakerPercent <= 0 || instanceCount < 1 {
+		return ""
+	}
+
+	violating := make(map[string]bool)
+	for e := alerts.Front(); e != nil; e = e.Next() {
+		violating[e.Value.(Alert).Instance.ID] = true
+	}
+
+	percent := float64(len(violating)) * 100 / float64(instanceCount)
+
+	if percent <= policy.circuitBreakerPercent {
+		return ""
+	}
+
+	return fmt.Sprintf("Circuit breaker tripped: %v of %v instances (%.1f%%) "+
+		"are in violation, more than %v%%", len(violating), instanceCount,
+		percent, policy.circuitBreakerPercent)
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+)
+
+func TestRemediationLimiterPacesGlobalAndAccountRates(t *testing.T) {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	var slept []time.Duration
+
+	limiter := newRemediationLimiter(remediationPolicy{remediationRate: 60})
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(delay time.Duration) { slept = append(slept, delay) }
+
+	account := Account{AccountName: "some.user", RemediationRate: 6}
+	other := Account{AccountName: "other.user"}
+
+	limiter.wait(account)
+	limiter.record(account)
+	limiter.wait(other)
+	limiter.wait(account)
+
+	if len(slept) != 2 || slept[0] != time.Second || slept[1] != 10*time.Second {
+		t.Errorf("Expected waits of 1s and 10s. Actually: %v", slept)
+	}
+}
+
+func TestRemediationLimiterDefersAfterAccountLimit(t *testing.T) {
+	limiter := newRemediationLimiter(remediationPolicy{})
+	account := Account{AccountName: "some.user", MaxRemediatedInstancesPerRun: 1}
+
+	if reason := limiter.deferral(account); len(reason) > 0 {
+		t.Fatalf("Expected the first instance to be allowed: %v", reason)
+	}
+
+	limiter.record(account)
+
+	if reason := limiter.deferral(account); len(reason) < 1 {
+		t.Error("Expected the second instance to be deferred")
+	}
+}
+
+func TestAuditDefersRemediationBeyondAccountLimit(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	fake.addInstance("b5b5bbf4-6a2a-4a8f-a0a2-0c9e0f3a7a31", "second-offender",
+		&compute.NIC{MAC: "90:b8:d0:00:00:05", IP: "165.122.33.45",
+			Network: testPublicNetwork},
+		&compute.NIC{MAC: "90:b8:d0:00:00:06", IP: "10.2.45.236",
+			Network: testIntranetNetwork, Primary: true})
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	account := Account{
+		AccountName:                  "some.user",
+		NetworksToRemove:             []string{"public"},
+		MaxRemediatedInstancesPerRun: 1,
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 1 {
+		t.Errorf("Expected a single NIC to be removed: %v", removed)
+	}
+
+	if len(run.DeferredRemediations) != 1 ||
+		run.DeferredRemediations[0].Cause != deferAccountLimit ||
+		run.DeferredRemediations[0].InstanceName != "second-offender" {
+		t.Errorf("Expected the second instance to be deferred: %+v",
+			run.DeferredRemediations)
+	}
+
+	if len(sink.remediations) != 2 || len(sink.remediations[1].Deferred) < 1 {
+		t.Errorf("Expected the deferral to be reported: %+v", sink.remediations)
+	}
+}
+
+func TestAuditAccountLimitOnlyCountsChangedInstances(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	fake.addInstance("b5b5bbf4-6a2a-4a8f-a0a2-0c9e0f3a7a31", "second-offender",
+		&compute.NIC{MAC: "90:b8:d0:00:00:05", IP: "165.122.33.45",
+			Network: testPublicNetwork},
+		&compute.NIC{MAC: "90:b8:d0:00:00:06", IP: "10.2.45.236",
+			Network: testIntranetNetwork, Primary: true})
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.Remediation.DryRun = true
+	account := Account{
+		AccountName:                  "some.user",
+		NetworksToRemove:             []string{"public"},
+		MaxRemediatedInstancesPerRun: 1,
+	}
+	run := &AuditRun{}
+
+	if err := auditAccount(account, config.NicGroups, config, run,
+		&recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(run.DeferredRemediations) != 0 {
+		t.Errorf("Expected dry runs not to count towards the limit: %+v",
+			run.DeferredRemediations)
+	}
+}
+
+func TestAuditCircuitBreakerHaltsRemediation(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.Remediation.CircuitBreakerPercent = 40
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}
+	run := &AuditRun{}
+
+	if err := auditAccount(account, config.NicGroups, config, run,
+		&recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 0 {
+		t.Errorf("Expected no NICs to be removed: %v", removed)
+	}
+
+	if len(run.DeferredRemediations) != 1 ||
+		run.DeferredRemediations[0].Cause != deferCircuitBreaker {
+		t.Errorf("Expected remediation to be deferred by the circuit "+
+			"breaker: %+v", run.DeferredRemediations)
+	}
+}
+
+func TestAuditCircuitBreakerAllowsRemediationBelowThreshold(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.Remediation.CircuitBreakerPercent = 50
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}
+	run := &AuditRun{}
+
+	if err := auditAccount(account, config.NicGroups, config, run,
+		&recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 1 {
+		t.Errorf("Expected the public NIC to be removed: %v", removed)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// validateRBAC checks the RBAC sub-user and roles used to authenticate as
+// the account.
+func validateRBAC(account Account) error {
+	if strings.Contains(account.User, "/") {
+		return fmt.Errorf("Invalid user [%v] for account [%v]", account.User,
+			account.AccountName)
+	}
+
+	if len(account.Roles) > 0 && len(account.User) < 1 {
+		return fmt.Errorf("Roles of account [%v] can only be assumed by a "+
+			"user", account.AccountName)
+	}
+
+	for _, role := range account.Roles {
+		if len(role) < 1 || strings.Contains(role, ",") {
+			return fmt.Errorf("Invalid role [%v] for account [%v]", role,
+				account.AccountName)
+		}
+	}
+
+	return nil
+}
+
+// roleTransport asks CloudAPI to authorize every request using the
+// specified roles of the sub-user with the as-role query parameter, which
+// the triton-go clients don't support.
+type roleTransport struct {
+	next  http.RoundTripper
+	roles string
+}
+
+// newRoleTransport wraps the transport of a triton-go client so that its
+// requests assume the roles, or returns the transport as it is when there
+// are no roles.
+func newRoleTransport(next http.RoundTripper, roles []string) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	if len(roles) < 1 {
+		return next
+	}
+
+	return &roleTransport{
+		next:  next,
+		roles: strings.Join(roles, ","),
+	}
+}
+
+func (r *roleTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	withRoles := new(http.Request)
+	*withRoles = *request
+
+	url := *request.URL
+	query := url.Query()
+	query.Set("as-role", r.roles)
+	url.RawQuery = query.Encode()
+	withRoles.URL = &url
+
+	return r.next.RoundTrip(withRoles)
+}
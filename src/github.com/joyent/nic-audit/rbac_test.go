@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateRBACRequiresUserForRoles(t *testing.T) {
+	account := Account{AccountName: "some.user", Roles: []string{"audit"}}
+
+	if err := validateRBAC(account); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+
+	account.User = "auditor"
+
+	if err := validateRBAC(account); err != nil {
+		t.Error(err)
+	}
+
+	account.Roles = []string{"audit,remediate"}
+
+	if err := validateRBAC(account); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
+
+func TestRoleTransportAssumesRoles(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter,
+		request *http.Request) {
+		query = request.URL.RawQuery
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: newRoleTransport(nil, []string{"audit", "network-admin"}),
+	}
+	response, err := client.Get(server.URL + "/some.user/machines?limit=10")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if query != "as-role=audit%2Cnetwork-admin&limit=10" {
+		t.Errorf("Unexpected query: %v", query)
+	}
+}
@@ -0,0 +1,306 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// Types of remediation actions.
+const (
+	actionRemoveNICs     = "remove_nics"
+	actionStopInstance   = "stop_instance"
+	actionEnableFirewall = "enable_firewall"
+	actionAddTags        = "add_tags"
+	actionSetMetadata    = "set_metadata"
+)
+
+// Outcomes of a remediation action.
+const (
+	actionDone    = "done"
+	actionDryRun  = "dry-run"
+	actionFailed  = "failed"
+	actionPlanned = "planned"
+	// remove_nics found no NIC of the violation on the networks to remove
+	actionNoMatch = "no-match"
+	// Every NIC remove_nics would remove was blocked by a safety limit
+	actionBlocked = "blocked"
+)
+
+// defaultQuarantineTag is the tag added by an add_tags action that doesn't
+// list any tags. Its value is the name of the matched nic group.
+const defaultQuarantineTag = "nic_audit_quarantine"
+
+// RemediationAction describes a single action taken against an instance
+// that matched a nic group.
+type RemediationAction struct {
+	Type string `json:"type"`
+	// Tags added by add_tags and metadata set by set_metadata
+	Tags     map[string]string `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+	// Report what the action would do without changing the instance
+	DryRun bool `json:"dry_run"`
+}
+
+// ActionResult describes the outcome of a single remediation action.
+type ActionResult struct {
+	Action  string
+	Outcome string
+	Err     error
+}
+
+// remediationActions returns the actions to take against the instance of
+// an alert. Without configured actions, the NICs are removed when there are
+// networks to remove for the nic group that was matched.
+func (a Account) remediationActions(alert Alert) []RemediationAction {
+	nicGroup := alert.NicGroupName
+
+	if actions, ok := a.RemediationActions[nicGroup]; ok {
+		return actions
+	}
+
+	if len(alert.RuleType) > 0 {
+		return nil
+	}
+
+	if len(a.networksToRemove(nicGroup)) > 0 {
+		return []RemediationAction{{Type: actionRemoveNICs}}
+	}
+
+	return nil
+}
+
+// validateRemediationActions checks the remediation actions configured for
+// every nic group and network rule of an account and for the firewall audit.
+// NICs can't be removed for a network rule since it may be violated by a
+// missing NIC, nor for the firewall audit.
+func validateRemediationActions(account Account, nicGroups map[string][]string,
+	rules map[string]NetworkRule, requireApproval bool) error {
+
+	for nicGroup, actions := range account.RemediationActions {
+		_, isRule := rules[nicGroup]
+		isRule = isRule || nicGroup == firewallAlertGroup
+
+		if _, ok := nicGroups[nicGroup]; !ok && !isRule {
+			return fmt.Errorf("Unknown nic group [%v] in the remediation "+
+				"actions for account [%v]", nicGroup, account.AccountName)
+		}
+
+		for _, action := range actions {
+			// Only NIC removals can be planned for approval
+			if requireApproval && action.Type != actionRemoveNICs && !action.DryRun {
+				return fmt.Errorf("Remediation action [%v] for nic group [%v] "+
+					"of account [%v] can't be planned for approval; make it a "+
+					"dry run or disable require_approval", action.Type,
+					nicGroup, account.AccountName)
+			}
+
+			switch action.Type {
+			case actionRemoveNICs:
+				if isRule {
+					return fmt.Errorf("NICs can't be removed for network rule "+
+						"[%v] of account [%v]", nicGroup, account.AccountName)
+				}
+
+				if len(account.networksToRemove(nicGroup)) < 1 {
+					return fmt.Errorf("No networks to remove for nic group [%v] "+
+						"of account [%v]", nicGroup, account.AccountName)
+				}
+			case actionSetMetadata:
+				if len(action.Metadata) < 1 {
+					return fmt.Errorf("No metadata to set for nic group [%v] "+
+						"of account [%v]", nicGroup, account.AccountName)
+				}
+			case actionStopInstance, actionEnableFirewall, actionAddTags:
+			default:
+				return fmt.Errorf("Unknown remediation action [%v] for nic "+
+					"group [%v] of account [%v]", action.Type, nicGroup,
+					account.AccountName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// remediateAlert takes each of the actions against the instance of the
+// alert. A failed action doesn't prevent the following actions from being
+// taken; the first error is returned in the result.
+func remediateAlert(alert Alert, actions []RemediationAction, client cloudAPI,
+	config Configuration, policy remediationPolicy, run *AuditRun) RemediationResult {
+
+	var result RemediationResult
+
+	for _, action := range actions {
+		actionPolicy := policy
+		actionPolicy.dryRun = policy.dryRun || action.DryRun
+		actionPolicy.onRemoved = func(removal NICRemoval) {
+			journalRemoval(config.Remediation.Journal, alert, removal)
+		}
+		var actionErr error
+
+		planned := false
+		noMatch := false
+		var blockedErr error
+
+		if action.Type == actionRemoveNICs {
+			// Removals requiring approval are planned like a dry run
+			planned = policy.requireApproval && !actionPolicy.dryRun
+			actionPolicy.dryRun = actionPolicy.dryRun || planned
+			removals, removeErr := removeNICsBasedOnNetworks(
+				alert.Account.networksToRemove(alert.NicGroupName),
+				alert.NicGroupIds, alert.Instance, client,
+				config.PrivateNetworkBlocks, actionPolicy, run)
+
+			for i := range removals {
+				if planned && removals[i].Outcome == nicDryRun {
+					removals[i].Outcome = nicPlanned
+					run.PlannedRemovals = append(run.PlannedRemovals,
+						newPlanEntry(alert, removals[i]))
+				}
+			}
+
+			result.NICs = append(result.NICs, removals...)
+			actionErr = removeErr
+			noMatch = removeErr == nil && len(removals) < 1
+
+			if len(removals) > 0 && len(networksWithOutcome(removals,
+				nicBlocked)) == len(removals) {
+				blockedErr = removals[0].Err
+			}
+		} else if actionPolicy.dryRun {
+			log.Printf("Dry run of action [%v] on instance [%v]\n",
+				action.Type, alert.Instance.ID)
+		} else {
+			log.Printf("Taking action [%v] on instance [%v]\n",
+				action.Type, alert.Instance.ID)
+			actionErr = performInstanceAction(action, alert, client)
+		}
+
+		actionResult := ActionResult{Action: action.Type, Outcome: actionDone}
+
+		switch {
+		case actionErr != nil:
+			log.Printf("Error taking action [%v] on instance [%v]: %v\n",
+				action.Type, alert.Instance.ID, actionErr)
+			actionResult.Outcome = actionFailed
+			actionResult.Err = actionErr
+
+			if result.Err == nil {
+				result.Err = actionErr
+			}
+		case noMatch:
+			actionResult.Outcome = actionNoMatch
+		case blockedErr != nil:
+			actionResult.Outcome = actionBlocked
+			actionResult.Err = blockedErr
+		case planned:
+			actionResult.Outcome = actionPlanned
+		case actionPolicy.dryRun:
+			actionResult.Outcome = actionDryRun
+		}
+
+		result.Actions = append(result.Actions, actionResult)
+		auditMetrics.add(metricRemediationActions, accountMetricLabels(
+			alert.Account, "action", action.Type,
+			"outcome", actionResult.Outcome), 1)
+	}
+
+	result.NetworksRemoved = networksWithOutcome(result.NICs, nicRemoved)
+
+	return result
+}
+
+// takesEffect returns true when any of the actions changes the instance
+// rather than being a dry run or a removal planned for approval.
+func takesEffect(actions []RemediationAction, policy remediationPolicy) bool {
+	if policy.dryRun {
+		return false
+	}
+
+	for _, action := range actions {
+		planned := action.Type == actionRemoveNICs && policy.requireApproval
+
+		if !action.DryRun && !planned {
+			return true
+		}
+	}
+
+	return false
+}
+
+// performInstanceAction takes an action other than NIC removal against the
+// instance of the alert.
+func performInstanceAction(action RemediationAction, alert Alert, client cloudAPI) error {
+	ctx := context.Background()
+	instanceID := alert.Instance.ID
+
+	switch action.Type {
+	case actionStopInstance:
+		return client.StopInstance(ctx, instanceID)
+	case actionEnableFirewall:
+		return client.EnableFirewall(ctx, instanceID)
+	case actionAddTags:
+		tags := action.Tags
+
+		if len(tags) < 1 {
+			tags = map[string]string{defaultQuarantineTag: alert.NicGroupName}
+		}
+
+		return client.AddTags(ctx, instanceID, tags)
+	case actionSetMetadata:
+		return client.UpdateMetadata(ctx, instanceID, action.Metadata)
+	}
+
+	return fmt.Errorf("Unknown remediation action [%v]", action.Type)
+}
+
+// isDryRun returns true when any of the actions of the result were only
+// reported or planned instead of taken.
+func (r RemediationResult) isDryRun() bool {
+	for _, action := range r.Actions {
+		if action.Outcome == actionDryRun || action.Outcome == actionPlanned {
+			return true
+		}
+	}
+
+	return false
+}
+
+// changedInstance returns true when the remediation removed a NIC or took
+// an action against the instance, as opposed to dry runs, planned
+// removals and removals that were blocked, failed or had nothing to remove.
+func (r RemediationResult) changedInstance() bool {
+	for _, nic := range r.NICs {
+		if nic.Outcome == nicRemoved || nic.Outcome == nicPending {
+			return true
+		}
+	}
+
+	for _, action := range r.Actions {
+		if action.Action != actionRemoveNICs && action.Outcome == actionDone {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removedNothing returns true when a remove_nics action of the result found
+// no NIC to remove, so the violation wasn't remediated.
+func (r RemediationResult) removedNothing() bool {
+	for _, action := range r.Actions {
+		if action.Outcome == actionNoMatch {
+			return true
+		}
+	}
+
+	return false
+}
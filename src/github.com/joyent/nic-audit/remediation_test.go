@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestAuditAccountTakesConfiguredRemediationActions(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	account := Account{
+		AccountName: "some.user",
+		RemediationActions: map[string][]RemediationAction{
+			"public-and-intranet": {
+				{Type: actionEnableFirewall},
+				{Type: actionAddTags},
+				{Type: actionSetMetadata, Metadata: map[string]string{
+					"quarantined": "true",
+				}},
+				{Type: actionStopInstance},
+			},
+		},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"EnableFirewall", "AddTags", "UpdateMetadata", "StopInstance"}
+
+	if actions := fake.performedActions(); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("Expected actions %v. Actually: %v", expected, actions)
+	}
+
+	if len(fake.removedMACs()) != 0 {
+		t.Errorf("Expected no NICs to be removed: %v", fake.removedMACs())
+	}
+
+	instances, _ := fake.ListInstances(context.Background())
+	offender := instances[0]
+
+	if !offender.FirewallEnabled || offender.State != "stopped" ||
+		offender.Tags[defaultQuarantineTag] != "public-and-intranet" ||
+		offender.Metadata["quarantined"] != "true" {
+		t.Errorf("Unexpected instance after remediation: %+v", offender)
+	}
+
+	if len(sink.remediations) != 1 || len(sink.remediations[0].Actions) != 4 {
+		t.Fatalf("Expected the actions to be recorded: %+v", sink.remediations)
+	}
+
+	for _, action := range sink.remediations[0].Actions {
+		if action.Outcome != actionDone {
+			t.Errorf("Expected action to be done: %+v", action)
+		}
+	}
+
+	if run.AlertsRemediated != 1 {
+		t.Errorf("Expected a remediated alert. Actually: %v", run.AlertsRemediated)
+	}
+}
+
+func TestAuditAccountDryRunDoesNotChangeInstances(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.Remediation.DryRun = true
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+		RemediationActions: map[string][]RemediationAction{
+			"public-and-intranet": {
+				{Type: actionRemoveNICs},
+				{Type: actionStopInstance},
+			},
+		},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.removedMACs()) != 0 || len(fake.performedActions()) != 0 {
+		t.Errorf("Expected no changes. Removed: %v Actions: %v",
+			fake.removedMACs(), fake.performedActions())
+	}
+
+	if len(sink.remediations) != 1 {
+		t.Fatalf("Expected a remediation: %+v", sink.remediations)
+	}
+
+	result := sink.remediations[0]
+
+	if len(result.NICs) != 1 || result.NICs[0].Outcome != nicDryRun {
+		t.Errorf("Expected the NIC removal to be a dry run: %+v", result.NICs)
+	}
+
+	for _, action := range result.Actions {
+		if action.Outcome != actionDryRun {
+			t.Errorf("Expected action to be a dry run: %+v", action)
+		}
+	}
+
+	if run.AlertsRemediated != 0 || run.NICsRemoved != 0 {
+		t.Errorf("Expected nothing to be remediated: %+v", run)
+	}
+}
+
+func TestRemediationActionsDefaultToNICRemoval(t *testing.T) {
+	account := Account{NetworksToRemove: []string{"public"}}
+
+	actions := account.remediationActions(Alert{NicGroupName: "public-and-intranet"})
+
+	if len(actions) != 1 || actions[0].Type != actionRemoveNICs {
+		t.Errorf("Expected NIC removal. Actually: %+v", actions)
+	}
+
+	if actions := (Account{}).remediationActions(Alert{NicGroupName: "public-and-intranet"}); len(actions) != 0 {
+		t.Errorf("Expected no actions without networks. Actually: %+v", actions)
+	}
+}
+
+func TestValidateRemediationActionsRejectsInvalidActions(t *testing.T) {
+	nicGroups := testAuditConfiguration().NicGroups
+	accounts := []Account{
+		{RemediationActions: map[string][]RemediationAction{
+			"public-and-intranet": {{Type: "reboot"}},
+		}},
+		{RemediationActions: map[string][]RemediationAction{
+			"unknown-group": {{Type: actionStopInstance}},
+		}},
+		{RemediationActions: map[string][]RemediationAction{
+			"public-and-intranet": {{Type: actionRemoveNICs}},
+		}},
+		{RemediationActions: map[string][]RemediationAction{
+			"public-and-intranet": {{Type: actionSetMetadata}},
+		}},
+	}
+
+	for _, account := range accounts {
+		if err := validateRemediationActions(account, nicGroups, nil, false); err == nil {
+			t.Errorf("Expected error for %+v and none was thrown",
+				account.RemediationActions)
+		}
+	}
+}
+
+func TestValidateRemediationActionsRejectsUnplannableActions(t *testing.T) {
+	nicGroups := testAuditConfiguration().NicGroups
+	account := Account{
+		NetworksToRemove: []string{"public"},
+		RemediationActions: map[string][]RemediationAction{
+			"public-and-intranet": {
+				{Type: actionRemoveNICs},
+				{Type: actionStopInstance},
+			},
+		},
+	}
+
+	if err := validateRemediationActions(account, nicGroups, nil, false); err != nil {
+		t.Error(err)
+	}
+
+	if err := validateRemediationActions(account, nicGroups, nil, true); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+
+	account.RemediationActions["public-and-intranet"][1].DryRun = true
+
+	if err := validateRemediationActions(account, nicGroups, nil, true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTakesEffect(t *testing.T) {
+	removeNICs := []RemediationAction{{Type: actionRemoveNICs}}
+	stopInstance := []RemediationAction{{Type: actionStopInstance}}
+
+	if !takesEffect(removeNICs, remediationPolicy{}) {
+		t.Error("Expected NIC removal to take effect")
+	}
+
+	if takesEffect(removeNICs, remediationPolicy{requireApproval: true}) {
+		t.Error("Expected planned NIC removal not to take effect")
+	}
+
+	if !takesEffect(stopInstance, remediationPolicy{requireApproval: true}) {
+		t.Error("Expected stopping the instance to take effect")
+	}
+
+	if takesEffect(stopInstance, remediationPolicy{dryRun: true}) {
+		t.Error("Expected a dry run not to take effect")
+	}
+
+	if takesEffect([]RemediationAction{{Type: actionStopInstance, DryRun: true}},
+		remediationPolicy{}) {
+		t.Error("Expected a dry run action not to take effect")
+	}
+}
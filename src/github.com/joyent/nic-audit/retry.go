@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for retrying CloudAPI requests.
+const (
+	defaultRetryMaxAttempts    = 4
+	defaultRetryInitialBackoff = time.Second
+	defaultRetryMaxBackoff     = 30 * time.Second
+	defaultRetryJitter         = 0.2
+
+	// Requests are signed with the time they were created, so waiting
+	// longer than this, whether asked to by the server or configured as the
+	// max_backoff, would get the retried request rejected.
+	maxRetryAfter = 2 * time.Minute
+)
+
+// defaultRetryableStatusCodes are the HTTP statuses returned by CloudAPI
+// for transient conditions.
+var defaultRetryableStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryConfig contains the configuration of the retry policy applied to
+// every CloudAPI request.
+type RetryConfig struct {
+	MaxAttempts int `json:"max_attempts"`
+	// Delay before the first retry (e.g. "1s"), doubled on every attempt
+	// up to max_backoff
+	InitialBackoff string `json:"initial_backoff"`
+	MaxBackoff     string `json:"max_backoff"`
+	// Fraction of the delay (0 to 1) that is randomly subtracted from it
+	Jitter               *float64 `json:"jitter"`
+	RetryableStatusCodes []int    `json:"retryable_status_codes"`
+}
+
+// retryPolicy is the parsed form of RetryConfig.
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	retryable      map[int]bool
+}
+
+// cloudAPIRetryPolicy is the policy used by the CloudAPI clients. It is
+// replaced with the configured policy at startup.
+var cloudAPIRetryPolicy = defaultRetryPolicy()
+
+// cloudAPIRetries counts the CloudAPI requests retried by this process.
+var cloudAPIRetries int64
+
+// defaultRetryPolicy returns the policy used when nothing is configured.
+func defaultRetryPolicy() *retryPolicy {
+	policy, _ := newRetryPolicy(RetryConfig{})
+	return policy
+}
+
+// newRetryPolicy validates the retry configuration and fills in defaults
+// for any values that aren't set.
+func newRetryPolicy(config RetryConfig) (*retryPolicy, error) {
+	policy := &retryPolicy{
+		maxAttempts:    config.MaxAttempts,
+		initialBackoff: defaultRetryInitialBackoff,
+		maxBackoff:     defaultRetryMaxBackoff,
+		jitter:         defaultRetryJitter,
+		retryable:      make(map[int]bool),
+	}
+
+	if policy.maxAttempts == 0 {
+		policy.maxAttempts = defaultRetryMaxAttempts
+	}
+
+	if policy.maxAttempts < 1 {
+		return nil, fmt.Errorf("Retry max_attempts must be at least 1: %v",
+			config.MaxAttempts)
+	}
+
+	if len(config.InitialBackoff) > 0 {
+		backoff, parseErr := time.ParseDuration(config.InitialBackoff)
+
+		if parseErr != nil || backoff < 0 {
+			return nil, fmt.Errorf("Invalid retry initial_backoff [%v]",
+				config.InitialBackoff)
+		}
+
+		policy.initialBackoff = backoff
+	}
+
+	if len(config.MaxBackoff) > 0 {
+		backoff, parseErr := time.ParseDuration(config.MaxBackoff)
+
+		if parseErr != nil || backoff < 0 {
+			return nil, fmt.Errorf("Invalid retry max_backoff [%v]",
+				config.MaxBackoff)
+		}
+
+		if backoff > maxRetryAfter {
+			return nil, fmt.Errorf("Retry max_backoff [%v] can't exceed %v "+
+				"because retried requests keep their signed date",
+				config.MaxBackoff, maxRetryAfter)
+		}
+
+		policy.maxBackoff = backoff
+	}
+
+	if config.Jitter != nil {
+		if *config.Jitter < 0 || *config.Jitter > 1 {
+			return nil, fmt.Errorf("Retry jitter must be between 0 and 1: %v",
+				*config.Jitter)
+		}
+
+		policy.jitter = *config.Jitter
+	}
+
+	statusCodes := config.RetryableStatusCodes
+	if statusCodes == nil {
+		statusCodes = defaultRetryableStatusCodes
+	}
+
+	for _, statusCode := range statusCodes {
+		policy.retryable[statusCode] = true
+	}
+
+	return policy, nil
+}
+
+// backoff returns the delay before the specified retry, starting at 1.
+func (p *retryPolicy) backoff(retry int) time.Duration {
+	delay := p.initialBackoff
+
+	for i := 1; i < retry && delay < p.maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+
+	if p.jitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.jitter * float64(delay))
+	}
+
+	return delay
+}
+
+// retryTransport retries CloudAPI requests that fail with a transient error
+// according to a retry policy. Because it sits below the triton-go clients
+// it applies to every CloudAPI call and sees the HTTP status and headers
+// of every response.
+type retryTransport struct {
+	next   http.RoundTripper
+	policy *retryPolicy
+	sleep  func(*http.Request, time.Duration) error
+}
+
+// newRetryTransport wraps the transport of a triton-go client with the
+// configured CloudAPI retry policy.
+func newRetryTransport(next http.RoundTripper) *retryTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &retryTransport{
+		next:   next,
+		policy: cloudAPIRetryPolicy,
+		sleep:  sleepForRequest,
+	}
+}
+
+// RoundTrip sends the request and retries it as needed. The caller's request
+// is never modified, so every retry sends a clone of it with a fresh body.
+func (r *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	attemptRequest := request
+
+	for attempt := 1; ; attempt++ {
+		response, err := r.next.RoundTrip(attemptRequest)
+
+		if attempt >= r.policy.maxAttempts {
+			return response, err
+		}
+
+		delay, retry := r.shouldRetry(request, response, err, attempt)
+
+		if !retry {
+			return response, err
+		}
+
+		attemptRequest = request.Clone(request.Context())
+
+		if request.Body != nil {
+			if request.GetBody == nil {
+				return response, err
+			}
+
+			body, bodyErr := request.GetBody()
+
+			if bodyErr != nil {
+				return response, err
+			}
+
+			attemptRequest.Body = body
+		}
+
+		reason := fmt.Sprintf("%v", err)
+		if response != nil {
+			reason = response.Status
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		log.Printf("Retrying CloudAPI request %v %v in %v after: %v\n",
+			request.Method, request.URL.Path, delay, reason)
+		atomic.AddInt64(&cloudAPIRetries, 1)
+		auditMetrics.add(metricCloudAPIRetries, "", 1)
+
+		if sleepErr := r.sleep(request, delay); sleepErr != nil {
+			return nil, sleepErr
+		}
+	}
+}
+
+// shouldRetry classifies the outcome of an attempt and returns the delay
+// before the next attempt when it should be retried.
+func (r *retryTransport) shouldRetry(request *http.Request,
+	response *http.Response, err error, attempt int) (time.Duration, bool) {
+
+	if err != nil {
+		// The request may have reached CloudAPI, so only requests that
+		// can be safely repeated are retried after a connection error
+		if request.Context().Err() != nil || !isIdempotent(request.Method) {
+			return 0, false
+		}
+
+		return r.policy.backoff(attempt), true
+	}
+
+	if !r.policy.retryable[response.StatusCode] {
+		return 0, false
+	}
+
+	if retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+		if retryAfter > maxRetryAfter {
+			return 0, false
+		}
+
+		return retryAfter, true
+	}
+
+	return r.policy.backoff(attempt), true
+}
+
+// isIdempotent returns true for HTTP methods that can be safely repeated.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or
+// as an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if len(value) < 1 {
+		return 0, false
+	}
+
+	if seconds, parseErr := strconv.Atoi(value); parseErr == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, parseErr := http.ParseTime(value); parseErr == nil {
+		delay := time.Until(date)
+
+		if delay < 0 {
+			delay = 0
+		}
+
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// sleepForRequest waits for the delay unless the request is cancelled.
+func sleepForRequest(request *http.Request, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-request.Context().Done():
+		return request.Context().Err()
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedServer responds to successive requests with the listed statuses
+// and answers any further requests with 200.
+func scriptedServer(statuses []int, headers map[string]string) (*httptest.Server, *int) {
+	requests := 0
+
+	handler := func(writer http.ResponseWriter, request *http.Request) {
+		requests++
+
+		if requests <= len(statuses) {
+			for name, value := range headers {
+				writer.Header().Set(name, value)
+			}
+
+			writer.WriteHeader(statuses[requests-1])
+			return
+		}
+
+		writer.WriteHeader(http.StatusOK)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(handler)), &requests
+}
+
+// newTestRetryTransport creates a retry transport that records its delays
+// instead of sleeping.
+func newTestRetryTransport(t *testing.T, config RetryConfig) (*retryTransport, *[]time.Duration) {
+	policy, policyErr := newRetryPolicy(config)
+
+	if policyErr != nil {
+		t.Fatal(policyErr)
+	}
+
+	var delays []time.Duration
+	transport := &retryTransport{
+		next:   http.DefaultTransport,
+		policy: policy,
+		sleep: func(request *http.Request, delay time.Duration) error {
+			delays = append(delays, delay)
+			return nil
+		},
+	}
+
+	return transport, &delays
+}
+
+func TestRetryTransportRetriesTransientStatus(t *testing.T) {
+	server, requests := scriptedServer([]int{503, 502}, nil)
+	defer server.Close()
+
+	noJitter := 0.0
+	transport, delays := newTestRetryTransport(t, RetryConfig{
+		InitialBackoff: "1s",
+		Jitter:         &noJitter,
+	})
+
+	response, err := (&http.Client{Transport: transport}).Get(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusOK || *requests != 3 {
+		t.Errorf("Expected success after 3 requests. Status: %v Requests: %v",
+			response.StatusCode, *requests)
+	}
+
+	if len(*delays) != 2 || (*delays)[0] != time.Second || (*delays)[1] != 2*time.Second {
+		t.Errorf("Expected exponential backoff. Actually: %v", *delays)
+	}
+}
+
+func TestRetryTransportGivesUpAfterMaxAttempts(t *testing.T) {
+	server, requests := scriptedServer([]int{503, 503, 503, 503}, nil)
+	defer server.Close()
+
+	transport, _ := newTestRetryTransport(t, RetryConfig{MaxAttempts: 2})
+	response, err := (&http.Client{Transport: transport}).Get(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusServiceUnavailable || *requests != 2 {
+		t.Errorf("Expected the last failure after 2 requests. Status: %v Requests: %v",
+			response.StatusCode, *requests)
+	}
+}
+
+func TestRetryTransportDoesNotRetryClientErrors(t *testing.T) {
+	server, requests := scriptedServer([]int{404}, nil)
+	defer server.Close()
+
+	transport, _ := newTestRetryTransport(t, RetryConfig{})
+	response, err := (&http.Client{Transport: transport}).Get(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusNotFound || *requests != 1 {
+		t.Errorf("Expected a single request. Status: %v Requests: %v",
+			response.StatusCode, *requests)
+	}
+}
+
+func TestRetryTransportRespectsRetryAfter(t *testing.T) {
+	server, _ := scriptedServer([]int{429}, map[string]string{"Retry-After": "7"})
+	defer server.Close()
+
+	transport, delays := newTestRetryTransport(t, RetryConfig{})
+
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*delays) != 1 || (*delays)[0] != 7*time.Second {
+		t.Errorf("Expected to wait for Retry-After. Actually: %v", *delays)
+	}
+}
+
+// failingTransport fails every request with a connection error.
+type failingTransport struct {
+	attempts int
+}
+
+func (f *failingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	f.attempts++
+	return nil, errors.New("connection reset by peer")
+}
+
+func TestRetryTransportOnlyRetriesIdempotentRequestsAfterErrors(t *testing.T) {
+	failing := &failingTransport{}
+	transport, _ := newTestRetryTransport(t, RetryConfig{MaxAttempts: 3})
+	transport.next = failing
+
+	client := &http.Client{Transport: transport}
+	client.Post("http://cloudapi.invalid/", "application/json",
+		strings.NewReader("{}"))
+
+	if failing.attempts != 1 {
+		t.Errorf("Expected POST not to be retried. Attempts: %v", failing.attempts)
+	}
+
+	failing.attempts = 0
+	request, _ := http.NewRequest(http.MethodDelete, "http://cloudapi.invalid/", nil)
+	client.Do(request)
+
+	if failing.attempts != 3 {
+		t.Errorf("Expected DELETE to be retried. Attempts: %v", failing.attempts)
+	}
+}
+
+func TestRetryPolicyBackoffIsCappedAndJittered(t *testing.T) {
+	jitter := 0.5
+	policy, _ := newRetryPolicy(RetryConfig{
+		InitialBackoff: "1s",
+		MaxBackoff:     "4s",
+		Jitter:         &jitter,
+	})
+
+	for i := 0; i < 20; i++ {
+		delay := policy.backoff(10)
+
+		if delay < 2*time.Second || delay > 4*time.Second {
+			t.Fatalf("Expected delay between 2s and 4s. Actually: %v", delay)
+		}
+	}
+}
+
+func TestNewRetryPolicyRejectsInvalidValues(t *testing.T) {
+	jitter := 2.0
+	configs := []RetryConfig{
+		{MaxAttempts: -1},
+		{InitialBackoff: "soon"},
+		{MaxBackoff: "5m"},
+		{Jitter: &jitter},
+	}
+
+	for _, config := range configs {
+		if _, err := newRetryPolicy(config); err == nil {
+			t.Errorf("Expected error for %+v and none was thrown", config)
+		}
+	}
+}
+
+func TestRetryTransportResendsBodyWithoutModifyingRequest(t *testing.T) {
+	var bodies []string
+	handler := func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		bodies = append(bodies, string(body))
+
+		if len(bodies) == 1 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	transport, _ := newTestRetryTransport(t, RetryConfig{})
+	request, requestErr := http.NewRequest(http.MethodPost, server.URL,
+		strings.NewReader(`{"network":"public"}`))
+
+	if requestErr != nil {
+		t.Fatal(requestErr)
+	}
+
+	originalBody := request.Body
+	response, err := transport.RoundTrip(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if len(bodies) != 2 || bodies[1] != `{"network":"public"}` {
+		t.Errorf("Expected the body to be sent with both attempts: %q", bodies)
+	}
+
+	if request.Body != originalBody {
+		t.Error("Expected the body of the request to be left as it was")
+	}
+}
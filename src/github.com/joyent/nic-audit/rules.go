@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+)
+
+// Types of network rules.
+const (
+	ruleRequired = "required"
+	ruleExactly  = "exactly"
+	ruleAtMost   = "at_most"
+)
+
+// NetworkRule asserts the number of NICs that instances matching the
+// selector have on a network, as opposed to nic groups that describe
+// forbidden combinations of networks.
+type NetworkRule struct {
+	// required (at least count), exactly or at_most
+	Type string `json:"type"`
+	// Network given the same way as the members of a nic group
+	Network string `json:"network"`
+	// Number of NICs, which defaults to 1 for required and exactly rules
+	Count    *int             `json:"count"`
+	Selector InstanceSelector `json:"selector"`
+	Severity string           `json:"severity"`
+}
+
+// InstanceSelector selects the instances a network rule applies to. Every
+// setting that is given must match and an empty selector matches every
+// instance.
+type InstanceSelector struct {
+	// Regular expression matched against the instance name
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags"`
+	Brand   string            `json:"brand"`
+	Package string            `json:"package"`
+	Image   string            `json:"image"`
+}
+
+// networkRule is a validated network rule.
+type networkRule struct {
+	NetworkRule
+	count int
+	name  *regexp.Regexp
+}
+
+// newNetworkRules validates the configured network rules. Rule names share
+// the alert stream with the nic groups, so they must differ from the names
+// of the nic groups.
+func newNetworkRules(rules map[string]NetworkRule,
+	nicGroups map[string][]string) (map[string]networkRule, error) {
+
+	validated := make(map[string]networkRule, len(rules))
+
+	for ruleName, rule := range rules {
+		if _, ok := nicGroups[ruleName]; ok || ruleName == firewallAlertGroup {
+			return nil, fmt.Errorf("Network rule [%v] has the same name as a "+
+				"nic group or the firewall audit", ruleName)
+		}
+
+		if !isValidNetwork(rule.Network) {
+			if _, cidrErr := parseMultipleCIDRs(rule.Network); cidrErr != nil {
+				return nil, fmt.Errorf("Network [%v] of network rule [%v] must "+
+					"be a UUID, CIDR or the string 'public'", rule.Network, ruleName)
+			}
+		}
+
+		compiled := networkRule{NetworkRule: rule, count: 1}
+
+		switch rule.Type {
+		case ruleRequired, ruleExactly:
+		case ruleAtMost:
+			if rule.Count == nil {
+				return nil, fmt.Errorf("Network rule [%v] needs a count",
+					ruleName)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown type [%v] of network rule [%v]",
+				rule.Type, ruleName)
+		}
+
+		if rule.Count != nil {
+			compiled.count = *rule.Count
+		}
+
+		if compiled.count < 0 || (rule.Type == ruleRequired && compiled.count < 1) {
+			return nil, fmt.Errorf("Invalid count [%v] of network rule [%v]",
+				compiled.count, ruleName)
+		}
+
+		if len(rule.Selector.Name) > 0 {
+			pattern, patternErr := regexp.Compile(rule.Selector.Name)
+
+			if patternErr != nil {
+				return nil, fmt.Errorf("Invalid name selector of network rule "+
+					"[%v]: %v", ruleName, patternErr)
+			}
+
+			compiled.name = pattern
+		}
+
+		validated[ruleName] = compiled
+	}
+
+	return validated, nil
+}
+
+// selects determines if the rule applies to the instance.
+func (r networkRule) selects(instance compute.Instance) bool {
+	selector := r.Selector
+
+	if r.name != nil && !r.name.MatchString(instance.Name) {
+		return false
+	}
+
+	for key, value := range selector.Tags {
+		tag, ok := instance.Tags[key]
+
+		if !ok || fmt.Sprintf("%v", tag) != value {
+			return false
+		}
+	}
+
+	return (len(selector.Brand) < 1 || selector.Brand == instance.Brand) &&
+		(len(selector.Package) < 1 || selector.Package == instance.Package) &&
+		(len(selector.Image) < 1 || selector.Image == instance.Image)
+}
+
+// violation returns a description of how the instance violates the rule, or
+// an empty string when it complies.
+func (r networkRule) violation(instance compute.Instance,
+	privateNetworkBlocks []string) string {
+
+	found := countNICsOnNetwork(instance, r.Network, privateNetworkBlocks)
+
+	switch {
+	case r.Type == ruleRequired && found < r.count:
+		return fmt.Sprintf("Requires at least %v NIC(s) on [%v], found %v",
+			r.count, r.Network, found)
+	case r.Type == ruleExactly && found != r.count:
+		return fmt.Sprintf("Requires exactly %v NIC(s) on [%v], found %v",
+			r.count, r.Network, found)
+	case r.Type == ruleAtMost && found > r.count:
+		return fmt.Sprintf("Allows at most %v NIC(s) on [%v], found %v",
+			r.count, r.Network, found)
+	}
+
+	return ""
+}
+
+// countNICsOnNetwork counts the IPs of the instance that are on the network.
+func countNICsOnNetwork(instance compute.Instance, network string,
+	privateNetworkBlocks []string) int {
+
+	count := 0
+
+	for i := 0; i < len(instance.IPs) && i < len(instance.Networks); i++ {
+		nic := &compute.NIC{IP: instance.IPs[i], Network: instance.Networks[i]}
+
+		if nicMatchesNetwork(nic, network, privateNetworkBlocks) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// createAlertsForNetworkRules aggregates alerts for every instance that
+// violates a network rule that selects it.
+func createAlertsForNetworkRules(account Account, instances []*compute.Instance,
+	rules map[string]networkRule, privateNetworkBlocks []string) list.List {
+
+	alerts := list.New()
+
+	for _, instance := range instances {
+		for ruleName, rule := range rules {
+			if !rule.selects(*instance) {
+				continue
+			}
+
+			if violation := rule.violation(*instance, privateNetworkBlocks); len(violation) > 0 {
+				alerts.PushBack(Alert{
+					Instance:     *instance,
+					Account:      account,
+					NicGroupName: ruleName,
+					NicGroupIds:  []string{rule.Network},
+					RuleType:     rule.Type,
+					Violation:    violation,
+				})
+			}
+		}
+	}
+
+	return *alerts
+}
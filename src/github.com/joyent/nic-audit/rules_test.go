@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/joyent/triton-go/compute"
+)
+
+func intPointer(value int) *int {
+	return &value
+}
+
+func TestNewNetworkRulesRejectsInvalidRules(t *testing.T) {
+	nicGroups := testAuditConfiguration().NicGroups
+
+	for name, rule := range map[string]NetworkRule{
+		"unknown-type":     {Type: "some", Network: "public"},
+		"at-most-no-count": {Type: ruleAtMost, Network: "public"},
+		"required-zero":    {Type: ruleRequired, Network: "public", Count: intPointer(0)},
+		"negative":         {Type: ruleExactly, Network: "public", Count: intPointer(-1)},
+		"bad-network":      {Type: ruleRequired, Network: "intranet"},
+		"bad-selector": {Type: ruleRequired, Network: "public",
+			Selector: InstanceSelector{Name: "("}},
+		"public-and-intranet": {Type: ruleRequired, Network: "public"},
+	} {
+		if _, err := newNetworkRules(map[string]NetworkRule{name: rule},
+			nicGroups); err == nil {
+			t.Errorf("Expected error for rule [%v] and none was thrown", name)
+		}
+	}
+}
+
+func TestNetworkRuleViolations(t *testing.T) {
+	instance := compute.Instance{
+		Name:     "web-01",
+		IPs:      []string{"165.122.33.44", "165.122.33.45", "10.2.45.234"},
+		Networks: []string{testPublicNetwork, testPublicNetwork, testIntranetNetwork},
+	}
+
+	rules, rulesErr := newNetworkRules(map[string]NetworkRule{
+		"management":       {Type: ruleRequired, Network: testPrivateNetwork},
+		"intranet":         {Type: ruleRequired, Network: testIntranetNetwork},
+		"one-public":       {Type: ruleExactly, Network: "public"},
+		"two-public":       {Type: ruleExactly, Network: "public", Count: intPointer(2)},
+		"at-most-1-public": {Type: ruleAtMost, Network: "public", Count: intPointer(1)},
+	}, nil)
+
+	if rulesErr != nil {
+		t.Fatal(rulesErr)
+	}
+
+	for name, violates := range map[string]bool{
+		"management":       true,
+		"intranet":         false,
+		"one-public":       true,
+		"two-public":       false,
+		"at-most-1-public": true,
+	} {
+		violation := rules[name].violation(instance, testPrivateBlocks)
+
+		if violates != (len(violation) > 0) {
+			t.Errorf("Unexpected violation of rule [%v]: %q", name, violation)
+		}
+	}
+}
+
+func TestNetworkRuleSelectors(t *testing.T) {
+	instance := compute.Instance{
+		Name:  "web-01",
+		Brand: "joyent",
+		Tags:  map[string]interface{}{"env": "production", "replicas": 3},
+	}
+
+	for selector, selects := range map[*InstanceSelector]bool{
+		{}:              true,
+		{Name: "^web-"}: true,
+		{Name: "^db-"}:  false,
+		{Tags: map[string]string{"env": "production", "replicas": "3"}}: true,
+		{Tags: map[string]string{"env": "staging"}}:                     false,
+		{Brand: "kvm"}: false,
+	} {
+		rules, _ := newNetworkRules(map[string]NetworkRule{
+			"rule": {Type: ruleRequired, Network: "public", Selector: *selector},
+		}, nil)
+
+		if rules["rule"].selects(instance) != selects {
+			t.Errorf("Expected selector %+v to select [%v]", *selector, selects)
+		}
+	}
+}
+
+func TestAuditAccountAlertsNetworkRuleViolationsWithoutRemovingNICs(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.NetworkRules = map[string]NetworkRule{
+		"exactly-one-public": {Type: ruleExactly, Network: "public"},
+	}
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, &AuditRun{},
+		sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.alerts) != 2 {
+		t.Fatalf("Expected a nic group and a network rule alert: %+v", sink.alerts)
+	}
+
+	ruleAlert := sink.alerts[1]
+
+	if ruleAlert.NicGroupName != "exactly-one-public" ||
+		ruleAlert.Instance.Name != "compliant" ||
+		ruleAlert.RuleType != ruleExactly || len(ruleAlert.Violation) < 1 {
+		t.Errorf("Unexpected network rule alert: %+v", ruleAlert)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 1 || removed[0] != "90:b8:d0:00:00:01" {
+		t.Errorf("Expected only the nic group violation to be remediated: %v", removed)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+)
+
+// Severities of alerts from least to most severe.
+const (
+	severityInfo     = "info"
+	severityLow      = "low"
+	severityMedium   = "medium"
+	severityHigh     = "high"
+	severityCritical = "critical"
+)
+
+// defaultSeverity is the severity of nic groups, network rules and the
+// firewall audit when no severity is configured.
+const defaultSeverity = severityMedium
+
+// severityLevels orders the severities.
+var severityLevels = map[string]int{
+	severityInfo:     1,
+	severityLow:      2,
+	severityMedium:   3,
+	severityHigh:     4,
+	severityCritical: 5,
+}
+
+// validateSeverity checks that a configured severity is known. An empty
+// severity is valid and means the default or no threshold.
+func validateSeverity(severity string, setting string) error {
+	if _, ok := severityLevels[severity]; ok || len(severity) < 1 {
+		return nil
+	}
+
+	return fmt.Errorf("Invalid severity [%v] for %v. It must be one of "+
+		"info, low, medium, high or critical", severity, setting)
+}
+
+// severityAtLeast determines if the severity is at or above the threshold.
+// Every severity passes an empty threshold.
+func severityAtLeast(severity string, threshold string) bool {
+	if len(threshold) < 1 {
+		return true
+	}
+
+	return severityLevels[severity] >= severityLevels[threshold]
+}
+
+// validateSeverities checks every severity of the configuration.
+func validateSeverities(config Configuration) error {
+	for nicGroup, severity := range config.NicGroupSeverities {
+		if _, ok := config.NicGroups[nicGroup]; !ok {
+			return fmt.Errorf("Unknown nic group [%v] in the nic group "+
+				"severities", nicGroup)
+		}
+
+		if err := validateSeverity(severity, "nic group ["+nicGroup+"]"); err != nil {
+			return err
+		}
+	}
+
+	for ruleName, rule := range config.NetworkRules {
+		if err := validateSeverity(rule.Severity, "network rule ["+ruleName+"]"); err != nil {
+			return err
+		}
+	}
+
+	for i, sinkConfig := range config.AlertSinks {
+		if err := validateSeverity(sinkConfig.MinSeverity,
+			fmt.Sprintf("alert sink %v", i+1)); err != nil {
+			return err
+		}
+	}
+
+	if err := validateSeverity(config.FirewallAudit.Severity, "the firewall audit"); err != nil {
+		return err
+	}
+
+	return validateSeverity(config.Remediation.MinSeverity, "remediation")
+}
+
+// alertSeverity determines the configured severity of an alert.
+func alertSeverity(config Configuration, alert Alert) string {
+	var severity string
+
+	switch alert.RuleType {
+	case "":
+		severity = config.NicGroupSeverities[alert.NicGroupName]
+	case ruleFirewall:
+		severity = config.FirewallAudit.Severity
+	default:
+		severity = config.NetworkRules[alert.NicGroupName].Severity
+	}
+
+	if len(severity) < 1 {
+		return defaultSeverity
+	}
+
+	return severity
+}
+
+// mergeAlerts combines lists of alerts into a single list, setting the
+// severity of every alert.
+func mergeAlerts(config Configuration, lists ...list.List) list.List {
+	merged := list.New()
+
+	for _, alerts := range lists {
+		for e := alerts.Front(); e != nil; e = e.Next() {
+			alert := e.Value.(Alert)
+			alert.Severity = alertSeverity(config, alert)
+			merged.PushBack(alert)
+		}
+	}
+
+	return *merged
+}
+
+// countSeverity increments the count of the severity, creating the counts
+// when needed.
+func countSeverity(counts map[string]int, severity string) map[string]int {
+	if counts == nil {
+		counts = make(map[string]int)
+	}
+
+	counts[severity]++
+
+	return counts
+}
+
+// highestSeverity returns the most severe severity of the alerts.
+func highestSeverity(alerts []*emailAlert) string {
+	highest := ""
+
+	for _, alert := range alerts {
+		if severityLevels[alert.Severity] > severityLevels[highest] {
+			highest = alert.Severity
+		}
+	}
+
+	return highest
+}
+
+// severityPrefix returns the prefix of an email subject for the specified
+// severity, such as "[CRITICAL] ".
+func severityPrefix(severity string) string {
+	if len(severity) < 1 {
+		return ""
+	}
+
+	return "[" + strings.ToUpper(severity) + "] "
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"container/list"
+	"testing"
+)
+
+func TestSeverityAtLeast(t *testing.T) {
+	if !severityAtLeast(severityCritical, severityHigh) ||
+		!severityAtLeast(severityHigh, severityHigh) ||
+		severityAtLeast(severityMedium, severityHigh) ||
+		!severityAtLeast(severityInfo, "") {
+		t.Error("Unexpected severity ordering")
+	}
+}
+
+func TestValidateSeveritiesRejectsUnknownSeverity(t *testing.T) {
+	config := testAuditConfiguration()
+	config.NicGroupSeverities = map[string]string{"public-and-intranet": "urgent"}
+
+	if err := validateSeverities(config); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+
+	config.NicGroupSeverities = map[string]string{"unknown": severityHigh}
+
+	if err := validateSeverities(config); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
+
+func TestMergeAlertsSetsConfiguredSeverities(t *testing.T) {
+	config := testAuditConfiguration()
+	config.NicGroupSeverities = map[string]string{"public-and-intranet": severityCritical}
+	config.NetworkRules = map[string]NetworkRule{
+		"one-public": {Type: ruleExactly, Network: "public", Severity: severityLow},
+	}
+
+	nicGroupAlerts := list.New()
+	nicGroupAlerts.PushBack(Alert{NicGroupName: "public-and-intranet"})
+	ruleAlerts := list.New()
+	ruleAlerts.PushBack(Alert{NicGroupName: "one-public", RuleType: ruleExactly})
+	firewallAlerts := list.New()
+	firewallAlerts.PushBack(Alert{NicGroupName: firewallAlertGroup, RuleType: ruleFirewall})
+
+	merged := mergeAlerts(config, *nicGroupAlerts, *ruleAlerts, *firewallAlerts)
+	var severities []string
+
+	for e := merged.Front(); e != nil; e = e.Next() {
+		severities = append(severities, e.Value.(Alert).Severity)
+	}
+
+	if len(severities) != 3 || severities[0] != severityCritical ||
+		severities[1] != severityLow || severities[2] != defaultSeverity {
+		t.Errorf("Unexpected severities: %v", severities)
+	}
+}
+
+func TestAuditOnlyRemediatesAlertsAboveSeverityThreshold(t *testing.T) {
+	fake := newTestFakeCloudAPI()
+	defer useFakeCloudAPI(fake)()
+
+	config := testAuditConfiguration()
+	config.NicGroupSeverities = map[string]string{"public-and-intranet": severityMedium}
+	config.Remediation.MinSeverity = severityHigh
+	account := Account{
+		AccountName:      "some.user",
+		NetworksToRemove: []string{"public"},
+	}
+	run := &AuditRun{}
+	sink := &recordingSink{}
+
+	if err := auditAccount(account, config.NicGroups, config, run, sink); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := fake.removedMACs(); len(removed) != 0 {
+		t.Errorf("Expected no NICs to be removed: %v", removed)
+	}
+
+	if len(sink.alerts) != 1 || sink.alerts[0].Severity != severityMedium ||
+		run.AlertsBySeverity[severityMedium] != 1 {
+		t.Errorf("Expected a medium severity alert: %+v", sink.alerts)
+	}
+}
+
+func TestSeverityPrefixUsesHighestSeverity(t *testing.T) {
+	alerts := []*emailAlert{
+		{Alert: Alert{Severity: severityLow}},
+		{Alert: Alert{Severity: severityCritical}},
+		{Alert: Alert{Severity: severityMedium}},
+	}
+
+	if prefix := severityPrefix(highestSeverity(alerts)); prefix != "[CRITICAL] " {
+		t.Errorf("Unexpected subject prefix: %q", prefix)
+	}
+}
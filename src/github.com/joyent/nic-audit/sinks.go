@@ -0,0 +1,390 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// AlertSink is a destination for the results of an audit run. A sink is
+// told when a run begins, receives every alert and remediation result as
+// they are produced and is told when the run ends so that it can flush any
+// aggregated output.
+type AlertSink interface {
+	BeginRun(run *AuditRun) error
+	EmitAlert(alert Alert) error
+	EmitRemediation(alert Alert, result RemediationResult) error
+	EndRun(run *AuditRun) error
+}
+
+// AuditRun describes a single execution of the auditing tool across all of
+// the configured accounts.
+type AuditRun struct {
+	Started          time.Time
+	Finished         time.Time
+	AccountsAudited  int
+	InstancesScanned int
+	AlertCount       int
+	AlertsRemediated int
+	AccountsFailed   int
+	CloudAPIRetries  int
+	// Instances and NICs that removal was attempted for and the NICs
+	// whose removal was blocked by the remediation safety limits
+	InstancesRemediated int
+	NICsRemoved         int
+	NICsBlocked         int
+	// NIC removals written to the remediation plan awaiting approval
+	PlannedRemovals []PlanEntry
+	// Alerts whose remediation was deferred until their grace period ends
+	AlertsInGracePeriod int
+	// Instances whose remediation was deferred by the rate limits or the
+	// circuit breaker
+	DeferredRemediations []DeferredRemediation
+	// Alerts found and remediated by severity
+	AlertsBySeverity     map[string]int
+	RemediatedBySeverity map[string]int
+	// When violations were first seen, if a state file is configured
+	violations *violationState
+	// Paces remediation across every account of the run
+	limiter *remediationLimiter
+	// Accounts in a data center at a CloudAPI URL that were audited
+	// successfully
+	audited map[string]bool
+}
+
+// markAudited records that the account was audited successfully in its data
+// center.
+func (r *AuditRun) markAudited(account Account) {
+	if r.audited == nil {
+		r.audited = make(map[string]bool)
+	}
+
+	r.audited[runAccountKey(account.AccountName, account.Datacenter,
+		account.TritonUrl)] = true
+	// Entries recorded without the CloudAPI URL match any account with the
+	// name in the data center
+	r.audited[runAccountKey(account.AccountName, account.Datacenter, "")] = true
+}
+
+// wasAudited determines if the account was audited successfully by the run.
+func (r *AuditRun) wasAudited(accountName string, datacenter string,
+	tritonURL string) bool {
+
+	return r.audited[runAccountKey(accountName, datacenter, tritonURL)]
+}
+
+// runAccountKey identifies an account in a data center at a CloudAPI URL.
+func runAccountKey(accountName string, datacenter string, tritonURL string) string {
+	return accountName + "\x00" + datacenter + "\x00" + tritonURL
+}
+
+// RemediationResult describes the outcome of attempting to remove the
+// offending NICs from an instance.
+type RemediationResult struct {
+	NetworksRemoved []string
+	NICs            []NICRemoval
+	Actions         []ActionResult
+	Err             error
+	// Reason that remediation was deferred instead of attempted
+	Deferred string
+}
+
+// AlertSinkConfig contains the configuration for a single alert sink along
+// with the filter that limits which alerts it receives.
+type AlertSinkConfig struct {
+	Type      string       `json:"type"`
+	Accounts  []string     `json:"accounts"`
+	NicGroups []string     `json:"nic_groups"`
+	Email     *EmailAlerts `json:"email"`
+	// Only alerts of at least this severity are passed to the sink
+	MinSeverity string `json:"min_severity"`
+}
+
+// buildAlertSinks creates the sinks described in the configuration. When no
+// sinks are configured, the historical behaviour of logging every alert and
+// emailing when an SMTP server is set is preserved.
+func buildAlertSinks(config Configuration) (AlertSink, error) {
+	sinkConfigs := config.AlertSinks
+
+	if len(sinkConfigs) < 1 {
+		sinkConfigs = []AlertSinkConfig{{Type: "log"}, {Type: "email"}}
+	}
+
+	sinks := make(multiSink, 0, len(sinkConfigs))
+
+	for _, sinkConfig := range sinkConfigs {
+		sink, sinkErr := newAlertSink(sinkConfig, config)
+
+		if sinkErr != nil {
+			return nil, sinkErr
+		}
+
+		if sink == nil {
+			continue
+		}
+
+		if len(sinkConfig.Accounts) > 0 || len(sinkConfig.NicGroups) > 0 ||
+			len(sinkConfig.MinSeverity) > 0 {
+			sink = &filteredSink{
+				sink:        sink,
+				accounts:    toSet(sinkConfig.Accounts),
+				nicGroups:   toSet(sinkConfig.NicGroups),
+				minSeverity: sinkConfig.MinSeverity,
+			}
+		}
+
+		sinks = append(sinks, namedSink{name: sinkConfig.Type, sink: sink})
+	}
+
+	return sinks, nil
+}
+
+// newAlertSink instantiates a single sink by its type name. A nil sink
+// with no error is returned when the sink is disabled by its configuration.
+func newAlertSink(sinkConfig AlertSinkConfig, config Configuration) (AlertSink, error) {
+	switch sinkConfig.Type {
+	case "log":
+		return &logSink{logger: alertLogger}, nil
+	case "email":
+		emailConfig := config.EmailAlerts
+		if sinkConfig.Email != nil {
+			emailConfig = *sinkConfig.Email
+		}
+
+		if len(emailConfig.SmtpServer) < 1 {
+			log.Println("Alert email is disabled because no SMTP server " +
+				"has been set")
+			return nil, nil
+		}
+
+		if routeErr := validateEmailRoutes(emailConfig, config.Accounts); routeErr != nil {
+			return nil, routeErr
+		}
+
+		return newEmailSink(emailConfig)
+	default:
+		return nil, fmt.Errorf("Unknown alert sink type [%v]", sinkConfig.Type)
+	}
+}
+
+// namedSink associates a sink with a name used when reporting its failures.
+type namedSink struct {
+	name string
+	sink AlertSink
+}
+
+// multiSink fans out every call to each of its sinks. A failure in one sink
+// is logged and doesn't prevent the remaining sinks from being called.
+type multiSink []namedSink
+
+func (sinks multiSink) BeginRun(run *AuditRun) error {
+	sinks.each("begin run", func(sink AlertSink) error {
+		return sink.BeginRun(run)
+	})
+	return nil
+}
+
+func (sinks multiSink) EmitAlert(alert Alert) error {
+	sinks.each("emit alert", func(sink AlertSink) error {
+		return sink.EmitAlert(alert)
+	})
+	return nil
+}
+
+func (sinks multiSink) EmitRemediation(alert Alert, result RemediationResult) error {
+	sinks.each("emit remediation", func(sink AlertSink) error {
+		return sink.EmitRemediation(alert, result)
+	})
+	return nil
+}
+
+func (sinks multiSink) EndRun(run *AuditRun) error {
+	sinks.each("end run", func(sink AlertSink) error {
+		return sink.EndRun(run)
+	})
+	return nil
+}
+
+// each invokes the specified function for every sink, isolating each call
+// so that an error or a panic is logged rather than propagated.
+func (sinks multiSink) each(action string, call func(sink AlertSink) error) {
+	for _, named := range sinks {
+		callErr := safeSinkCall(named.sink, call)
+
+		if callErr != nil {
+			log.Printf("Alert sink [%v] failed to %v: %v\n", named.name,
+				action, callErr)
+		}
+	}
+}
+
+// safeSinkCall invokes a sink call and converts any panic into an error.
+func safeSinkCall(sink AlertSink, call func(sink AlertSink) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return call(sink)
+}
+
+// filteredSink only passes on the alerts for the configured accounts and
+// nic groups of at least the minimum severity. An empty set or severity
+// places no restriction.
+type filteredSink struct {
+	sink        AlertSink
+	accounts    map[string]bool
+	nicGroups   map[string]bool
+	minSeverity string
+}
+
+func (f *filteredSink) BeginRun(run *AuditRun) error {
+	return f.sink.BeginRun(run)
+}
+
+func (f *filteredSink) EmitAlert(alert Alert) error {
+	if !f.accepts(alert) {
+		return nil
+	}
+
+	return f.sink.EmitAlert(alert)
+}
+
+func (f *filteredSink) EmitRemediation(alert Alert, result RemediationResult) error {
+	if !f.accepts(alert) {
+		return nil
+	}
+
+	return f.sink.EmitRemediation(alert, result)
+}
+
+func (f *filteredSink) EndRun(run *AuditRun) error {
+	return f.sink.EndRun(run)
+}
+
+// accepts determines if the specified alert passes the filter.
+func (f *filteredSink) accepts(alert Alert) bool {
+	if len(f.accounts) > 0 && !f.accounts[alert.Account.AccountName] {
+		return false
+	}
+
+	if !severityAtLeast(alert.Severity, f.minSeverity) {
+		return false
+	}
+
+	if len(f.nicGroups) > 0 && !f.nicGroups[alert.NicGroupName] {
+		return false
+	}
+
+	return true
+}
+
+// logSink writes a single line for every alert to the specified logger.
+type logSink struct {
+	logger *log.Logger
+}
+
+func (l *logSink) BeginRun(run *AuditRun) error {
+	return nil
+}
+
+func (l *logSink) EmitAlert(alert Alert) error {
+	datacenter := datacenterSuffix(alert.Account.Datacenter)
+
+	if len(alert.Violation) > 0 {
+		l.logger.Printf("[%v] %v: %v (%v)%v %v %v\n", alert.Severity,
+			alert.NicGroupName, alert.Instance.Name, alert.Instance.ID,
+			datacenter, alert.Instance.IPs, alert.Violation)
+		return nil
+	}
+
+	l.logger.Printf("[%v] %v: %v (%v)%v %v\n", alert.Severity,
+		alert.NicGroupName, alert.Instance.Name, alert.Instance.ID, datacenter,
+		alert.Instance.IPs)
+	return nil
+}
+
+// datacenterSuffix describes the data center of an alert in a log line, or
+// is empty for accounts that aren't audited in several data centers.
+func datacenterSuffix(datacenter string) string {
+	if len(datacenter) < 1 {
+		return ""
+	}
+
+	return " in datacenter [" + datacenter + "]"
+}
+
+func (l *logSink) EmitRemediation(alert Alert, result RemediationResult) error {
+	if len(result.Deferred) > 0 {
+		l.logger.Printf("%v: %v (%v) remediation deferred: %v\n",
+			alert.NicGroupName, alert.Instance.Name, alert.Instance.ID,
+			result.Deferred)
+		return nil
+	}
+
+	if result.Err != nil {
+		l.logger.Printf("%v: %v (%v) remediation failed: %v\n",
+			alert.NicGroupName, alert.Instance.Name, alert.Instance.ID,
+			result.Err)
+
+		for _, nic := range result.NICs {
+			l.logger.Printf("%v: %v (%v) NIC %v %v (%v) %v\n",
+				alert.NicGroupName, alert.Instance.Name, alert.Instance.ID,
+				nic.MAC, nic.IP, nic.Network, nic.Outcome)
+		}
+
+		for _, action := range result.Actions {
+			l.logger.Printf("%v: %v (%v) action %v %v\n", alert.NicGroupName,
+				alert.Instance.Name, alert.Instance.ID, action.Action,
+				action.Outcome)
+		}
+
+		return nil
+	}
+
+	l.logger.Printf("%v: %v (%v) networks removed %v\n", alert.NicGroupName,
+		alert.Instance.Name, alert.Instance.ID, result.NetworksRemoved)
+
+	if pending := networksWithOutcome(result.NICs, nicPending); len(pending) > 0 {
+		l.logger.Printf("%v: %v (%v) networks pending removal %v\n",
+			alert.NicGroupName, alert.Instance.Name, alert.Instance.ID, pending)
+	}
+
+	if blocked := networksWithOutcome(result.NICs, nicBlocked); len(blocked) > 0 {
+		l.logger.Printf("%v: %v (%v) networks blocked from removal %v\n",
+			alert.NicGroupName, alert.Instance.Name, alert.Instance.ID, blocked)
+	}
+
+	for _, action := range result.Actions {
+		l.logger.Printf("%v: %v (%v) action %v %v\n", alert.NicGroupName,
+			alert.Instance.Name, alert.Instance.ID, action.Action, action.Outcome)
+	}
+
+	return nil
+}
+
+func (l *logSink) EndRun(run *AuditRun) error {
+	l.logger.Printf("Audit finished: accounts [%v] failed [%v] instances [%v] "+
+		"alerts [%v] remediated [%v] in grace period [%v] deferred [%v] "+
+		"NICs removed [%v] blocked [%v] CloudAPI retries [%v]\n",
+		run.AccountsAudited, run.AccountsFailed, run.InstancesScanned,
+		run.AlertCount, run.AlertsRemediated, run.AlertsInGracePeriod,
+		len(run.DeferredRemediations), run.NICsRemoved, run.NICsBlocked,
+		run.CloudAPIRetries)
+
+	for _, deferred := range run.DeferredRemediations {
+		l.logger.Printf("Remediation deferred: %v: %v (%v) in account [%v]%v: %v\n",
+			deferred.NicGroup, deferred.InstanceName, deferred.Instance,
+			deferred.Account, datacenterSuffix(deferred.Datacenter), deferred.Reason)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// recordingSink keeps every alert it receives and optionally fails.
+type recordingSink struct {
+	alerts       []Alert
+	remediations []RemediationResult
+	fail         bool
+	panics       bool
+	ended        bool
+}
+
+func (r *recordingSink) BeginRun(run *AuditRun) error {
+	return nil
+}
+
+func (r *recordingSink) EmitAlert(alert Alert) error {
+	if r.panics {
+		panic("sink exploded")
+	}
+
+	if r.fail {
+		return errors.New("sink failed")
+	}
+
+	r.alerts = append(r.alerts, alert)
+	return nil
+}
+
+func (r *recordingSink) EmitRemediation(alert Alert, result RemediationResult) error {
+	r.remediations = append(r.remediations, result)
+	return nil
+}
+
+func (r *recordingSink) EndRun(run *AuditRun) error {
+	r.ended = true
+	return nil
+}
+
+func TestFilteredSinkOnlyPassesConfiguredAccounts(t *testing.T) {
+	recorder := &recordingSink{}
+	sink := &filteredSink{
+		sink:     recorder,
+		accounts: toSet([]string{"team-a"}),
+	}
+
+	sink.EmitAlert(Alert{Account: Account{AccountName: "team-a"}})
+	sink.EmitAlert(Alert{Account: Account{AccountName: "team-b"}})
+
+	if len(recorder.alerts) != 1 {
+		t.Errorf("Expected 1 alert to pass the filter. Actually: %v",
+			len(recorder.alerts))
+	}
+}
+
+func TestFilteredSinkOnlyPassesMinimumSeverity(t *testing.T) {
+	recorder := &recordingSink{}
+	sink := &filteredSink{
+		sink:        recorder,
+		minSeverity: severityHigh,
+	}
+
+	sink.EmitAlert(Alert{Severity: severityCritical})
+	sink.EmitAlert(Alert{Severity: severityHigh})
+	sink.EmitAlert(Alert{Severity: severityMedium})
+
+	if len(recorder.alerts) != 2 {
+		t.Errorf("Expected 2 alerts to pass the filter. Actually: %v",
+			len(recorder.alerts))
+	}
+}
+
+func TestFilteredSinkOnlyPassesConfiguredNicGroups(t *testing.T) {
+	recorder := &recordingSink{}
+	sink := &filteredSink{
+		sink:      recorder,
+		nicGroups: toSet([]string{"public-and-intranet"}),
+	}
+
+	sink.EmitAlert(Alert{NicGroupName: "public-and-intranet"})
+	sink.EmitAlert(Alert{NicGroupName: "private-and-intranet"})
+
+	if len(recorder.alerts) != 1 {
+		t.Errorf("Expected 1 alert to pass the filter. Actually: %v",
+			len(recorder.alerts))
+	}
+}
+
+func TestMultiSinkContinuesAfterSinkFailure(t *testing.T) {
+	failing := &recordingSink{fail: true}
+	panicking := &recordingSink{panics: true}
+	healthy := &recordingSink{}
+
+	sinks := multiSink{
+		{name: "failing", sink: failing},
+		{name: "panicking", sink: panicking},
+		{name: "healthy", sink: healthy},
+	}
+
+	sinks.EmitAlert(Alert{})
+	sinks.EndRun(&AuditRun{})
+
+	if len(healthy.alerts) != 1 {
+		t.Errorf("Expected healthy sink to receive 1 alert. Actually: %v",
+			len(healthy.alerts))
+	}
+
+	if !failing.ended || !panicking.ended || !healthy.ended {
+		t.Error("Expected every sink to be told the run ended")
+	}
+}
+
+func TestBuildAlertSinksRejectsUnknownType(t *testing.T) {
+	config := Configuration{
+		AlertSinks: []AlertSinkConfig{{Type: "carrier-pigeon"}},
+	}
+
+	_, err := buildAlertSinks(config)
+
+	if err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/jordan-wright/email"
+)
+
+// smtpDialTimeout is the maximum amount of time to wait when connecting to
+// the SMTP server.
+const smtpDialTimeout = 30 * time.Second
+
+// smtpSessionTimeout is the maximum amount of time that delivering a message
+// to the SMTP server may take once connected, so that a hung server can't
+// block the audit. It is a variable so that tests can shorten it.
+var smtpSessionTimeout = 2 * time.Minute
+
+// validateSMTPSettings verifies that the TLS mode and authentication
+// mechanism are known values and that any TLS material can be loaded.
+func validateSMTPSettings(config EmailAlerts) error {
+	switch strings.ToLower(config.SmtpTLS) {
+	case "", "none", "starttls", "tls":
+	default:
+		return fmt.Errorf("Unknown SMTP TLS mode [%v]. It must be one of "+
+			"'none', 'starttls' or 'tls'", config.SmtpTLS)
+	}
+
+	switch strings.ToLower(config.SmtpAuth) {
+	case "", "plain", "login", "cram-md5":
+	default:
+		return fmt.Errorf("Unknown SMTP authentication mechanism [%v]. It "+
+			"must be one of 'plain', 'login' or 'cram-md5'", config.SmtpAuth)
+	}
+
+	_, tlsErr := smtpTLSConfig(config)
+
+	return tlsErr
+}
+
+// smtpTLSConfig builds the TLS configuration used to connect to the SMTP
+// server from the CA bundle, server name and client certificate settings.
+func smtpTLSConfig(config EmailAlerts) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: config.SmtpServer,
+	}
+
+	if len(config.SmtpServerName) > 0 {
+		tlsConfig.ServerName = config.SmtpServerName
+	}
+
+	if len(config.SmtpCAFile) > 0 {
+		pem, readErr := ioutil.ReadFile(config.SmtpCAFile)
+
+		if readErr != nil {
+			return nil, fmt.Errorf("Unable to read SMTP CA bundle [%v]. %v",
+				config.SmtpCAFile, readErr)
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in SMTP CA bundle [%v]",
+				config.SmtpCAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(config.SmtpClientCert) > 0 || len(config.SmtpClientKey) > 0 {
+		cert, certErr := tls.LoadX509KeyPair(config.SmtpClientCert,
+			config.SmtpClientKey)
+
+		if certErr != nil {
+			return nil, fmt.Errorf("Unable to load SMTP client certificate. %v",
+				certErr)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// smtpAuth returns the authentication mechanism configured for the SMTP
+// server or nil when no user has been set.
+func smtpAuth(config EmailAlerts) smtp.Auth {
+	if len(config.SmtpUser) < 1 {
+		return nil
+	}
+
+	switch strings.ToLower(config.SmtpAuth) {
+	case "login":
+		return &loginAuth{
+			username: config.SmtpUser,
+			password: config.SmtpPassword,
+			host:     config.SmtpServer,
+		}
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(config.SmtpUser, config.SmtpPassword)
+	default:
+		return smtp.PlainAuth(config.SmtpIdentity, config.SmtpUser,
+			config.SmtpPassword, config.SmtpServer)
+	}
+}
+
+// sendMail delivers a message to the configured SMTP server using the
+// configured TLS mode and authentication mechanism.
+func sendMail(config EmailAlerts, message *email.Email) error {
+	tlsConfig, tlsErr := smtpTLSConfig(config)
+
+	if tlsErr != nil {
+		return tlsErr
+	}
+
+	serverWithPort := net.JoinHostPort(config.SmtpServer,
+		fmt.Sprintf("%v", config.SmtpPort))
+	tlsMode := strings.ToLower(config.SmtpTLS)
+
+	var conn net.Conn
+	var dialErr error
+
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+
+	if tlsMode == "tls" {
+		conn, dialErr = tls.DialWithDialer(dialer, "tcp", serverWithPort, tlsConfig)
+	} else {
+		conn, dialErr = dialer.Dial("tcp", serverWithPort)
+	}
+
+	if dialErr != nil {
+		return dialErr
+	}
+
+	if deadlineErr := conn.SetDeadline(time.Now().Add(smtpSessionTimeout)); deadlineErr != nil {
+		conn.Close()
+		return deadlineErr
+	}
+
+	client, clientErr := smtp.NewClient(conn, config.SmtpServer)
+
+	if clientErr != nil {
+		conn.Close()
+		return clientErr
+	}
+
+	defer client.Close()
+
+	if tlsMode == "starttls" || tlsMode == "" {
+		supported, _ := client.Extension("STARTTLS")
+
+		if supported {
+			if startErr := client.StartTLS(tlsConfig); startErr != nil {
+				return startErr
+			}
+		} else if tlsMode == "starttls" {
+			return errors.New("SMTP server doesn't support STARTTLS")
+		}
+	}
+
+	if auth := smtpAuth(config); auth != nil {
+		if authErr := client.Auth(auth); authErr != nil {
+			return authErr
+		}
+	}
+
+	from, fromErr := mail.ParseAddress(message.From)
+
+	if fromErr != nil {
+		return fromErr
+	}
+
+	if mailErr := client.Mail(from.Address); mailErr != nil {
+		return mailErr
+	}
+
+	recipients := make([]string, 0, len(message.To)+len(message.Cc)+len(message.Bcc))
+	recipients = append(recipients, message.To...)
+	recipients = append(recipients, message.Cc...)
+	recipients = append(recipients, message.Bcc...)
+
+	for _, recipient := range recipients {
+		address, addressErr := mail.ParseAddress(recipient)
+
+		if addressErr != nil {
+			return addressErr
+		}
+
+		if rcptErr := client.Rcpt(address.Address); rcptErr != nil {
+			return rcptErr
+		}
+	}
+
+	raw, rawErr := message.Bytes()
+
+	if rawErr != nil {
+		return rawErr
+	}
+
+	writer, dataErr := client.Data()
+
+	if dataErr != nil {
+		return dataErr
+	}
+
+	if _, writeErr := writer.Write(raw); writeErr != nil {
+		writer.Close()
+		return writeErr
+	}
+
+	if closeErr := writer.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	return client.Quit()
+}
+
+// loginAuth implements the non-standard but widely deployed LOGIN SMTP
+// authentication mechanism.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+
+	switch {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("Unexpected LOGIN challenge [%v]", string(fromServer))
+	}
+}
+
+// isLocalhost determines if the specified host name refers to the local
+// machine.
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,423 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/jordan-wright/email"
+)
+
+// smtpSession records what a client did while connected to the stub
+// SMTP server.
+type smtpSession struct {
+	authenticated bool
+	tls           bool
+	from          string
+	recipients    []string
+}
+
+// smtpStub is a minimal SMTP server used to verify the client behaviour.
+type smtpStub struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	startTLS  bool
+	username  string
+	password  string
+	sessions  chan smtpSession
+}
+
+// newSMTPStub starts a stub SMTP server on a random local port. When
+// implicitTLS is set the listener only accepts TLS connections.
+func newSMTPStub(t *testing.T, tlsConfig *tls.Config, implicitTLS bool) *smtpStub {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+
+	if implicitTLS {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	stub := &smtpStub{
+		listener:  listener,
+		tlsConfig: tlsConfig,
+		startTLS:  tlsConfig != nil && !implicitTLS,
+		username:  "auditor",
+		password:  "secret",
+		sessions:  make(chan smtpSession, 1),
+	}
+
+	go stub.serve(implicitTLS)
+
+	return stub
+}
+
+func (s *smtpStub) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStub) close() {
+	s.listener.Close()
+}
+
+func (s *smtpStub) serve(implicitTLS bool) {
+	conn, acceptErr := s.listener.Accept()
+
+	if acceptErr != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	session := smtpSession{tls: implicitTLS}
+	defer func() { s.sessions <- session }()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 stub ESMTP")
+
+	for {
+		line, readErr := text.ReadLine()
+
+		if readErr != nil {
+			return
+		}
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-stub")
+			if s.startTLS && !session.tls {
+				text.PrintfLine("250-STARTTLS")
+			}
+			text.PrintfLine("250 AUTH PLAIN LOGIN")
+		case "STARTTLS":
+			text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+
+			if tlsConn.Handshake() != nil {
+				return
+			}
+
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+			session.tls = true
+		case "AUTH":
+			session.authenticated = s.authenticate(text, line)
+
+			if session.authenticated {
+				text.PrintfLine("235 Authentication succeeded")
+			} else {
+				text.PrintfLine("535 Authentication failed")
+			}
+		case "MAIL":
+			session.from = smtpArgument(line)
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			session.recipients = append(session.recipients, smtpArgument(line))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			text.ReadDotBytes()
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Unrecognized command")
+		}
+	}
+}
+
+// authenticate handles the PLAIN and LOGIN authentication exchanges.
+func (s *smtpStub) authenticate(text *textproto.Conn, line string) bool {
+	fields := strings.Fields(line)
+
+	if len(fields) < 2 {
+		return false
+	}
+
+	switch strings.ToUpper(fields[1]) {
+	case "LOGIN":
+		text.PrintfLine("334 %v", base64.StdEncoding.EncodeToString([]byte("Username:")))
+		username := readBase64Line(text)
+		text.PrintfLine("334 %v", base64.StdEncoding.EncodeToString([]byte("Password:")))
+		password := readBase64Line(text)
+		return username == s.username && password == s.password
+	case "PLAIN":
+		var encoded string
+		if len(fields) > 2 {
+			encoded = fields[2]
+		} else {
+			text.PrintfLine("334 ")
+			encoded, _ = text.ReadLine()
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(encoded)
+		parts := strings.Split(string(decoded), "\x00")
+		return len(parts) == 3 && parts[1] == s.username && parts[2] == s.password
+	}
+
+	return false
+}
+
+func readBase64Line(text *textproto.Conn) string {
+	line, _ := text.ReadLine()
+	decoded, _ := base64.StdEncoding.DecodeString(line)
+	return string(decoded)
+}
+
+// smtpArgument extracts the address from a MAIL FROM or RCPT TO command.
+func smtpArgument(line string) string {
+	start := strings.Index(line, "<")
+	end := strings.LastIndex(line, ">")
+
+	if start < 0 || end < start {
+		return ""
+	}
+
+	return line[start+1 : end]
+}
+
+// generateTestCertificate creates a self-signed certificate for the
+// specified host name and writes it as a PEM CA bundle in a temporary
+// directory.
+func generateTestCertificate(t *testing.T, host string) (*tls.Config, string) {
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, certErr := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+
+	if certErr != nil {
+		t.Fatal(certErr)
+	}
+
+	dir, dirErr := ioutil.TempDir("", "nic-audit-smtp")
+
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if writeErr := ioutil.WriteFile(caFile, caPem, 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+	}
+
+	return tlsConfig, caFile
+}
+
+func testMessage() *email.Email {
+	message := email.NewEmail()
+	message.From = "Triton NIC Audit <audit@some.site>"
+	message.To = []string{"sysadmin@some.site"}
+	message.Bcc = []string{"Security <security@some.site>"}
+	message.Subject = "Test"
+	message.Text = []byte("Test message")
+	return message
+}
+
+func TestSendMailWithLoginAuthentication(t *testing.T) {
+	stub := newSMTPStub(t, nil, false)
+	defer stub.close()
+
+	config := EmailAlerts{
+		SmtpServer:   "127.0.0.1",
+		SmtpPort:     stub.port(),
+		SmtpTLS:      "none",
+		SmtpAuth:     "login",
+		SmtpUser:     "auditor",
+		SmtpPassword: "secret",
+	}
+
+	if err := sendMail(config, testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	session := <-stub.sessions
+
+	if !session.authenticated {
+		t.Error("Expected client to authenticate using LOGIN")
+	}
+
+	if session.from != "audit@some.site" {
+		t.Errorf("Unexpected sender: %v", session.from)
+	}
+
+	if len(session.recipients) != 2 {
+		t.Errorf("Expected 2 recipients including BCC. Actually: %v",
+			session.recipients)
+	}
+}
+
+func TestSendMailWithImplicitTLSAndPrivateCA(t *testing.T) {
+	serverTLS, caFile := generateTestCertificate(t, "smtp.some.site")
+	defer os.RemoveAll(filepath.Dir(caFile))
+
+	stub := newSMTPStub(t, serverTLS, true)
+	defer stub.close()
+
+	config := EmailAlerts{
+		SmtpServer:     "127.0.0.1",
+		SmtpPort:       stub.port(),
+		SmtpTLS:        "tls",
+		SmtpCAFile:     caFile,
+		SmtpServerName: "smtp.some.site",
+		SmtpUser:       "auditor",
+		SmtpPassword:   "secret",
+	}
+
+	if err := sendMail(config, testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	session := <-stub.sessions
+
+	if !session.tls || !session.authenticated {
+		t.Errorf("Expected authenticated TLS session. Actually: %+v", session)
+	}
+}
+
+func TestSendMailWithStartTLS(t *testing.T) {
+	serverTLS, caFile := generateTestCertificate(t, "smtp.some.site")
+	defer os.RemoveAll(filepath.Dir(caFile))
+
+	stub := newSMTPStub(t, serverTLS, false)
+	defer stub.close()
+
+	config := EmailAlerts{
+		SmtpServer:     "127.0.0.1",
+		SmtpPort:       stub.port(),
+		SmtpTLS:        "starttls",
+		SmtpCAFile:     caFile,
+		SmtpServerName: "smtp.some.site",
+	}
+
+	if err := sendMail(config, testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	session := <-stub.sessions
+
+	if !session.tls {
+		t.Error("Expected client to upgrade the connection with STARTTLS")
+	}
+}
+
+func TestSendMailFailsWhenStartTLSIsRequiredButUnsupported(t *testing.T) {
+	stub := newSMTPStub(t, nil, false)
+	defer stub.close()
+
+	config := EmailAlerts{
+		SmtpServer: "127.0.0.1",
+		SmtpPort:   stub.port(),
+		SmtpTLS:    "starttls",
+	}
+
+	if err := sendMail(config, testMessage()); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+
+	<-stub.sessions
+}
+
+func TestSendMailTimesOutWhenServerHangs(t *testing.T) {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+
+	defer listener.Close()
+
+	// Accept the connection but never send the SMTP greeting
+	go func() {
+		conn, acceptErr := listener.Accept()
+
+		if acceptErr == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	original := smtpSessionTimeout
+	smtpSessionTimeout = 100 * time.Millisecond
+	defer func() { smtpSessionTimeout = original }()
+
+	config := EmailAlerts{
+		SmtpServer: "127.0.0.1",
+		SmtpPort:   listener.Addr().(*net.TCPAddr).Port,
+		SmtpTLS:    "none",
+	}
+	started := time.Now()
+
+	if err := sendMail(config, testMessage()); err == nil {
+		t.Error("Expected error and none was thrown")
+	}
+
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("Expected sending to time out. Took: %v", elapsed)
+	}
+}
+
+func TestValidateSMTPSettingsRejectsUnknownValues(t *testing.T) {
+	if err := validateSMTPSettings(EmailAlerts{SmtpTLS: "ssl3"}); err == nil {
+		t.Error("Expected error for unknown TLS mode and none was thrown")
+	}
+
+	if err := validateSMTPSettings(EmailAlerts{SmtpAuth: "ntlm"}); err == nil {
+		t.Error("Expected error for unknown auth mechanism and none was thrown")
+	}
+
+	if err := validateSMTPSettings(EmailAlerts{SmtpAuth: "cram-md5"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/jordan-wright/email"
+)
+
+const (
+	// spoolRetryBase is the delay before the first retry of a spooled
+	// message. The delay doubles with every failed attempt.
+	spoolRetryBase = 5 * time.Minute
+	// spoolRetryMax is the longest delay between retries of a spooled
+	// message.
+	spoolRetryMax = 6 * time.Hour
+	// defaultSpoolMaxAge is used when no spool_max_age has been configured.
+	defaultSpoolMaxAge = 7 * 24 * time.Hour
+)
+
+// spooledEmail is an alert email that couldn't be delivered and has been
+// written to the spool directory to be retried later.
+type spooledEmail struct {
+	ID          string    `json:"-"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastError   string    `json:"last_error"`
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	CC          []string  `json:"cc"`
+	BCC         []string  `json:"bcc"`
+	Subject     string    `json:"subject"`
+	Text        string    `json:"text"`
+	HTML        string    `json:"html"`
+}
+
+// nextAttempt returns the earliest time at which the message should be
+// retried based on an exponential backoff from the last attempt.
+func (m spooledEmail) nextAttempt() time.Time {
+	delay := spoolRetryBase
+
+	for i := 1; i < m.Attempts && delay < spoolRetryMax; i++ {
+		delay *= 2
+	}
+
+	if delay > spoolRetryMax {
+		delay = spoolRetryMax
+	}
+
+	return m.LastAttempt.Add(delay)
+}
+
+// toEmail converts the spooled message back into a sendable email.
+func (m spooledEmail) toEmail() *email.Email {
+	mail := email.NewEmail()
+	mail.From = m.From
+	mail.To = m.To
+	mail.Cc = m.CC
+	mail.Bcc = m.BCC
+	mail.Subject = m.Subject
+	mail.Text = []byte(m.Text)
+	mail.HTML = []byte(m.HTML)
+
+	return mail
+}
+
+// spoolMaxAge parses the configured maximum age of spooled messages.
+func spoolMaxAge(config EmailAlerts) (time.Duration, error) {
+	if len(config.SpoolMaxAge) < 1 {
+		return defaultSpoolMaxAge, nil
+	}
+
+	maxAge, parseErr := time.ParseDuration(config.SpoolMaxAge)
+
+	if parseErr != nil {
+		return 0, fmt.Errorf("Invalid spool_max_age [%v]. %v",
+			config.SpoolMaxAge, parseErr)
+	}
+
+	return maxAge, nil
+}
+
+// spoolEmail writes an undeliverable email to the spool directory.
+func spoolEmail(spoolDir string, mail *email.Email, sendErr error) error {
+	if mkdirErr := os.MkdirAll(spoolDir, 0700); mkdirErr != nil {
+		return mkdirErr
+	}
+
+	now := time.Now()
+	message := spooledEmail{
+		Created:     now,
+		Attempts:    1,
+		LastAttempt: now,
+		LastError:   sendErr.Error(),
+		From:        mail.From,
+		To:          mail.To,
+		CC:          mail.Cc,
+		BCC:         mail.Bcc,
+		Subject:     mail.Subject,
+		Text:        string(mail.Text),
+		HTML:        string(mail.HTML),
+	}
+
+	suffix := make([]byte, 4)
+	if _, randErr := rand.Read(suffix); randErr != nil {
+		return randErr
+	}
+
+	message.ID = fmt.Sprintf("%d-%v", now.UnixNano(), hex.EncodeToString(suffix))
+
+	return writeSpooledEmail(spoolDir, message)
+}
+
+// writeSpooledEmail atomically writes a spooled message to disk.
+func writeSpooledEmail(spoolDir string, message spooledEmail) error {
+	data, marshalErr := json.MarshalIndent(message, "", "  ")
+
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	return writeFileAtomically(filepath.Join(spoolDir, message.ID+".json"),
+		data, 0600)
+}
+
+// listSpooledEmails reads every message in the spool directory ordered
+// from oldest to newest.
+func listSpooledEmails(spoolDir string) ([]spooledEmail, error) {
+	files, readErr := ioutil.ReadDir(spoolDir)
+
+	if os.IsNotExist(readErr) {
+		return nil, nil
+	}
+
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	messages := make([]spooledEmail, 0, len(files))
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		data, fileErr := ioutil.ReadFile(filepath.Join(spoolDir, file.Name()))
+
+		if fileErr != nil {
+			return nil, fileErr
+		}
+
+		var message spooledEmail
+
+		if jsonErr := json.Unmarshal(data, &message); jsonErr != nil {
+			log.Printf("Ignoring unreadable spooled email [%v]: %v\n",
+				file.Name(), jsonErr)
+			continue
+		}
+
+		message.ID = strings.TrimSuffix(file.Name(), ".json")
+		messages = append(messages, message)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Created.Before(messages[j].Created)
+	})
+
+	return messages, nil
+}
+
+// flushSpool attempts to deliver every spooled message for the specified
+// email configuration. Messages older than the maximum spool age are
+// discarded. Unless force is set, messages are only retried once their
+// backoff delay has elapsed. The number of messages delivered is returned.
+func flushSpool(config EmailAlerts, force bool) (int, error) {
+	maxAge, maxAgeErr := spoolMaxAge(config)
+
+	if maxAgeErr != nil {
+		return 0, maxAgeErr
+	}
+
+	messages, listErr := listSpooledEmails(config.SpoolDir)
+
+	if listErr != nil {
+		return 0, listErr
+	}
+
+	now := time.Now()
+	delivered := 0
+
+	for _, message := range messages {
+		path := filepath.Join(config.SpoolDir, message.ID+".json")
+
+		if now.Sub(message.Created) > maxAge {
+			log.Printf("Discarding spooled email [%v] older than %v: %v\n",
+				message.ID, maxAge, message.Subject)
+			os.Remove(path)
+			continue
+		}
+
+		if !force && now.Before(message.nextAttempt()) {
+			continue
+		}
+
+		sendErr := sendMail(config, message.toEmail())
+
+		if sendErr == nil {
+			log.Printf("Delivered spooled email [%v]: %v\n", message.ID,
+				message.Subject)
+			os.Remove(path)
+			delivered++
+			continue
+		}
+
+		log.Printf("Error delivering spooled email [%v]. %v\n", message.ID,
+			sendErr)
+
+		message.Attempts++
+		message.LastAttempt = now
+		message.LastError = sendErr.Error()
+
+		if writeErr := writeSpooledEmail(config.SpoolDir, message); writeErr != nil {
+			return delivered, writeErr
+		}
+	}
+
+	return delivered, nil
+}
+
+// spoolingEmailConfigs returns every email configuration, both global and
+// per-sink, that has a spool directory configured.
+func spoolingEmailConfigs(config Configuration) []EmailAlerts {
+	configs := make([]EmailAlerts, 0, 1)
+	seen := make(map[string]bool)
+
+	candidates := []EmailAlerts{config.EmailAlerts}
+	for _, sinkConfig := range config.AlertSinks {
+		if sinkConfig.Email != nil {
+			candidates = append(candidates, *sinkConfig.Email)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if len(candidate.SpoolDir) < 1 || seen[candidate.SpoolDir] {
+			continue
+		}
+
+		seen[candidate.SpoolDir] = true
+		configs = append(configs, candidate)
+	}
+
+	return configs
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2017, Joyent, Inc. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSpoolEmailCanBeListed(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+
+	spoolErr := spoolEmail(dir, testMessage(), errors.New("connection refused"))
+
+	if spoolErr != nil {
+		t.Fatal(spoolErr)
+	}
+
+	messages, listErr := listSpooledEmails(dir)
+
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 spooled email. Actually: %v", len(messages))
+	}
+
+	if messages[0].Subject != "Test" || messages[0].LastError != "connection refused" {
+		t.Errorf("Unexpected spooled email: %+v", messages[0])
+	}
+}
+
+func TestFlushSpoolDiscardsExpiredEmails(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+
+	expired := spooledEmail{
+		ID:      "expired",
+		Created: time.Now().Add(-2 * time.Hour),
+		Subject: "Old",
+	}
+
+	if err := writeSpooledEmail(dir, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	config := EmailAlerts{SpoolDir: dir, SpoolMaxAge: "1h"}
+	delivered, flushErr := flushSpool(config, true)
+
+	if flushErr != nil {
+		t.Fatal(flushErr)
+	}
+
+	messages, _ := listSpooledEmails(dir)
+
+	if delivered != 0 || len(messages) != 0 {
+		t.Errorf("Expected expired email to be discarded. Delivered: %v "+
+			"Remaining: %v", delivered, len(messages))
+	}
+}
+
+func TestFlushSpoolDeliversAndRemovesEmails(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+
+	stub := newSMTPStub(t, nil, false)
+	defer stub.close()
+
+	if err := spoolEmail(dir, testMessage(), errors.New("timeout")); err != nil {
+		t.Fatal(err)
+	}
+
+	config := EmailAlerts{
+		SmtpServer: "127.0.0.1",
+		SmtpPort:   stub.port(),
+		SmtpTLS:    "none",
+		SpoolDir:   dir,
+	}
+
+	delivered, flushErr := flushSpool(config, true)
+
+	if flushErr != nil {
+		t.Fatal(flushErr)
+	}
+
+	<-stub.sessions
+	messages, _ := listSpooledEmails(dir)
+
+	if delivered != 1 || len(messages) != 0 {
+		t.Errorf("Expected spooled email to be delivered. Delivered: %v "+
+			"Remaining: %v", delivered, len(messages))
+	}
+}
+
+func TestFlushSpoolWaitsForBackoffUnlessForced(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+
+	if err := spoolEmail(dir, testMessage(), errors.New("timeout")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens on this server so a forced delivery would fail
+	config := EmailAlerts{
+		SmtpServer: "127.0.0.1",
+		SmtpPort:   1,
+		SpoolDir:   dir,
+	}
+
+	if _, err := flushSpool(config, false); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, _ := listSpooledEmails(dir)
+
+	if len(messages) != 1 || messages[0].Attempts != 1 {
+		t.Errorf("Expected spooled email to be left untouched: %+v", messages)
+	}
+}
+
+func TestSpooledEmailBackoffDoublesUpToMaximum(t *testing.T) {
+	message := spooledEmail{Attempts: 1}
+
+	if delay := message.nextAttempt().Sub(message.LastAttempt); delay != spoolRetryBase {
+		t.Errorf("Unexpected first retry delay: %v", delay)
+	}
+
+	message.Attempts = 3
+
+	if delay := message.nextAttempt().Sub(message.LastAttempt); delay != 4*spoolRetryBase {
+		t.Errorf("Unexpected third retry delay: %v", delay)
+	}
+
+	message.Attempts = 50
+
+	if delay := message.nextAttempt().Sub(message.LastAttempt); delay != spoolRetryMax {
+		t.Errorf("Unexpected maximum retry delay: %v", delay)
+	}
+}